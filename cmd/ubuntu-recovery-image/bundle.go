@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/fat"
+	"github.com/Lyoncore/ubuntu-recovery-image/update"
+	utils "github.com/Lyoncore/ubuntu-recovery-image/utils"
+)
+
+// fatFiles adds the regular files under dir of fs to files.
+func fatFiles(fs *fat.Filesystem, dir string, files map[string]bool) error {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := path.Join(dir, e.Name())
+		if e.IsDir() {
+			if err := fatFiles(fs, name, files); err != nil {
+				return err
+			}
+			continue
+		}
+		files[name] = true
+	}
+
+	return nil
+}
+
+// bundlePaths returns the paths of files of a and b, sorted, with the
+// buildstamp last so that an update records its target once complete.
+func bundlePaths(a, b map[string]bool) []string {
+	var paths []string
+	for p := range a {
+		paths = append(paths, p)
+	}
+	for p := range b {
+		if !a[p] {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	for i, p := range paths {
+		if p == utils.BuildStampFile {
+			paths = append(append(paths[:i:i], paths[i+1:]...), p)
+			break
+		}
+	}
+
+	return paths
+}
+
+func stampOf(r *recoveryImage) utils.BuildStamp {
+	if s := r.report.Recovery.BuildStamp; s != nil {
+		return *s
+	}
+
+	return utils.BuildStamp{}
+}
+
+// writeBundle writes to bw the update from the recovery partition of
+// oldImage to the one of newImage: the new files, and deltas of the
+// changed files when they are smaller than the files.
+func writeBundle(bw *update.Writer, oldImage, newImage *recoveryImage) error {
+	oldFiles, newFiles := map[string]bool{}, map[string]bool{}
+	if err := fatFiles(oldImage.fs, "", oldFiles); err != nil {
+		return err
+	}
+	if err := fatFiles(newImage.fs, "", newFiles); err != nil {
+		return err
+	}
+
+	for _, p := range bundlePaths(oldFiles, newFiles) {
+		if strings.HasPrefix(p, update.StageDir+"/") {
+			continue
+		}
+
+		var err error
+		f := update.File{Path: p}
+		if oldFiles[p] {
+			if f.Old, _, err = fatSHA256(oldImage.fs, p); err != nil {
+				return err
+			}
+		}
+		if newFiles[p] {
+			if f.New, f.Size, err = fatSHA256(newImage.fs, p); err != nil {
+				return err
+			}
+		}
+		if f.Old == f.New {
+			continue
+		}
+
+		switch {
+		case f.Removed():
+			log.Printf("remove %s", p)
+			err = bw.Add(f, nil, 0)
+		case f.Old == "":
+			log.Printf("add %s (%s)", p, humanSize(f.Size))
+			err = addFatFile(bw, f, newImage.fs)
+		default:
+			err = addChangedFile(bw, f, oldImage.fs, newImage.fs)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return bw.Close()
+}
+
+// fatSHA256 returns the SHA-256 and the size of the file name of fs.
+func fatSHA256(fs *fat.Filesystem, name string) (string, int64, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// addFatFile adds f to bw with its content in fs as payload.
+func addFatFile(bw *update.Writer, f update.File, fs *fat.Filesystem) error {
+	in, err := fs.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return bw.Add(f, in, in.Size())
+}
+
+// addChangedFile adds f to bw with a delta from its content in oldFS as
+// payload, or with its content in newFS when the delta is not smaller.
+// Only changed files are read in memory, for update.Delta.
+func addChangedFile(bw *update.Writer, f update.File, oldFS, newFS *fat.Filesystem) error {
+	oldData, err := oldFS.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	newData, err := newFS.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+
+	payload := newData
+	if d := update.Delta(oldData, newData); len(d) < len(newData) {
+		payload = d
+		f.Delta = true
+	}
+	log.Printf("update %s (%s, payload %s)", f.Path, humanSize(f.Size), humanSize(int64(len(payload))))
+
+	return bw.Add(f, bytes.NewReader(payload), int64(len(payload)))
+}
+
+// runBundle implements "ubuntu-recovery-image bundle -key key.pem [-o file]
+// <old.img> <new.img>".
+func runBundle(args []string) int {
+	fs := newCommandFlags("bundle")
+	keyFile := fs.String("key", "", "PEM encoded RSA private key signing the bundle")
+	output := fs.String("o", "update.bundle", "Bundle file to write")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 2 || *keyFile == "" {
+		fs.Usage()
+		return exitUsage
+	}
+
+	key, err := update.LoadPrivateKey(*keyFile)
+	if err != nil {
+		return fail(exitUsage, "%v", err)
+	}
+
+	var images []*recoveryImage
+	for _, image := range fs.Args() {
+		r, err := openRecoveryImage(image)
+		if err != nil {
+			return fail(exitFailed, "%v", err)
+		}
+		defer r.Close()
+		images = append(images, r)
+	}
+
+	out, err := os.Create(*output)
+	if err != nil {
+		return fail(exitFailed, "%v", err)
+	}
+	bw := update.NewWriter(out, key, stampOf(images[0]), stampOf(images[1]))
+	err = writeBundle(bw, images[0], images[1])
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(*output)
+		return fail(exitFailed, "%v", err)
+	}
+	log.Printf("wrote update bundle %s", *output)
+
+	return exitOK
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Exit codes shared by every subcommand.
+const (
+	exitOK = 0
+	// exitFailed is a build or check that ran and failed.
+	exitFailed = 1
+	// exitUsage is a wrong command line or config.
+	exitUsage = 2
+	// exitHost is a host that cannot run the command: missing tools or
+	// privileges.
+	exitHost = 3
+)
+
+// command is a subcommand of ubuntu-recovery-image.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands []command
+
+// xzImageHelp is the help of the commands reading .xz images, see
+// openImageFile.
+const xzImageHelp = `An .xz image is decompressed to a sparse temporary file in the work
+directory before it is read, so the work directory needs room for the whole
+decompressed image.`
+
+// commandHelp is printed by "<command> -help" after the summary.
+var commandHelp = map[string]string{
+	"inspect": xzImageHelp,
+	"diff":    xzImageHelp,
+	"bundle":  xzImageHelp,
+	"extract": xzImageHelp,
+	"flash": `A device is a whole disk or a regular file. A file which does not exist
+is created, outside of /dev, and grown to the size of the image.`,
+}
+
+func init() {
+	// set up here, as runHelp refers to commands
+	commands = []command{
+		{"build", "[-o image]", "build the recovery image (the default command)", runBuild},
+		{"plan", "", "print the image layout the build would use", runPlan},
+		{"validate", "[config.yaml...]", "check config.yaml without building", runValidate},
+		{"verify", "", "verify the seed snaps of the base image against their assertions", runVerify},
+		{"inspect", "[-json] <image>", "print the partitions, buildstamp, snaps and config of a recovery image", runInspect},
+		{"diff", "<old.img> <new.img>", "print the changes between two recovery images as release notes", runDiff},
+		{"bundle", "-key key.pem [-o file] <old.img> <new.img>", "write a signed bundle updating the recovery partition of old.img devices to new.img", runBundle},
+		{"extract", "[-o dest] [-unpack] <image> <path>", "copy a file or directory of the recovery partition out of an image", runExtract},
+		{"flash", "[-bmap file] [-no-verify] <image> <device>...", "write an image to block devices in parallel and verify them", runFlash},
+		{"refresh", "[-kernel snap] [-gadget snap] [-os snap] [-initrd] [-includes] [-env] <image>", "replace snaps, initrd, includes or boot environment of a built image in place", runRefresh},
+		{"init", "<base.img>", "create config.yaml and include directories for a base image", runInit},
+		{"migrate-config", "[-dry-run] [config.yaml...]", "update config files to the current schemaversion", runMigrate},
+		{"serial", "sign|mock [config.yaml]", "request a serial assertion or generate mock assertions", runSerial},
+		{"help", "[command]", "print the help of a command", runHelp},
+	}
+}
+
+var (
+	logFormat string
+	verbose   bool
+	quiet     bool
+)
+
+// setupLogging applies the global -log-format, -v and -q flags.
+func setupLogging() error {
+	var out io.Writer = os.Stderr
+	if quiet {
+		out = ioutil.Discard
+	}
+
+	switch logFormat {
+	case "text":
+		flags := log.LstdFlags
+		if verbose {
+			flags |= log.Lshortfile
+		}
+		log.SetFlags(flags)
+		log.SetOutput(out)
+	case "json":
+		flags := 0
+		if verbose {
+			flags = log.Lshortfile
+		}
+		log.SetFlags(flags)
+		log.SetOutput(&jsonLogWriter{out: out, level: "info"})
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", logFormat)
+	}
+
+	return nil
+}
+
+// jsonLogWriter writes every log line as a JSON object.
+type jsonLogWriter struct {
+	out   io.Writer
+	level string
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	b, err := json.Marshal(struct {
+		Time    string `json:"time"`
+		Level   string `json:"level"`
+		Message string `json:"msg"`
+	}{time.Now().UTC().Format(time.RFC3339), w.level, strings.TrimSuffix(string(p), "\n")})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.out.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// fail reports an error, even with -q, and returns code.
+func fail(code int, format string, a ...interface{}) int {
+	msg := fmt.Sprintf(format, a...)
+	if currentBuild != nil {
+		currentBuild.lastError = msg
+	}
+	if logFormat == "json" {
+		w := &jsonLogWriter{out: os.Stderr, level: "error"}
+		w.Write([]byte(msg))
+	} else {
+		fmt.Fprintln(os.Stderr, "Error:", msg)
+	}
+
+	return code
+}
+
+// catchPanic runs f and returns the panic of rplib.Checkerr and the like
+// as an error, once the deferred cleanups of f have run.
+func catchPanic(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			// keep the type of the errors, see hostError
+			if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+	f()
+
+	return nil
+}
+
+// newCommandFlags returns the flag set of a subcommand, with its help.
+func newCommandFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		for _, c := range commands {
+			if c.name == name {
+				fmt.Fprintf(os.Stderr, "usage: %s\n\n%s.\n", strings.TrimSpace("ubuntu-recovery-image [global flags] "+c.name+" "+c.args), strings.ToUpper(c.summary[:1])+c.summary[1:])
+				if help := commandHelp[name]; help != "" {
+					fmt.Fprintf(os.Stderr, "\n%s\n", help)
+				}
+			}
+		}
+		var hasFlags bool
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintln(os.Stderr, "\nFlags:")
+			fs.PrintDefaults()
+		}
+	}
+
+	return fs
+}
+
+// parseCommandFlags parses the flags of a subcommand, which may follow its
+// arguments until "--". It returns false with the exit code when the
+// command must not run, as after -help.
+func parseCommandFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if err == flag.ErrHelp {
+				return exitOK, false
+			}
+			return exitUsage, false
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			break
+		}
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			positional = append(positional, rest...)
+			break
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+
+	// leaves fs.Args() to the arguments, keeping the flags set above
+	fs.Parse(append([]string{"--"}, positional...))
+
+	return exitOK, true
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "usage: ubuntu-recovery-image [global flags] [command] [flags]")
+	fmt.Fprintln(os.Stderr, "\nRun in the config repo, or pass -config-dir. Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-15s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nGlobal flags:")
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "\nExit codes: 0 ok, 1 failed, 2 usage or config error, 3 host error (missing tools or privileges).")
+	fmt.Fprintln(os.Stderr, "Run \"ubuntu-recovery-image help <command>\" for the flags of a command.")
+}
+
+// runHelp implements "ubuntu-recovery-image help [command]".
+func runHelp(args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return exitOK
+	}
+
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run([]string{"-help"})
+		}
+	}
+
+	return fail(exitUsage, "unknown command %q", args[0])
+}
+
+// runCommand runs the subcommand named by args[0], build by default.
+func runCommand(args []string) int {
+	if len(args) == 0 {
+		return runBuild(nil)
+	}
+
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(args[1:])
+		}
+	}
+
+	fail(exitUsage, "unknown command %q", args[0])
+	printUsage()
+	return exitUsage
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/config"
+)
+
+// stringsFlag is a flag that may be given several times.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+var (
+	// configFiles are merged in order, later files overriding earlier ones.
+	configFiles stringsFlag
+	// configSets are key=value overrides applied after the files.
+	configSets stringsFlag
+	// variant is the section of variants: applied over the files.
+	variant string
+	// effectiveConfig is the merged config.yaml the build uses.
+	effectiveConfig string
+)
+
+// configFilePaths returns the config files, config.yaml by default.
+func configFilePaths() []string {
+	files := []string{configPath("config.yaml")}
+	if len(configFiles) > 0 {
+		files = nil
+		for _, f := range configFiles {
+			files = append(files, configPath(f))
+		}
+	}
+
+	return files
+}
+
+// mergeConfig merges the config files, the variant and the overrides.
+func mergeConfig() (*config.Document, error) {
+	return config.Merge(configFilePaths(), variant, configSets)
+}
+
+// writeEffectiveConfig writes the merged config to a config.yaml in dir,
+// or in a new temporary directory if dir is empty, and loads it.
+func writeEffectiveConfig(doc *config.Document, dir string) (string, error) {
+	if dir == "" {
+		var err error
+		if dir, err = ioutil.TempDir("", ""); err != nil {
+			return "", err
+		}
+	}
+
+	path := filepath.Join(dir, "config.yaml")
+	if err := doc.WriteFile(path); err != nil {
+		return "", err
+	}
+	if err := configs.Load(path); err != nil {
+		return "", err
+	}
+	if err := options.Load(path); err != nil {
+		return "", err
+	}
+	resolveConfigPaths()
+
+	return path, nil
+}
+
+// loadConfig loads the effective config of the build and prints it with
+// the origin of every value.
+func loadConfig() error {
+	doc, err := mergeConfig()
+	if err != nil {
+		return err
+	}
+
+	effectiveConfig, err = writeEffectiveConfig(doc, workDir)
+	if err != nil {
+		return err
+	}
+
+	annotated, err := doc.Encode(true)
+	if err != nil {
+		return err
+	}
+	log.Printf("[effective config %s]\n%s", effectiveConfig, annotated)
+
+	return nil
+}
+
+// removeEffectiveConfig removes the effective config unless it is kept
+// in the work dir.
+func removeEffectiveConfig() {
+	if workDir == "" && effectiveConfig != "" {
+		os.RemoveAll(filepath.Dir(effectiveConfig))
+	}
+}
+
+// loadBuildConfig loads the config for the commands working on the base
+// image and checks its schema version and base image. It returns exitOK,
+// or the exit code to return.
+func loadBuildConfig() int {
+	if err := loadConfig(); err != nil {
+		return fail(exitUsage, "%v", err)
+	}
+	if err := checkSchemaVersion(); err != nil {
+		return fail(exitUsage, "%v", err)
+	}
+
+	log.Printf("[Base image is %s]", configs.Configs.BaseImage)
+	if _, err := os.Stat(configs.Configs.BaseImage); err != nil {
+		return fail(exitUsage, "can not find base image: %s, please build base image first", configs.Configs.BaseImage)
+	}
+
+	return exitOK
+}
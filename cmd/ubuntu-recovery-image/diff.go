@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/disk"
+	"github.com/Lyoncore/ubuntu-recovery-image/fat"
+	utils "github.com/Lyoncore/ubuntu-recovery-image/utils"
+)
+
+const initrdFile = "initrd.img"
+
+// recoveryImage is an image opened for diff or extract.
+type recoveryImage struct {
+	report  *imageReport
+	file    *os.File
+	fs      *fat.Filesystem
+	cleanup func()
+}
+
+// openRecoveryImage opens the recovery partition of image, which may be
+// compressed with xz. Errors name image.
+func openRecoveryImage(image string) (r *recoveryImage, err error) {
+	name, cleanup, err := openImageFile(image)
+	if err != nil {
+		return nil, imageError(image, err)
+	}
+	defer func() {
+		if err != nil {
+			cleanup()
+			err = imageError(image, err)
+		}
+	}()
+
+	report, err := inspectImage(name)
+	if err != nil {
+		return nil, err
+	}
+	if report.Recovery == nil {
+		return nil, fmt.Errorf("no recovery partition found")
+	}
+	report.Image = image
+
+	table, err := disk.ReadTableFile(name)
+	if err != nil {
+		return nil, err
+	}
+	p := table.Partition(report.Recovery.Partition)
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := fat.New(io.NewSectionReader(f, p.Start, p.Size))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &recoveryImage{report: report, file: f, fs: fs, cleanup: cleanup}, nil
+}
+
+func (r *recoveryImage) Close() error {
+	err := r.file.Close()
+	r.cleanup()
+
+	return err
+}
+
+// tree lists the archive name of the recovery partition with list, and
+// returns nil when it is missing.
+func (r *recoveryImage) tree(name string, list func(io.Reader) (fileTree, error)) (fileTree, error) {
+	f, err := r.fs.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t, err := list(bufio.NewReaderSize(f, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	return t, nil
+}
+
+// sum returns the SHA-256 of the file name of the recovery partition.
+func (r *recoveryImage) sum(name string) ([]byte, error) {
+	f, err := r.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	return h.Sum(nil), nil
+}
+
+// changeList collects the lines of a section of the release notes.
+type changeList []string
+
+func (l *changeList) addf(format string, a ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, a...))
+}
+
+func printSection(w io.Writer, title string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n## %s\n\n", title)
+	for _, l := range lines {
+		fmt.Fprintf(w, "- %s\n", l)
+	}
+}
+
+func diffValue(l *changeList, what, a, b string) {
+	if a != b {
+		l.addf("%s: %s → %s", what, orNone(a), orNone(b))
+	}
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+
+	return s
+}
+
+func diffBuildStamp(a, b *utils.BuildStamp) changeList {
+	var l changeList
+	switch {
+	case a == nil && b == nil:
+		return l
+	case a == nil:
+		l.addf("buildstamp added")
+		return l
+	case b == nil:
+		l.addf("buildstamp removed")
+		return l
+	}
+
+	diffValue(&l, "build date", a.BuildDate.Format(time.RFC3339), b.BuildDate.Format(time.RFC3339))
+	diffValue(&l, "build tool", formatProject(a.BuildTool), formatProject(b.BuildTool))
+	diffValue(&l, "config", formatProject(a.BuildConfig), formatProject(b.BuildConfig))
+	diffValue(&l, "variant", orNone(a.Variant), orNone(b.Variant))
+	if len(b.Refreshes) > len(a.Refreshes) && a.BuildDate.Equal(b.BuildDate) {
+		for _, r := range b.Refreshes[len(a.Refreshes):] {
+			l.addf("refreshed %s with config %s: %s", r.Date.Format(time.RFC3339), r.BuildConfig.Version, strings.Join(r.Replaced, ", "))
+		}
+	}
+
+	return l
+}
+
+func diffPartitions(a, b []partitionReport) changeList {
+	var l changeList
+	describe := func(p partitionReport) string {
+		return fmt.Sprintf("%s at %d, %s, %s %s", orNone(p.Name), p.Start, humanSize(p.Size), orNone(p.Fs), p.Label)
+	}
+
+	byNumber := map[int]partitionReport{}
+	for _, p := range b {
+		byNumber[p.Number] = p
+	}
+	for _, pa := range a {
+		pb, ok := byNumber[pa.Number]
+		delete(byNumber, pa.Number)
+		switch {
+		case !ok:
+			l.addf("partition %d removed: %s", pa.Number, describe(pa))
+		case describe(pa) != describe(pb):
+			l.addf("partition %d: %s → %s", pa.Number, describe(pa), describe(pb))
+		}
+	}
+	for _, pb := range b {
+		if _, ok := byNumber[pb.Number]; ok {
+			l.addf("partition %d added: %s", pb.Number, describe(pb))
+		}
+	}
+
+	return l
+}
+
+func diffSnaps(a, b []utils.SnapInfo) changeList {
+	var l changeList
+	describe := func(s utils.SnapInfo) string {
+		d := fmt.Sprintf("%s %s", s.Name, s.Version)
+		if s.Revision != "" {
+			d += fmt.Sprintf(" (revision %s)", s.Revision)
+		}
+		return d
+	}
+
+	byType := map[string]utils.SnapInfo{}
+	for _, s := range b {
+		byType[s.Type] = s
+	}
+	for _, sa := range a {
+		sb, ok := byType[sa.Type]
+		delete(byType, sa.Type)
+		switch {
+		case !ok:
+			l.addf("%s snap removed: %s", sa.Type, describe(sa))
+		case sa != sb:
+			l.addf("%s snap: %s → %s", sa.Type, describe(sa), describe(sb))
+		}
+	}
+	for _, sb := range b {
+		if _, ok := byType[sb.Type]; ok {
+			l.addf("%s snap added: %s", sb.Type, describe(sb))
+		}
+	}
+
+	return l
+}
+
+func diffEnv(a, b []envVar) changeList {
+	var l changeList
+	values := map[string]string{}
+	for _, v := range b {
+		values[v.Name] = v.Value
+	}
+	for _, va := range a {
+		vb, ok := values[va.Name]
+		delete(values, va.Name)
+		switch {
+		case !ok:
+			l.addf("%s removed (was %q)", va.Name, va.Value)
+		case va.Value != vb:
+			l.addf("%s: %q → %q", va.Name, va.Value, vb)
+		}
+	}
+	for _, vb := range b {
+		if _, ok := values[vb.Name]; ok {
+			l.addf("%s added: %q", vb.Name, vb.Value)
+		}
+	}
+
+	return l
+}
+
+// diffFactory lists the files of recovery/factory added, removed or
+// changed; the files of the same size are compared by checksum.
+func diffFactory(oldImage, newImage *recoveryImage) (changeList, error) {
+	var l changeList
+	sizes := map[string]int64{}
+	for _, f := range newImage.report.Recovery.Factory {
+		sizes[f.Name] = f.Size
+	}
+	for _, fa := range oldImage.report.Recovery.Factory {
+		sb, ok := sizes[fa.Name]
+		delete(sizes, fa.Name)
+		switch {
+		case !ok:
+			l.addf("%s removed (%s)", fa.Name, humanSize(fa.Size))
+		case fa.Size != sb:
+			l.addf("%s: %s → %s", fa.Name, humanSize(fa.Size), humanSize(sb))
+		default:
+			name := path.Join(factoryDir, fa.Name)
+			suma, err := oldImage.sum(name)
+			if err != nil {
+				return nil, err
+			}
+			sumb, err := newImage.sum(name)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(suma, sumb) {
+				l.addf("%s: content changed (%s)", fa.Name, humanSize(sb))
+			}
+		}
+	}
+	for _, fb := range newImage.report.Recovery.Factory {
+		if _, ok := sizes[fb.Name]; ok {
+			l.addf("%s added (%s)", fb.Name, humanSize(fb.Size))
+		}
+	}
+
+	return l, nil
+}
+
+// describeTreeChanges turns file changes into lines with sizes.
+func describeTreeChanges(changes []treeChange) changeList {
+	var added, removed, modified int
+	var l changeList
+	for _, c := range changes {
+		switch {
+		case c.Old == nil:
+			added++
+			l.addf("added %s (%s)", c.Path, describeTreeFile(c.New))
+		case c.New == nil:
+			removed++
+			l.addf("removed %s (%s)", c.Path, describeTreeFile(c.Old))
+		default:
+			modified++
+			before, after := describeTreeFile(c.Old), describeTreeFile(c.New)
+			if before == after {
+				l.addf("modified %s (%s, content changed)", c.Path, after)
+			} else {
+				l.addf("modified %s (%s → %s)", c.Path, before, after)
+			}
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	summary := fmt.Sprintf("%d added, %d removed, %d modified", added, removed, modified)
+	return append(changeList{summary}, l...)
+}
+
+func describeTreeFile(f *treeFile) string {
+	switch {
+	case f.Mode&os.ModeSymlink != 0:
+		return "symlink to " + f.Link
+	case f.Mode.IsDir():
+		return fmt.Sprintf("directory, %s", f.Mode.Perm())
+	case f.Link != "":
+		return "hard link to " + f.Link
+	}
+
+	return fmt.Sprintf("%s, %s", humanSize(f.Size), f.Mode.Perm())
+}
+
+// isArchive tells whether the factory file name is a tar archive.
+func isArchive(name string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".tar.xz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// diffImages writes the changes from the old to the new image as
+// Markdown release notes.
+func diffImages(w io.Writer, oldImage, newImage *recoveryImage) error {
+	a, b := oldImage.report, newImage.report
+	ra, rb := a.Recovery, b.Recovery
+
+	fmt.Fprintf(w, "# Changes from %s to %s\n", path.Base(a.Image), path.Base(b.Image))
+	cw := &countingWriter{w: w}
+	w = cw
+
+	printSection(w, "Build", diffBuildStamp(ra.BuildStamp, rb.BuildStamp))
+	var parts changeList
+	diffValue(&parts, "partition table", a.Schema, b.Schema)
+	diffValue(&parts, "recovery partition", fmt.Sprintf("%d, %s %s", ra.Partition, ra.Fs, ra.Label), fmt.Sprintf("%d, %s %s", rb.Partition, rb.Fs, rb.Label))
+	parts = append(parts, diffPartitions(a.Partitions, b.Partitions)...)
+	printSection(w, "Partitions", parts)
+	printSection(w, "Snaps", diffSnaps(ra.Snaps, rb.Snaps))
+
+	var env changeList
+	if ra.EnvFile != rb.EnvFile {
+		env.addf("boot environment file: %s → %s", orNone(ra.EnvFile), orNone(rb.EnvFile))
+	}
+	env = append(env, diffEnv(ra.Env, rb.Env)...)
+	printSection(w, "Boot environment", env)
+
+	if d := utils.UnifiedDiff("old/"+recoveryConfigFile, "new/"+recoveryConfigFile, ra.Config, rb.Config); d != "" {
+		fmt.Fprintf(w, "\n## %s\n\n```diff\n%s```\n", recoveryConfigFile, d)
+	}
+
+	ta, err := oldImage.tree(initrdFile, initrdTree)
+	if err != nil {
+		return err
+	}
+	tb, err := newImage.tree(initrdFile, initrdTree)
+	if err != nil {
+		return err
+	}
+	printSection(w, initrdFile, describeTreeChanges(diffTrees(ta, tb)))
+
+	factory, err := diffFactory(oldImage, newImage)
+	if err != nil {
+		return err
+	}
+	printSection(w, factoryDir, factory)
+	for _, f := range rb.Factory {
+		if !isArchive(f.Name) {
+			continue
+		}
+		name := path.Join(factoryDir, f.Name)
+		// an archive new in newImage lists all its files as added
+		ta, err := oldImage.tree(name, tarTree)
+		if err != nil {
+			return err
+		}
+		tb, err := newImage.tree(name, tarTree)
+		if err != nil {
+			return err
+		}
+		printSection(w, name, describeTreeChanges(diffTrees(ta, tb)))
+	}
+
+	if cw.n == 0 {
+		fmt.Fprintln(w, "\nNo changes.")
+	}
+
+	return nil
+}
+
+// countingWriter tells whether anything was written.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// runDiff implements "ubuntu-recovery-image diff <old.img> <new.img>".
+func runDiff(args []string) int {
+	fs := newCommandFlags("diff")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	var images []*recoveryImage
+	for _, image := range fs.Args() {
+		r, err := openRecoveryImage(image)
+		if err != nil {
+			return fail(exitFailed, "%v", err)
+		}
+		defer r.Close()
+		images = append(images, r)
+	}
+
+	if err := diffImages(os.Stdout, images[0], images[1]); err != nil {
+		return fail(exitFailed, "%v", err)
+	}
+
+	return exitOK
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/cpio"
+	"github.com/Lyoncore/ubuntu-recovery-image/fat"
+)
+
+// extractPath copies the file or directory name of the recovery partition
+// to dest.
+func extractPath(fs *fat.Filesystem, name, dest string) error {
+	fi, err := fs.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return extractFile(fs, name, dest)
+	}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	entries, err := fs.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := extractPath(fs, path.Join(name, e.Name()), filepath.Join(dest, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func extractFile(fs *fat.Filesystem, name, dest string) error {
+	f, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, f); err != nil {
+		out.Close()
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	fi, _ := f.Stat()
+	return os.Chtimes(dest, fi.ModTime(), fi.ModTime())
+}
+
+// unpackInitrd unpacks the initrd name of the recovery partition into the
+// directory dest. Device nodes need root and are skipped, and entries are
+// never written through a symlink, so that the archive stays inside dest.
+func unpackInitrd(fs *fat.Filesystem, name, dest string) error {
+	f, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	// directories stay writable until their content is unpacked
+	dirModes := map[string]os.FileMode{}
+	err = walkInitrd(f, func(h *cpio.Header, content io.Reader) error {
+		p := cleanTreePath(h.Name)
+		if p == "/" {
+			return nil
+		}
+		target := filepath.Join(dest, filepath.FromSlash(p))
+		if err := checkNoSymlink(dest, p); err != nil {
+			return err
+		}
+
+		mode := h.FileMode()
+		switch {
+		case mode.IsDir():
+			dirModes[target] = mode.Perm()
+			return os.MkdirAll(target, 0755)
+		case mode&os.ModeDevice != 0:
+			log.Printf("skipping device node %s", p)
+			return nil
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		// a later archive replaces the files of an earlier one
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if mode&os.ModeSymlink != 0 {
+			return os.Symlink(h.Linkname, target)
+		}
+
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, content); err != nil {
+			out.Close()
+			return fmt.Errorf("%s: %v", p, err)
+		}
+		return out.Close()
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	for dir, mode := range dirModes {
+		if err := os.Chmod(dir, mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkNoSymlink fails when a parent directory of the slash separated path
+// p in dest is a symlink.
+func checkNoSymlink(dest, p string) error {
+	dir := dest
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s: refusing to write through the symlink %s", p, dir)
+		}
+	}
+
+	return nil
+}
+
+// runExtract implements "ubuntu-recovery-image extract [-o dest] [-unpack]
+// <image[.xz]> <path>".
+func runExtract(args []string) int {
+	fs := newCommandFlags("extract")
+	dest := fs.String("o", "", "File or directory to write (default: the base name of path, in the current directory)")
+	unpack := fs.Bool("unpack", false, "Unpack the initrd at path into the directory -o")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	name := strings.Trim(path.Clean("/"+fs.Arg(1)), "/")
+	if *dest == "" {
+		if name == "" {
+			return fail(exitUsage, "-o is needed to extract the whole recovery partition")
+		}
+		*dest = path.Base(name)
+	}
+
+	r, err := openRecoveryImage(fs.Arg(0))
+	if err != nil {
+		return fail(exitFailed, "%v", err)
+	}
+	defer r.Close()
+
+	if *unpack {
+		err = unpackInitrd(r.fs, name, *dest)
+	} else {
+		// like cp, a file copied to a directory keeps its name
+		if fi, err := os.Stat(*dest); err == nil && fi.IsDir() && name != "" {
+			if info, err := r.fs.Stat(name); err == nil && !info.IsDir() {
+				*dest = filepath.Join(*dest, path.Base(name))
+			}
+		}
+		err = extractPath(r.fs, name, *dest)
+	}
+	if err != nil {
+		return fail(exitFailed, "%v", err)
+	}
+	log.Printf("extracted %s to %s", "/"+name, *dest)
+
+	return exitOK
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery-rplib"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/seed"
+)
+
+const (
+	extraSnapsDir        = "recovery/snaps"
+	extraSnapsAssertions = "snaps.assert"
+)
+
+// addExtraSnaps copies the extra snaps of config.yaml, from the seed or
+// from local files, to recovery/snaps/ along with a seed.yaml and an
+// assertion bundle the factory restore can seed them from.
+func addExtraSnaps(recoveryDir string, snaps seedSnaps) {
+	if len(options.Snaps.Extra) == 0 {
+		return
+	}
+	log.Printf("[add extra snaps to %s]", extraSnapsDir)
+
+	dir := filepath.Join(recoveryDir, extraSnapsDir)
+	err := os.MkdirAll(dir, 0755)
+	rplib.Checkerr(err)
+
+	// the brand assertions come along with the model, so it is accepted
+	// even when every extra snap is a local unasserted file
+	extras := &seed.Seed{Dir: dir}
+	extras.AddAssertions(snaps.Seed.ModelAssertions()...)
+
+	for _, extra := range options.Snaps.Extra {
+		var sn *seed.Snap
+		switch {
+		case extra.File != "":
+			local, _, as := readLocalSnap(extra.File)
+			extras.AddAssertions(as...)
+			sn = local
+		case extra.Name != "":
+			candidates := snaps.Seed.ByName(extra.Name)
+			if len(candidates) == 0 {
+				log.Panicf("extra snap %q not found in the seed", extra.Name)
+			}
+			if len(candidates) > 1 {
+				rplib.Checkerr(&seed.AmbiguousError{What: extra.Name, Candidates: candidates})
+			}
+			copied := *candidates[0]
+			sn = &copied
+			as, err := snaps.Seed.SnapAssertions(sn)
+			rplib.Checkerr(err)
+			extras.AddAssertions(as...)
+		default:
+			log.Panicf("extra snap entries need a name or a file")
+		}
+
+		log.Println("extra snap:", sn)
+		rplib.Shellexec("cp", "-f", sn.Path, filepath.Join(dir, sn.File))
+		sn.Path = filepath.Join(dir, sn.File)
+		extras.Snaps = append(extras.Snaps, sn)
+	}
+
+	err = extras.Verify(options.Snaps.AllowUnasserted)
+	rplib.Checkerr(err)
+
+	err = extras.WriteYaml(filepath.Join(dir, seed.SeedYaml))
+	rplib.Checkerr(err)
+	err = extras.WriteAssertions(filepath.Join(dir, extraSnapsAssertions))
+	rplib.Checkerr(err)
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/ulikunitz/xz"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/disk"
+)
+
+const flashChunkSize = 4 << 20
+
+// blkflsbuf is the BLKFLSBUF ioctl, dropping the buffers of a block
+// device so that verify reads the device and not the page cache.
+const blkflsbuf = 0x1261
+
+// byteRange is a range of the image to write, End excluded. Sum is the
+// SHA-256 of the range given by the bmap, if any.
+type byteRange struct {
+	Start, End int64
+	Sum        string
+}
+
+// bmapFile is the block map written by bmaptool create.
+type bmapFile struct {
+	Version      string `xml:"version,attr"`
+	ImageSize    int64  `xml:"ImageSize"`
+	BlockSize    int64  `xml:"BlockSize"`
+	ChecksumType string `xml:"ChecksumType"`
+	Ranges       []struct {
+		Sum    string `xml:"chksum,attr"`
+		Blocks string `xml:",chardata"`
+	} `xml:"BlockMap>Range"`
+}
+
+// readBmap returns the mapped ranges of a bmap file and the image size.
+func readBmap(file string) ([]byteRange, int64, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	var bm bmapFile
+	if err := xml.Unmarshal(b, &bm); err != nil {
+		return nil, 0, fmt.Errorf("%s: %v", file, err)
+	}
+	if bm.BlockSize <= 0 {
+		return nil, 0, fmt.Errorf("%s: no block size", file)
+	}
+
+	var ranges []byteRange
+	for _, r := range bm.Ranges {
+		blocks := strings.SplitN(strings.TrimSpace(r.Blocks), "-", 2)
+		first, err := strconv.ParseInt(blocks[0], 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: bad range %q", file, r.Blocks)
+		}
+		last := first
+		if len(blocks) == 2 {
+			if last, err = strconv.ParseInt(blocks[1], 10, 64); err != nil {
+				return nil, 0, fmt.Errorf("%s: bad range %q", file, r.Blocks)
+			}
+		}
+		br := byteRange{Start: first * bm.BlockSize, End: (last + 1) * bm.BlockSize}
+		if br.End > bm.ImageSize {
+			br.End = bm.ImageSize
+		}
+		// bmap 1.x has SHA-1 sums, which are not checked
+		if strings.ToLower(strings.TrimSpace(bm.ChecksumType)) == "sha256" {
+			br.Sum = r.Sum
+		}
+		ranges = append(ranges, br)
+	}
+
+	return ranges, bm.ImageSize, nil
+}
+
+// findBmap returns the bmap file next to image, as bmaptool names it, or
+// "" when there is none.
+func findBmap(image string) string {
+	for _, name := range []string{image + ".bmap", strings.TrimSuffix(image, ".xz") + ".bmap"} {
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// xzSize returns the uncompressed size of the xz file name, summed from
+// the index at the end of each of its streams, without decompressing it.
+func xzSize(name string) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	end := fi.Size()
+	for end > 0 {
+		// stream padding, a multiple of four null bytes
+		word := make([]byte, 4)
+		if _, err := f.ReadAt(word, end-4); err != nil {
+			return 0, fmt.Errorf("%s: %v", name, err)
+		}
+		if string(word) == "\x00\x00\x00\x00" {
+			end -= 4
+			continue
+		}
+
+		footer := make([]byte, 12)
+		if end < 24 {
+			return 0, fmt.Errorf("%s: truncated xz stream", name)
+		}
+		if _, err := f.ReadAt(footer, end-12); err != nil {
+			return 0, fmt.Errorf("%s: %v", name, err)
+		}
+		if string(footer[10:]) != "YZ" {
+			return 0, fmt.Errorf("%s: no xz stream footer", name)
+		}
+		indexSize := (int64(binary.LittleEndian.Uint32(footer[4:8])) + 1) * 4
+		indexStart := end - 12 - indexSize
+		if indexStart < 12 {
+			return 0, fmt.Errorf("%s: bad xz index size", name)
+		}
+
+		index := bufio.NewReader(io.NewSectionReader(f, indexStart, indexSize))
+		if b, err := index.ReadByte(); err != nil || b != 0 {
+			return 0, fmt.Errorf("%s: no xz index", name)
+		}
+		records, err := binary.ReadUvarint(index)
+		if err != nil {
+			return 0, fmt.Errorf("%s: bad xz index: %v", name, err)
+		}
+		var blocks int64
+		for i := uint64(0); i < records; i++ {
+			unpadded, err := binary.ReadUvarint(index)
+			if err != nil {
+				return 0, fmt.Errorf("%s: bad xz index: %v", name, err)
+			}
+			uncompressed, err := binary.ReadUvarint(index)
+			if err != nil {
+				return 0, fmt.Errorf("%s: bad xz index: %v", name, err)
+			}
+			blocks += (int64(unpadded) + 3) &^ 3
+			size += int64(uncompressed)
+		}
+
+		// the blocks and the stream header come before the index
+		end = indexStart - blocks - 12
+		if end < 0 {
+			return 0, fmt.Errorf("%s: bad xz index", name)
+		}
+	}
+
+	return size, nil
+}
+
+// flashTarget is a device being written.
+type flashTarget struct {
+	dev *disk.Device
+	f   *os.File
+	err error
+}
+
+func (t *flashTarget) fail(err error) {
+	if t.err == nil {
+		t.err = err
+		log.Printf("%s: %v", t.dev.Path, err)
+	}
+}
+
+// flashImage writes the ranges of image, or all of it, to the targets in
+// parallel and returns the SHA-256 of what was written and the ranges
+// written, ending where the image ends. A target which fails is dropped
+// and keeps its error.
+func flashImage(image string, ranges []byteRange, size int64, targets []*flashTarget) (string, []byteRange, error) {
+	f, err := os.Open(image)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	var src io.Reader = f
+	if strings.HasSuffix(image, ".xz") {
+		if src, err = xz.NewReader(bufio.NewReaderSize(f, 1<<20)); err != nil {
+			return "", nil, fmt.Errorf("%s: %v", image, err)
+		}
+	}
+	if ranges == nil {
+		end := size
+		if end < 0 {
+			end = 1<<63 - 1
+		}
+		ranges = []byteRange{{Start: 0, End: end}}
+	}
+
+	sum := sha256.New()
+	buf := make([]byte, flashChunkSize)
+	var pos, written int64
+	nextLog := int64(256 << 20)
+	var done []byteRange
+	for _, r := range ranges {
+		if r.Start < pos {
+			return "", nil, fmt.Errorf("bmap ranges overlap at %d", r.Start)
+		}
+		if _, err := io.CopyN(ioutil.Discard, src, r.Start-pos); err != nil {
+			return "", nil, fmt.Errorf("%s: %v", image, err)
+		}
+		pos = r.Start
+
+		var rangeSum hash.Hash
+		if r.Sum != "" {
+			rangeSum = sha256.New()
+		}
+		for pos < r.End {
+			n := int64(len(buf))
+			if r.End-pos < n {
+				n = r.End - pos
+			}
+			m, err := io.ReadFull(src, buf[:n])
+			if m > 0 {
+				sum.Write(buf[:m])
+				if rangeSum != nil {
+					rangeSum.Write(buf[:m])
+				}
+				writeTargets(targets, buf[:m], pos)
+				pos += int64(m)
+				written += int64(m)
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				if size >= 0 {
+					return "", nil, fmt.Errorf("%s ends at %d, before the end of the bmap", image, pos)
+				}
+				r.End = pos
+				break
+			}
+			if err != nil {
+				return "", nil, fmt.Errorf("%s: %v", image, err)
+			}
+			if written >= nextLog {
+				logProgress(written, size)
+				nextLog += 256 << 20
+			}
+		}
+		if rangeSum != nil && hex.EncodeToString(rangeSum.Sum(nil)) != r.Sum {
+			return "", nil, fmt.Errorf("%s: bytes %d-%d do not match the checksum of the bmap", image, r.Start, r.End)
+		}
+		done = append(done, byteRange{Start: r.Start, End: r.End})
+	}
+	logProgress(written, size)
+
+	for _, t := range targets {
+		if t.err == nil {
+			if err := t.f.Sync(); err != nil {
+				t.fail(err)
+			}
+		}
+	}
+
+	return hex.EncodeToString(sum.Sum(nil)), done, nil
+}
+
+func logProgress(written, size int64) {
+	if size > 0 {
+		log.Printf("written %s of %s", humanSize(written), humanSize(size))
+	} else {
+		log.Printf("written %s", humanSize(written))
+	}
+}
+
+// writeTargets writes b at off to every target still working, in
+// parallel.
+func writeTargets(targets []*flashTarget, b []byte, off int64) {
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		if t.err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(t *flashTarget) {
+			defer wg.Done()
+			if _, err := t.f.WriteAt(b, off); err != nil {
+				t.fail(err)
+			}
+		}(t)
+	}
+	wg.Wait()
+}
+
+// verifyTarget reads the ranges back from the device and compares their
+// SHA-256 with sum.
+func verifyTarget(t *flashTarget, ranges []byteRange, sum string) error {
+	if t.dev.Block {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, t.f.Fd(), blkflsbuf, 0); errno != 0 {
+			return fmt.Errorf("flushing buffers: %v", errno)
+		}
+	}
+
+	h := sha256.New()
+	for _, r := range ranges {
+		if _, err := io.Copy(h, io.NewSectionReader(t.f, r.Start, r.End-r.Start)); err != nil {
+			return err
+		}
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+		return fmt.Errorf("read back SHA-256 %s, wrote %s", got, sum)
+	}
+
+	return nil
+}
+
+// createImageFile creates the missing target path as an image file,
+// unless it is in /dev where it can only be a device unplugged.
+func createImageFile(path string) (*disk.Device, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(abs, "/dev/") {
+		return nil, fmt.Errorf("%s does not exist", path)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	log.Printf("[created image file %s]", path)
+
+	return disk.OpenDevice(path)
+}
+
+// runFlash implements "ubuntu-recovery-image flash [-bmap file]
+// [-no-verify] <image> <device>...".
+func runFlash(args []string) int {
+	fs := newCommandFlags("flash")
+	bmap := fs.String("bmap", "", "Block map of the image; <image>.bmap is used if it exists")
+	noBmap := fs.Bool("no-bmap", false, "Write the whole image even if there is a bmap file")
+	noVerify := fs.Bool("no-verify", false, "Do not read the devices back")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return exitUsage
+	}
+	image := fs.Arg(0)
+
+	var ranges []byteRange
+	size := int64(-1)
+	if *bmap == "" && !*noBmap {
+		*bmap = findBmap(image)
+	}
+	if *bmap != "" && !*noBmap {
+		var err error
+		if ranges, size, err = readBmap(*bmap); err != nil {
+			return fail(exitUsage, "%v", err)
+		}
+		log.Printf("[using block map %s]", *bmap)
+	} else if strings.HasSuffix(image, ".xz") {
+		var err error
+		if size, err = xzSize(image); err != nil {
+			return fail(exitUsage, "%v", err)
+		}
+	} else {
+		fi, err := os.Stat(image)
+		if err != nil {
+			return fail(exitUsage, "%v", err)
+		}
+		size = fi.Size()
+	}
+
+	var targets []*flashTarget
+	seen := map[string]bool{}
+	for _, path := range fs.Args()[1:] {
+		dev, err := disk.OpenDevice(path)
+		if os.IsNotExist(err) {
+			dev, err = createImageFile(path)
+		}
+		if err != nil {
+			if os.IsPermission(err) {
+				return fail(exitHost, "%v", err)
+			}
+			return fail(exitUsage, "refusing to flash: %v", err)
+		}
+		key := dev.ID
+		if !dev.Block {
+			key = path
+		}
+		if seen[key] {
+			return fail(exitUsage, "%s is given twice", path)
+		}
+		seen[key] = true
+		if size > dev.Size && dev.Block {
+			return fail(exitUsage, "%s (%s) is smaller than the image (%s)", path, humanSize(dev.Size), humanSize(size))
+		}
+
+		flags := os.O_RDWR
+		if dev.Block {
+			// the kernel refuses exclusive opens of devices in use
+			flags |= syscall.O_EXCL
+		}
+		f, err := os.OpenFile(path, flags, 0)
+		if err != nil {
+			if os.IsPermission(err) {
+				return fail(exitHost, "%v", err)
+			}
+			return fail(exitUsage, "refusing to flash: %v", err)
+		}
+		defer f.Close()
+		// an image file gets the size of the image, with holes where the
+		// bmap maps nothing
+		if !dev.Block && size > dev.Size {
+			if err := f.Truncate(size); err != nil {
+				return fail(exitFailed, "%v", err)
+			}
+		}
+		targets = append(targets, &flashTarget{dev: dev, f: f})
+	}
+
+	log.Printf("[flash %s to %s]", image, strings.Join(fs.Args()[1:], ", "))
+	sum, written, err := flashImage(image, ranges, size, targets)
+	if err != nil {
+		return fail(exitFailed, "%v", err)
+	}
+
+	if !*noVerify {
+		log.Printf("[verify %s]", strings.Join(fs.Args()[1:], ", "))
+		var wg sync.WaitGroup
+		for _, t := range targets {
+			if t.err != nil {
+				continue
+			}
+			wg.Add(1)
+			go func(t *flashTarget) {
+				defer wg.Done()
+				if err := verifyTarget(t, written, sum); err != nil {
+					t.fail(fmt.Errorf("verify failed: %v", err))
+				}
+			}(t)
+		}
+		wg.Wait()
+	}
+
+	failed := 0
+	for _, t := range targets {
+		if t.err != nil {
+			failed++
+			fmt.Printf("%s: FAILED: %v\n", t.dev.Path, t.err)
+		} else {
+			fmt.Printf("%s: OK\n", t.dev.Path)
+		}
+	}
+	if failed > 0 {
+		return fail(exitFailed, "%d of %d devices failed", failed, len(targets))
+	}
+
+	return exitOK
+}
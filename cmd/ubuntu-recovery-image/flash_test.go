@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/disk"
+)
+
+func randomImage(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "flash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func checkTarget(t *testing.T, target string, want []byte) {
+	got, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s: got %d bytes differing from the %d of the image", target, len(got), len(want))
+	}
+}
+
+// TestFlashRaw writes a raw image to an existing file and to a file it
+// creates.
+func TestFlashRaw(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	data := randomImage(2*flashChunkSize + 1234)
+	image := filepath.Join(dir, "test.img")
+	existing := filepath.Join(dir, "existing")
+	created := filepath.Join(dir, "created")
+	if err := ioutil.WriteFile(image, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(existing, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := runFlash([]string{image, existing, created}); code != exitOK {
+		t.Fatalf("exit code %d", code)
+	}
+	checkTarget(t, existing, data)
+	checkTarget(t, created, data)
+}
+
+func TestFlashXz(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	data := randomImage(300000)
+	image := filepath.Join(dir, "test.img.xz")
+	f, err := os.Create(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := xz.NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	target := filepath.Join(dir, "target")
+	if code := runFlash([]string{image, target}); code != exitOK {
+		t.Fatalf("exit code %d", code)
+	}
+	checkTarget(t, target, data)
+}
+
+func xzBytes(t *testing.T, data []byte, blockSize int64) []byte {
+	var b bytes.Buffer
+	w, err := xz.WriterConfig{BlockSize: blockSize}.NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestXzSize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	one, two := randomImage(300000), randomImage(70001)
+	for _, c := range []struct {
+		name string
+		xz   []byte
+		size int64
+	}{
+		{"one block", xzBytes(t, one, 1<<20), 300000},
+		{"blocks", xzBytes(t, one, 65536), 300000},
+		{"streams", bytes.Join([][]byte{xzBytes(t, one, 65536), make([]byte, 8), xzBytes(t, two, 1<<20)}, nil), 370001},
+		{"not xz", one, -1},
+	} {
+		image := filepath.Join(dir, "test.img.xz")
+		if err := ioutil.WriteFile(image, c.xz, 0644); err != nil {
+			t.Fatal(err)
+		}
+		size, err := xzSize(image)
+		if c.size < 0 {
+			if err == nil {
+				t.Errorf("%s: no error", c.name)
+			}
+			continue
+		}
+		if err != nil || size != c.size {
+			t.Errorf("%s: got %d, %v, want %d", c.name, size, err, c.size)
+		}
+	}
+}
+
+// writeBmap writes the bmap of image mapping the blocks of ranges, as
+// "first-last" or "block", with the SHA-256 of each range.
+func writeBmap(t *testing.T, file string, image []byte, blockSize int, ranges ...string) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<?xml version=\"1.0\" ?>\n<bmap version=\"2.0\">\n")
+	fmt.Fprintf(&b, "<ImageSize>%d</ImageSize>\n<BlockSize>%d</BlockSize>\n", len(image), blockSize)
+	fmt.Fprintf(&b, "<ChecksumType>sha256</ChecksumType>\n<BlockMap>\n")
+	for _, r := range ranges {
+		var first, last int
+		if _, err := fmt.Sscanf(r, "%d-%d", &first, &last); err != nil {
+			fmt.Sscanf(r, "%d", &first)
+			last = first
+		}
+		end := (last + 1) * blockSize
+		if end > len(image) {
+			end = len(image)
+		}
+		sum := sha256.Sum256(image[first*blockSize : end])
+		fmt.Fprintf(&b, "<Range chksum=\"%s\">%s</Range>\n", hex.EncodeToString(sum[:]), r)
+	}
+	fmt.Fprintf(&b, "</BlockMap>\n</bmap>\n")
+	if err := ioutil.WriteFile(file, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestFlashBmap writes the mapped blocks only: the other blocks of an
+// existing target are kept, those of a created one are holes.
+func TestFlashBmap(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	const blockSize = 4096
+	data := randomImage(10*blockSize + 100)
+	image := filepath.Join(dir, "test.img")
+	if err := ioutil.WriteFile(image, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeBmap(t, image+".bmap", data, blockSize, "0-1", "4", "8-10")
+
+	old := bytes.Repeat([]byte{0xff}, len(data))
+	existing := filepath.Join(dir, "existing")
+	created := filepath.Join(dir, "created")
+	if err := ioutil.WriteFile(existing, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := runFlash([]string{image, existing, created}); code != exitOK {
+		t.Fatalf("exit code %d", code)
+	}
+
+	mapped := func(fill []byte) []byte {
+		want := append([]byte{}, fill...)
+		copy(want[:2*blockSize], data)
+		copy(want[4*blockSize:5*blockSize], data[4*blockSize:])
+		copy(want[8*blockSize:], data[8*blockSize:])
+		return want
+	}
+	checkTarget(t, existing, mapped(old))
+	checkTarget(t, created, mapped(make([]byte, len(data))))
+
+	// a block which does not match its checksum fails the flash
+	data[4*blockSize] ^= 1
+	if err := ioutil.WriteFile(image, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := runFlash([]string{image, existing}); code != exitFailed {
+		t.Errorf("image not matching the bmap: got exit code %d, want %d", code, exitFailed)
+	}
+	if code := runFlash([]string{"-no-bmap", image, existing}); code != exitOK {
+		t.Errorf("-no-bmap: got exit code %d", code)
+	}
+	checkTarget(t, existing, data)
+}
+
+func TestFlashVerifyFailure(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	data := randomImage(100000)
+	image := filepath.Join(dir, "test.img")
+	target := filepath.Join(dir, "target")
+	if err := ioutil.WriteFile(image, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(target, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dev, err := disk.OpenDevice(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(target, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ft := &flashTarget{dev: dev, f: f}
+
+	sum, written, err := flashImage(image, nil, int64(len(data)), []*flashTarget{ft})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ft.err != nil {
+		t.Fatal(ft.err)
+	}
+	if err := verifyTarget(ft, written, sum); err != nil {
+		t.Fatalf("verify of a good target: %v", err)
+	}
+
+	if _, err := f.WriteAt([]byte{data[5000] ^ 1}, 5000); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyTarget(ft, written, sum); err == nil || !strings.Contains(err.Error(), "read back SHA-256") {
+		t.Errorf("verify of a corrupted target: got %v", err)
+	}
+}
+
+// devNode returns the /dev node of the block device of the sysfs
+// directory sysDir, or "" when there is none.
+func devNode(sysDir string) string {
+	b, err := ioutil.ReadFile(filepath.Join(sysDir, "uevent"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "DEVNAME=") {
+			node := "/dev/" + strings.TrimPrefix(line, "DEVNAME=")
+			if _, err := os.Stat(node); err == nil {
+				return node
+			}
+		}
+	}
+
+	return ""
+}
+
+// rootDevice returns the block device mounted on /, or "".
+func rootDevice() string {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 5 && fields[4] == "/" {
+			return devNode(filepath.Join("/sys/dev/block", fields[2]))
+		}
+	}
+
+	return ""
+}
+
+func TestFlashRefuses(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "test.img")
+	target := filepath.Join(dir, "target")
+	if err := ioutil.WriteFile(image, randomImage(1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := [][]string{
+		{image, "/dev/null"},
+		{image, "/dev/no-such-disk"},
+		{image, target, target},
+		{image, dir},
+	}
+	if dev := rootDevice(); dev != "" {
+		cases = append(cases, []string{image, dev})
+	} else {
+		t.Log("no block device mounted on /")
+	}
+	partition := ""
+	partitions, _ := filepath.Glob("/sys/class/block/*/partition")
+	for _, p := range partitions {
+		if partition = devNode(filepath.Dir(p)); partition != "" {
+			cases = append(cases, []string{image, partition})
+			break
+		}
+	}
+	if partition == "" {
+		t.Log("no partition to refuse")
+	}
+
+	for _, args := range cases {
+		if code := runFlash(args); code != exitUsage {
+			t.Errorf("flash %s: got exit code %d, want %d", strings.Join(args[1:], " "), code, exitUsage)
+		}
+	}
+	if _, err := os.Stat("/dev/no-such-disk"); !os.IsNotExist(err) {
+		t.Errorf("/dev/no-such-disk created: %v", err)
+	}
+}
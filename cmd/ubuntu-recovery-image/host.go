@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery-rplib"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/gadget"
+)
+
+// hostLockFile serializes the loop device and device-mapper changes of
+// the builds running on the host.
+const hostLockFile = "/run/lock/ubuntu-recovery-image.lock"
+
+// buildTools are the host tools every build runs.
+var buildTools = []string{
+	"losetup", "kpartx", "udevadm", "blkid",
+	"sfdisk", "sgdisk", "parted", "mkfs.fat", "dd", "debugfs",
+	"rsync", "tar", "xz", "gzip", "cpio", "mksquashfs",
+}
+
+// hostError is a failure of the host rather than of the build: missing
+// tools or privileges, or a host tool which does not work.
+type hostError struct {
+	err error
+}
+
+func (e *hostError) Error() string {
+	return e.err.Error()
+}
+
+// checkHostErr panics with a hostError for err, as rplib.Checkerr panics
+// for the failures of the build.
+func checkHostErr(err error) {
+	if err != nil {
+		panic(&hostError{err})
+	}
+}
+
+// hostExec runs the host tool c as rplib.Shellexec does, its failures
+// being host errors.
+func hostExec(c string, a ...string) {
+	checkHostErr(catchPanic(func() { rplib.Shellexec(c, a...) }))
+}
+
+// checkHost makes sure the build can run on this host: it mounts loop
+// devices, so it needs root, and it runs the tools above.
+func checkHost(bootloader string) error {
+	if os.Geteuid() != 0 {
+		return &hostError{fmt.Errorf("the build sets up loop devices and mounts, run it as root")}
+	}
+
+	tools := buildTools
+	if bootloader == gadget.BootloaderGrub {
+		tools = append(tools, "grub-editenv")
+	}
+
+	return lookTools(tools)
+}
+
+// lookTools fails with the tools missing from PATH.
+func lookTools(tools []string) error {
+	var missing []string
+	for _, t := range tools {
+		if _, err := exec.LookPath(t); err != nil {
+			missing = append(missing, t)
+		}
+	}
+	if len(missing) > 0 {
+		return &hostError{fmt.Errorf("missing host tools: %s", strings.Join(missing, ", "))}
+	}
+
+	return nil
+}
+
+// lockHost takes the host lock, waiting for the other builds holding it,
+// and returns the function releasing it.
+func lockHost() func() {
+	err := os.MkdirAll(filepath.Dir(hostLockFile), 0755)
+	checkHostErr(err)
+	f, err := os.OpenFile(hostLockFile, os.O_RDWR|os.O_CREATE, 0644)
+	checkHostErr(err)
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		log.Printf("[waiting for another build to release %s]", hostLockFile)
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		checkHostErr(err)
+	} else {
+		checkHostErr(err)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}
+}
+
+// attachImage sets up a loop device for image and the device maps of its
+// partitions under the host lock, and returns the loop device name. The
+// loop device and the maps of a read-only image are read-only.
+func attachImage(image string, readOnly bool) string {
+	unlock := lockHost()
+	defer unlock()
+
+	losetup, kpartx := "losetup --find --show", "-avs"
+	if readOnly {
+		losetup, kpartx = "losetup -r --find --show", "-avrs"
+	}
+	var loop string
+	checkHostErr(catchPanic(func() {
+		loop = rplib.Shellcmdoutput(fmt.Sprintf("%s %s | xargs basename", losetup, image))
+	}))
+	hostExec("kpartx", kpartx, fmt.Sprintf("/dev/%s", loop))
+	hostExec("udevadm", "settle")
+
+	return loop
+}
+
+// detachImage removes the device maps and the loop device of attachImage.
+func detachImage(loop string) {
+	unlock := lockHost()
+	defer unlock()
+
+	hostExec("kpartx", "-ds", fmt.Sprintf("/dev/%s", loop))
+	hostExec("udevadm", "settle")
+	hostExec("losetup", "-d", fmt.Sprintf("/dev/%s", loop))
+}
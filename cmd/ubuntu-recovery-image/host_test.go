@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/disk"
+)
+
+// TestMissingDebugfs checks that debugfs missing is a host error, though
+// the seed of the base image is read before the host stage.
+func TestMissingDebugfs(t *testing.T) {
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", "")
+
+	_, err := readBaseSeed(disk.Partition{}, "")
+	if _, ok := err.(*hostError); !ok {
+		t.Fatalf("got %v, want a host error", err)
+	}
+	if code := panicExitCode(catchPanic(func() { panic(err) })); code != exitHost {
+		t.Errorf("got exit code %d, want %d", code, exitHost)
+	}
+}
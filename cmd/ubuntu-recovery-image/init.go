@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	configdirs "github.com/Lyoncore/ubuntu-recovery-rplib/dirs/configdir"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/config"
+	"github.com/Lyoncore/ubuntu-recovery-image/disk"
+	"github.com/Lyoncore/ubuntu-recovery-image/gadget"
+	"github.com/Lyoncore/ubuntu-recovery-image/seed"
+	"github.com/Lyoncore/ubuntu-recovery-image/snap"
+)
+
+// baseImageInfo is what init finds out about a base image.
+type baseImageInfo struct {
+	Project       string
+	BaseImage     string
+	Arch          string
+	Store         string
+	Bootloader    string
+	PartitionType string
+	// RecoverySize is a first guess in megabytes: the size of the base
+	// image, which the compressed factory images stay below.
+	RecoverySize int64
+	Kernel       string
+	Gadget       string
+	Os           string
+	// SchemaVersion is the config schema written.
+	SchemaVersion int
+}
+
+var initConfigTemplate = template.Must(template.New("config.yaml").Parse(`# generated by ubuntu-recovery-image init from {{.BaseImage}}
+schemaversion: {{.SchemaVersion}}
+project: {{.Project}}
+snaps:
+  kernel: {{.Kernel}}
+  os: {{.Os}}
+  gadget: {{.Gadget}}
+configs:
+  arch:{{with .Arch}} {{.}}{{end}}
+  baseimage: {{.BaseImage}}
+  recoverytype: full
+  # megabytes, check the size of recovery/factory/ after a first build
+  recoverysize: {{.RecoverySize}}
+  release: 16
+  store:{{with .Store}} {{.}}{{end}}
+  device:
+  channel: stable
+  size:
+{{- if .Bootloader}}
+  # read from gadget.yaml of the base image, set only to override it
+  bootloader: {{.Bootloader}}
+{{- else}}
+  # the gadget snap of the base image has no gadget.yaml: grub or u-boot
+  bootloader:
+{{- end}}
+  partitiontype: {{.PartitionType}}
+recovery:
+  type: factory_install
+  fslabel: recovery
+  installerfslabel:
+  imagetype:
+  systembootimage:
+  writableimage:
+debug:
+  devmode: false
+  ssh: false
+  xz: true
+`))
+
+// uEnvTemplate is rendered by the build, see "Templates" in README.md.
+const uEnvTemplate = `# u-boot environment of the recovery partition, the build appends
+# snap_core and snap_kernel
+recoverylabel={{.Config.Recovery.FsLabel}}
+recoverytype={{.Config.Recovery.Type}}
+`
+
+const grubenvExample = `# grubenv of the recovery partition, set by the build with grub-editenv:
+#   firstfactoryrestore=no
+#   recoverylabel=<recovery.fslabel>
+#   recoverytype=<recovery.type>
+#   installerfslabel=<recovery.installerfslabel>, if set
+# Files in local-includes/ overwrite the recovery partition content, e.g.
+# local-includes/efi/ubuntu/grub.cfg.
+`
+
+// inspectBaseImage reads the partition table, the seed and the gadget.yaml
+// of the base image.
+func inspectBaseImage(image string) (*baseImageInfo, error) {
+	configs.Configs.BaseImage = image
+
+	info := &baseImageInfo{
+		Project:       strings.TrimSuffix(filepath.Base(image), filepath.Ext(image)),
+		BaseImage:     image,
+		SchemaVersion: config.SchemaVersion,
+	}
+	if st, err := os.Stat(image); err == nil {
+		info.RecoverySize = (st.Size() + (1<<20 - 1)) >> 20
+	}
+
+	table, err := disk.ReadTableFile(image)
+	if err != nil {
+		return nil, imageError(image, err)
+	}
+	info.PartitionType = table.Schema
+
+	writable, err := baseWritable()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(workDir, "")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	s, err := readBaseSeed(writable, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range []struct {
+		typ  string
+		name *string
+	}{
+		{seed.TypeKernel, &info.Kernel},
+		{seed.TypeGadget, &info.Gadget},
+		{seed.TypeOS, &info.Os},
+	} {
+		sn, err := s.Resolve(c.typ, "")
+		if err != nil {
+			return nil, err
+		}
+		*c.name = sn.Name
+	}
+	if model := s.Model(); model != nil {
+		info.Arch = model.Architecture()
+		info.Store = model.Store()
+	}
+
+	if info.Arch == "" {
+		info.Arch, err = kernelArch(s, info.Kernel)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	gadgetSnap, err := s.Resolve(seed.TypeGadget, info.Gadget)
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := snap.Open(gadgetSnap.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer pkg.Close()
+	if b, err := pkg.GadgetYaml(); err == nil {
+		gi, err := gadget.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		if _, vol, err := gi.Volume(); err == nil {
+			info.Bootloader = vol.Bootloader
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// kernelArch returns the architecture of the kernel snap, for seeds
+// without a model assertion.
+func kernelArch(s *seed.Seed, name string) (string, error) {
+	sn, err := s.Resolve(seed.TypeKernel, name)
+	if err != nil {
+		return "", err
+	}
+	pkg, err := snap.Open(sn.Path)
+	if err != nil {
+		return "", err
+	}
+	defer pkg.Close()
+
+	si, err := pkg.Info()
+	if err != nil || len(si.Architectures) == 0 {
+		return "", err
+	}
+
+	return si.Architectures[0], nil
+}
+
+// runInit implements "ubuntu-recovery-image init <base.img>": it creates
+// a config repo for the base image in the config dir.
+func runInit(args []string) int {
+	fs := newCommandFlags("init")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	if _, err := os.Stat(configPath("config.yaml")); err == nil {
+		return fail(exitUsage, "%s exists already", configPath("config.yaml"))
+	}
+
+	info, err := inspectBaseImage(fs.Arg(0))
+	if err != nil {
+		return fail(exitUsage, "%v", err)
+	}
+	info.BaseImage = configRelative(fs.Arg(0))
+
+	if err := writeConfigRepo(info); err != nil {
+		return fail(exitFailed, "%v", err)
+	}
+
+	bootloader := info.Bootloader
+	if bootloader == "" {
+		bootloader = "unknown"
+	}
+	fmt.Printf("created config for %s in %s: %s bootloader, %s, snaps %s, %s and %s\n",
+		info.Project, configDir, bootloader, info.PartitionType, info.Kernel, info.Gadget, info.Os)
+	if info.Bootloader == "" {
+		fmt.Printf("the gadget snap %s has no gadget.yaml, set configs.bootloader in config.yaml\n", info.Gadget)
+	}
+	fmt.Printf("check it with: ubuntu-recovery-image -config-dir %s validate\n", configDir)
+	return exitOK
+}
+
+// configRelative returns path relative to the config dir when it is below
+// it, and absolute otherwise.
+func configRelative(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	dir, err := filepath.Abs(configDir)
+	if err != nil {
+		return abs
+	}
+	if rel, err := filepath.Rel(dir, abs); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+
+	return abs
+}
+
+func writeConfigRepo(info *baseImageInfo) error {
+	for _, dir := range []string{"local-includes", "initrd_local-includes", configdirs.WritableLocalIncludeDir} {
+		if err := os.MkdirAll(configPath(dir), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(configPath(dir), ".gitkeep"), nil, 0644); err != nil {
+			return err
+		}
+	}
+
+	var config bytes.Buffer
+	if err := initConfigTemplate.Execute(&config, info); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(configPath("config.yaml"), config.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(configPath("package.json")); os.IsNotExist(err) {
+		b, err := json.MarshalIndent(map[string]string{"name": info.Project, "version": "0.1"}, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(configPath("package.json"), append(b, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+
+	switch info.Bootloader {
+	case gadget.BootloaderUBoot:
+		return ioutil.WriteFile(configPath("local-includes/uEnv.txt.tmpl"), []byte(uEnvTemplate), 0644)
+	case gadget.BootloaderGrub:
+		return ioutil.WriteFile(configPath("grubenv.example"), []byte(grubenvExample), 0644)
+	}
+
+	return nil
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ulikunitz/xz"
+	"gopkg.in/yaml.v2"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/disk"
+	"github.com/Lyoncore/ubuntu-recovery-image/fat"
+	"github.com/Lyoncore/ubuntu-recovery-image/snap"
+	utils "github.com/Lyoncore/ubuntu-recovery-image/utils"
+)
+
+// Files of the recovery partition, as written by createRecoveryImage.
+const (
+	recoveryConfigFile = "recovery/config.yaml"
+	factoryDir         = "recovery/factory"
+	grubEnvFile        = "efi/ubuntu/grubenv"
+	uEnvFile           = "uEnv.txt"
+)
+
+// recoverySnapFiles are the snaps of the recovery partition by type.
+var recoverySnapFiles = []struct{ typ, file string }{
+	{"kernel", "kernel.snap"},
+	{"gadget", "gadget.snap"},
+	{"os", "os.snap"},
+}
+
+// imageReport is what inspect finds in a recovery image.
+type imageReport struct {
+	Image      string
+	Schema     string
+	DiskID     string
+	Partitions []partitionReport
+	// Recovery is nil when no partition looks like a recovery partition.
+	Recovery *recoveryReport `json:",omitempty"`
+}
+
+type partitionReport struct {
+	disk.Partition
+	Fs    string
+	Label string
+	FsID  string
+}
+
+type recoveryReport struct {
+	Partition  int
+	Label      string
+	Fs         string
+	BuildStamp *utils.BuildStamp `json:",omitempty"`
+	// EnvFile is the grubenv or uEnv.txt that Env comes from.
+	EnvFile string
+	Env     []envVar
+	Snaps   []utils.SnapInfo
+	Factory []factoryFile
+	Config  string
+}
+
+type envVar struct {
+	Name  string
+	Value string
+}
+
+type factoryFile struct {
+	Name string
+	Size int64
+}
+
+// openImageFile returns image, or for an .xz image a sparse temporary
+// copy decompressed into the work dir, and a function removing the copy.
+// The readers of the partitions need random access, which an xz stream
+// does not give, so the copy is made up front, once the work dir is known
+// to have room for it.
+func openImageFile(image string) (string, func(), error) {
+	if !strings.HasSuffix(image, ".xz") {
+		return image, func() {}, nil
+	}
+
+	size, err := xzSize(image)
+	if err != nil {
+		return "", nil, err
+	}
+	dir := workDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	if free, err := freeSpace(dir); err == nil && free < size {
+		return "", nil, fmt.Errorf("%s decompresses to %s but %s has %s free, use -work-dir to decompress it elsewhere",
+			image, humanSize(size), dir, humanSize(free))
+	}
+
+	in, err := os.Open(image)
+	if err != nil {
+		return "", nil, err
+	}
+	defer in.Close()
+	xr, err := xz.NewReader(bufio.NewReader(in))
+	if err != nil {
+		return "", nil, err
+	}
+
+	out, err := ioutil.TempFile(workDir, "image")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.Remove(out.Name()) }
+	if err := copySparse(out, xr); err != nil {
+		out.Close()
+		cleanup()
+		return "", nil, fmt.Errorf("decompressing %s: %v", image, err)
+	}
+	if err := out.Close(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return out.Name(), cleanup, nil
+}
+
+// freeSpace returns the space available to unprivileged users in the
+// file system of dir.
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// imageError names image in err, unless err is a file error naming a
+// file already.
+func imageError(image string, err error) error {
+	if _, ok := err.(*os.PathError); ok {
+		return err
+	}
+
+	return fmt.Errorf("%s: %v", image, err)
+}
+
+// copySparse copies r to f, seeking over the blocks of zeros, which make
+// up most of a disk image.
+func copySparse(f *os.File, r io.Reader) error {
+	buf := make([]byte, 64*1024)
+	var size int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if isZero(buf[:n]) {
+				_, err = f.Seek(int64(n), os.SEEK_CUR)
+			} else {
+				_, err = f.Write(buf[:n])
+			}
+			if err != nil {
+				return err
+			}
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return f.Truncate(size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// inspectImage reads the partition table of image and the content of its
+// recovery partition, without mounting anything.
+func inspectImage(image string) (*imageReport, error) {
+	table, err := disk.ReadTableFile(image)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(image)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	report := &imageReport{Image: image, Schema: table.Schema, DiskID: table.DiskID}
+	for _, p := range table.Partitions {
+		info, err := disk.Probe(f, p)
+		if err != nil {
+			return nil, fmt.Errorf("partition %d: %v", p.Number, err)
+		}
+		report.Partitions = append(report.Partitions, partitionReport{Partition: p, Fs: info.Type, Label: info.Label, FsID: info.UUID})
+		if info.Type != disk.FsVfat || report.Recovery != nil {
+			continue
+		}
+
+		fs, err := fat.New(io.NewSectionReader(f, p.Start, p.Size))
+		if err != nil {
+			return nil, fmt.Errorf("partition %d: %v", p.Number, err)
+		}
+		if _, err := fs.Stat(recoveryConfigFile); err != nil {
+			if _, err := fs.Stat(utils.BuildStampFile); err != nil {
+				continue
+			}
+		}
+		if report.Recovery, err = inspectRecovery(fs); err != nil {
+			return nil, fmt.Errorf("recovery partition %d: %v", p.Number, err)
+		}
+		report.Recovery.Partition = p.Number
+	}
+
+	return report, nil
+}
+
+// inspectRecovery reads the buildstamp, the boot environment, the snaps,
+// the factory archives and the config of a recovery partition.
+func inspectRecovery(fs *fat.Filesystem) (*recoveryReport, error) {
+	r := &recoveryReport{Label: fs.Label, Fs: fs.Type}
+
+	if b, err := fs.ReadFile(utils.BuildStampFile); err == nil {
+		var stamp utils.BuildStamp
+		if err := yaml.Unmarshal(b, &stamp); err != nil {
+			return nil, fmt.Errorf("%s: %v", utils.BuildStampFile, err)
+		}
+		r.BuildStamp = &stamp
+		r.Snaps = stamp.Snaps
+	}
+
+	for _, name := range []string{grubEnvFile, uEnvFile} {
+		if b, err := fs.ReadFile(name); err == nil {
+			r.EnvFile = name
+			r.Env = parseEnv(b)
+			break
+		}
+	}
+
+	// images built before the buildstamp listed the snaps only carry the
+	// snap files themselves, which do not know their revision
+	if len(r.Snaps) == 0 {
+		for _, s := range recoverySnapFiles {
+			info, err := readFatSnapInfo(fs, s.file)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			r.Snaps = append(r.Snaps, utils.SnapInfo{Type: s.typ, Name: info.Name, Version: info.Version})
+		}
+	}
+
+	if files, err := fs.ReadDir(factoryDir); err == nil {
+		for _, fi := range files {
+			if !fi.IsDir() {
+				r.Factory = append(r.Factory, factoryFile{Name: fi.Name(), Size: fi.Size()})
+			}
+		}
+	}
+
+	if b, err := fs.ReadFile(recoveryConfigFile); err == nil {
+		r.Config = string(b)
+	}
+
+	return r, nil
+}
+
+func readFatSnapInfo(fs *fat.Filesystem, name string) (*snap.Info, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s, err := snap.New(f, name)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	return s.Info()
+}
+
+// parseEnv reads the name=value lines of a grubenv or uEnv.txt; grubenv
+// pads its block with '#'.
+func parseEnv(b []byte) []envVar {
+	var env []envVar
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.Index(line, "="); i > 0 {
+			env = append(env, envVar{Name: line[:i], Value: line[i+1:]})
+		}
+	}
+
+	return env
+}
+
+func humanSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+
+	return fmt.Sprintf("%d B", n)
+}
+
+func formatProject(p utils.ProjectInfo) string {
+	return fmt.Sprintf("%s (commit %s, %s)", p.Version, p.Commit, p.CommitStamp.Format(time.RFC3339))
+}
+
+// printImageReport writes the report as text.
+func printImageReport(w io.Writer, report *imageReport) {
+	fmt.Fprintf(w, "image: %s\n", report.Image)
+	fmt.Fprintf(w, "partition table: %s, disk id %s\n", report.Schema, report.DiskID)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "  nr\tstart\tsize\tname\tfs\tlabel")
+	for _, p := range report.Partitions {
+		fmt.Fprintf(tw, "  %d\t%d\t%s\t%s\t%s\t%s\n", p.Number, p.Start, humanSize(p.Size), p.Name, p.Fs, p.Label)
+	}
+	tw.Flush()
+
+	r := report.Recovery
+	if r == nil {
+		fmt.Fprintln(w, "no recovery partition found")
+		return
+	}
+	fmt.Fprintf(w, "\nrecovery partition: %d, %s, label %s\n", r.Partition, r.Fs, r.Label)
+
+	if s := r.BuildStamp; s != nil {
+		fmt.Fprintln(w, "\nbuildstamp:")
+		fmt.Fprintf(w, "  date:   %s\n", s.BuildDate.Format(time.RFC3339))
+		fmt.Fprintf(w, "  tool:   %s\n", formatProject(s.BuildTool))
+		fmt.Fprintf(w, "  config: %s\n", formatProject(s.BuildConfig))
+		if s.Variant != "" {
+			fmt.Fprintf(w, "  variant: %s\n", s.Variant)
+		}
+		if s.Output != "" {
+			fmt.Fprintf(w, "  output: %s\n", s.Output)
+		}
+		for _, r := range s.Refreshes {
+			fmt.Fprintf(w, "  refreshed %s with config %s: %s\n", r.Date.Format(time.RFC3339), r.BuildConfig.Version, strings.Join(r.Replaced, ", "))
+		}
+	} else {
+		fmt.Fprintln(w, "\nno buildstamp")
+	}
+
+	if len(r.Snaps) > 0 {
+		fmt.Fprintln(w, "\nsnaps:")
+		tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		for _, s := range r.Snaps {
+			rev := s.Revision
+			if rev == "" {
+				rev = "unknown"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\tversion %s\trevision %s\n", s.Type, s.Name, s.Version, rev)
+		}
+		tw.Flush()
+	}
+
+	if r.EnvFile != "" {
+		fmt.Fprintf(w, "\n%s:\n", r.EnvFile)
+		for _, v := range r.Env {
+			fmt.Fprintf(w, "  %s=%s\n", v.Name, v.Value)
+		}
+	}
+
+	if len(r.Factory) > 0 {
+		fmt.Fprintf(w, "\n%s:\n", factoryDir)
+		tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		for _, f := range r.Factory {
+			fmt.Fprintf(tw, "  %s\t%s\t(%d bytes)\n", f.Name, humanSize(f.Size), f.Size)
+		}
+		tw.Flush()
+	}
+
+	if r.Config != "" {
+		fmt.Fprintf(w, "\n%s:\n", recoveryConfigFile)
+		for _, line := range strings.Split(strings.TrimRight(r.Config, "\n"), "\n") {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+}
+
+// runInspect implements "ubuntu-recovery-image inspect [-json] <image[.xz]>".
+func runInspect(args []string) int {
+	fs := newCommandFlags("inspect")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	image, cleanup, err := openImageFile(fs.Arg(0))
+	if err != nil {
+		return fail(exitFailed, "%v", err)
+	}
+	defer cleanup()
+	report, err := inspectImage(image)
+	if err != nil {
+		return fail(exitFailed, "%v", imageError(fs.Arg(0), err))
+	}
+	report.Image = fs.Arg(0)
+
+	if *asJSON {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fail(exitFailed, "%v", err)
+		}
+		fmt.Printf("%s\n", b)
+	} else {
+		printImageReport(os.Stdout, report)
+	}
+
+	return exitOK
+}
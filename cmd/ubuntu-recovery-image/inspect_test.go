@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenImageFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	saved := workDir
+	workDir = dir
+	defer func() { workDir = saved }()
+
+	// zeros in the middle, as in the free space of a disk image
+	data := bytes.Join([][]byte{randomImage(70000), make([]byte, 1<<20), randomImage(1000)}, nil)
+	image := filepath.Join(dir, "test.img.xz")
+	if err := ioutil.WriteFile(image, xzBytes(t, data, 65536), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	name, cleanup, err := openImageFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTarget(t, name, data)
+	cleanup()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("%s: got %v after cleanup, want no such file", name, err)
+	}
+
+	// a raw image is read in place
+	if name, _, err := openImageFile("test.img"); name != "test.img" || err != nil {
+		t.Errorf("got %q, %v, want test.img", name, err)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/template"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery-rplib"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/gadget"
+	utils "github.com/Lyoncore/ubuntu-recovery-image/utils"
+)
+
+// Files of the installer partition.
+const (
+	installerDir     = "installer"
+	installerPayload = "recovery.img.xz"
+	installerConf    = "installer.conf"
+	installerSums    = "SHA256SUMS"
+)
+
+// installerHook is the initramfs-tools script of the installer initrd: it
+// writes the recovery image of the installer partition to the target disk
+// picked by installer.conf, reads it back, and reboots.
+var installerHook = template.Must(template.New("hook").Parse(`#!/bin/sh
+# headless installer, generated by ubuntu-recovery-image
+PREREQ=""
+prereqs()
+{
+	echo "$PREREQ"
+}
+case "$1" in
+prereqs)
+	prereqs
+	exit 0
+	;;
+esac
+
+. /scripts/functions
+
+INSTALLER_LABEL="{{.Label}}"
+mnt=/run/installer
+
+installer_fail()
+{
+	panic "installer: $*"
+}
+
+wait_for_udev 10
+part=$(blkid -L "$INSTALLER_LABEL") || installer_fail "no partition labelled $INSTALLER_LABEL"
+mkdir -p $mnt
+mount -o ro "$part" $mnt || installer_fail "cannot mount $part"
+. $mnt/{{.Dir}}/{{.Conf}}
+
+# the disk of the installer is never a target
+installer_disk=$(basename "$(readlink -f /sys/class/block/${part##*/}/..)")
+
+pick_target()
+{
+	if [ -n "$TARGET_DEVICE" ]; then
+		echo "$TARGET_DEVICE"
+		return
+	fi
+
+	best=""
+	best_size=0
+	for sys in /sys/block/*; do
+		disk=${sys##*/}
+		case "$disk" in
+		loop*|ram*|zram*|sr*|dm-*|md*|mmcblk*boot*|mmcblk*rpmb)
+			continue
+			;;
+		esac
+		[ "$disk" = "$installer_disk" ] && continue
+		[ "$(cat $sys/removable)" = 1 ] && [ "$TARGET_REMOVABLE" != yes ] && continue
+		# 512 bytes sectors to gigabytes
+		size=$(( $(cat $sys/size) / 1953125 ))
+		[ "$TARGET_MINSIZE" -gt 0 ] && [ "$size" -lt "$TARGET_MINSIZE" ] && continue
+		[ "$TARGET_MAXSIZE" -gt 0 ] && [ "$size" -gt "$TARGET_MAXSIZE" ] && continue
+		case "$TARGET_ORDER" in
+		smallest)
+			[ -n "$best" ] && [ "$size" -ge "$best_size" ] && continue
+			;;
+		largest)
+			[ -n "$best" ] && [ "$size" -le "$best_size" ] && continue
+			;;
+		*)
+			[ -n "$best" ] && continue
+			;;
+		esac
+		best=/dev/$disk
+		best_size=$size
+	done
+	echo "$best"
+}
+
+target=$(pick_target)
+[ -n "$target" ] || installer_fail "no disk matches the target rules of $INSTALLER_LABEL/{{.Dir}}/{{.Conf}}"
+
+echo "installer: checking the recovery image"
+(cd $mnt/{{.Dir}} && sha256sum -c {{.Sums}}) || installer_fail "the recovery image is corrupt"
+
+echo "installer: writing the recovery image to $target"
+xzcat $mnt/{{.Dir}}/{{.Payload}} | dd of="$target" bs=4M conv=fsync || installer_fail "writing $target failed"
+sync
+echo 3 > /proc/sys/vm/drop_caches
+
+echo "installer: verifying $target"
+sum=$(head -c "$IMAGE_SIZE" "$target" | sha256sum | cut -d ' ' -f 1)
+[ "$sum" = "$IMAGE_SHA256" ] || installer_fail "$target does not read back as written"
+
+echo "installer: done"
+umount $mnt
+case "$INSTALLER_FINISH" in
+poweroff)
+	poweroff -f
+	;;
+halt)
+	halt -f
+	;;
+*)
+	reboot -f
+	;;
+esac
+`))
+
+// installerImageName returns the installer image file: installer.image
+// of the config, or <image>-installer.img next to the recovery image.
+func installerImageName(recoveryOutputFile string) string {
+	if options.Installer.Image != "" {
+		return options.Installer.Image
+	}
+
+	return strings.TrimSuffix(recoveryOutputFile, ".img") + "-installer.img"
+}
+
+// fileSHA256 returns the SHA-256 and the size of file.
+func fileSHA256(file string) (string, int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// writeInstallerConf writes the target rules of config.yaml and the
+// checksum of the recovery image for the installer hook.
+func writeInstallerConf(file string, imageSum string, imageSize int64) error {
+	t := options.Installer.Target
+	removable := "no"
+	if t.Removable {
+		removable = "yes"
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# written by ubuntu-recovery-image from the installer: section of config.yaml\n")
+	fmt.Fprintf(&b, "TARGET_DEVICE=%s\n", shellQuote(t.Device))
+	fmt.Fprintf(&b, "TARGET_REMOVABLE=%s\n", removable)
+	fmt.Fprintf(&b, "TARGET_MINSIZE=%d\n", t.MinSize)
+	fmt.Fprintf(&b, "TARGET_MAXSIZE=%d\n", t.MaxSize)
+	fmt.Fprintf(&b, "TARGET_ORDER=%s\n", shellQuote(t.Order))
+	fmt.Fprintf(&b, "INSTALLER_FINISH=%s\n", shellQuote(options.Installer.Finish))
+	fmt.Fprintf(&b, "IMAGE_SIZE=%d\n", imageSize)
+	fmt.Fprintf(&b, "IMAGE_SHA256=%s\n", imageSum)
+
+	return ioutil.WriteFile(file, b.Bytes(), 0644)
+}
+
+// addInitrdHook adds the script name to the boot phase of initramfs-tools
+// (init-premount, local-premount, ...) of the unpacked initrd dir.
+func addInitrdHook(dir, phase, name string, script []byte) {
+	hook := filepath.Join(dir, "scripts", phase, name)
+	err := os.MkdirAll(filepath.Dir(hook), 0755)
+	rplib.Checkerr(err)
+	err = ioutil.WriteFile(hook, script, 0755)
+	rplib.Checkerr(err)
+
+	// initramfs-tools runs the scripts listed in ORDER
+	order, err := os.OpenFile(filepath.Join(filepath.Dir(hook), "ORDER"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	rplib.Checkerr(err)
+	defer order.Close()
+	_, err = fmt.Fprintf(order, "/scripts/%s/%s \"$@\"\n[ -e /conf/param.conf ] && . /conf/param.conf\n", phase, name)
+	rplib.Checkerr(err)
+}
+
+// addInstallerHook adds the installer hook to the unpacked initrd dir.
+func addInstallerHook(dir string) {
+	var b bytes.Buffer
+	err := installerHook.Execute(&b, map[string]string{
+		"Label":   configs.Recovery.InstallerFsLabel,
+		"Dir":     installerDir,
+		"Conf":    installerConf,
+		"Sums":    installerSums,
+		"Payload": installerPayload,
+	})
+	rplib.Checkerr(err)
+
+	addInitrdHook(dir, "local-premount", "headless-installer", b.Bytes())
+}
+
+// stageInstaller copies to stageDir the boot files of the recovery
+// partition of recoveryOutputFile, an initrd running the installer hook,
+// and the compressed recovery image with its checksums.
+func stageInstaller(recoveryOutputFile, stageDir, tmpDir string) {
+	r, err := openRecoveryImage(recoveryOutputFile)
+	rplib.Checkerr(err)
+	defer r.Close()
+
+	entries, err := r.fs.ReadDir("")
+	rplib.Checkerr(err)
+	for _, e := range entries {
+		switch e.Name() {
+		// the factory archives and the core snap are only needed once
+		// the recovery image is installed
+		case "recovery", "os.snap", utils.BuildStampFile, initrdFile:
+			continue
+		}
+		err = extractPath(r.fs, e.Name(), filepath.Join(stageDir, e.Name()))
+		rplib.Checkerr(err)
+	}
+
+	log.Printf("[setup installer initrd.img]")
+	recoveryInitrd := filepath.Join(tmpDir, "recovery-initrd.img")
+	err = extractFile(r.fs, initrdFile, recoveryInitrd)
+	rplib.Checkerr(err)
+	repackInitrd(recoveryInitrd, filepath.Join(stageDir, initrdFile), tmpDir, addInstallerHook)
+
+	if bootloaderOf(r.report.Recovery) == gadget.BootloaderGrub {
+		grubenv := filepath.Join(stageDir, grubEnvFile)
+		err = os.Remove(grubenv)
+		rplib.Checkerr(err)
+		createGrubEnv(grubenv)
+		// boot the kernel of the installer partition
+		rplib.Shellexec("grub-editenv", grubenv, "set", "recoverylabel="+configs.Recovery.InstallerFsLabel)
+		rplib.Shellexec("grub-editenv", grubenv, "set", "recoverytype="+rplib.HEADLESS_INSTALLER)
+	}
+
+	log.Printf("[add %s to the installer]", installerPayload)
+	payloadDir := filepath.Join(stageDir, installerDir)
+	err = os.MkdirAll(payloadDir, 0755)
+	rplib.Checkerr(err)
+	payload := filepath.Join(payloadDir, installerPayload)
+	rplib.Shellcmd(fmt.Sprintf("xz -T0 -c %s > %s", recoveryOutputFile, payload))
+
+	imageSum, imageSize, err := fileSHA256(recoveryOutputFile)
+	rplib.Checkerr(err)
+	payloadSum, _, err := fileSHA256(payload)
+	rplib.Checkerr(err)
+	err = ioutil.WriteFile(filepath.Join(payloadDir, installerSums), []byte(fmt.Sprintf("%s  %s\n", payloadSum, installerPayload)), 0644)
+	rplib.Checkerr(err)
+	err = writeInstallerConf(filepath.Join(payloadDir, installerConf), imageSum, imageSize)
+	rplib.Checkerr(err)
+}
+
+// dirSize returns the size of the files under dir.
+func dirSize(dir string) int64 {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return err
+	})
+	rplib.Checkerr(err)
+
+	return size
+}
+
+// createInstallerImage creates the bootable installer image of a
+// headless_installer build: one FAT partition labelled InstallerFsLabel
+// holding the boot files of the recovery image and the recovery image
+// itself, which its initrd writes to the target disk.
+func createInstallerImage(recoveryOutputFile, installerOutputFile string) {
+	log.Printf("[create installer image %s]", installerOutputFile)
+
+	tmpDir, err := ioutil.TempDir(workDir, "")
+	rplib.Checkerr(err)
+	defer os.RemoveAll(tmpDir)
+
+	stageDir := filepath.Join(tmpDir, "installer")
+	err = os.MkdirAll(stageDir, 0755)
+	rplib.Checkerr(err)
+	stageInstaller(recoveryOutputFile, stageDir, tmpDir)
+
+	// room for the FAT, the partition table and alignment
+	size := dirSize(stageDir)*11/10 + 16<<20
+	size = (size + 1<<20 - 1) &^ (1<<20 - 1)
+	f, err := os.Create(installerOutputFile)
+	rplib.Checkerr(err)
+	err = syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	f.Close()
+	rplib.Checkerr(err)
+
+	// u-boot boards load from the first partition of an MBR
+	schema := "gpt"
+	if layout.Bootloader == gadget.BootloaderUBoot {
+		schema = "msdos"
+	}
+	rplib.Shellexec("parted", "-ms", "-a", "optimal", installerOutputFile,
+		"mklabel", schema,
+		"unit", "MiB",
+		"mkpart", "primary", "fat32", "1", "100%",
+		"set", "1", "boot", "on",
+		"print")
+
+	loop := attachImage(installerOutputFile, false)
+	defer detachImage(loop)
+
+	device := filepath.Join("/dev/mapper", loop+"p1")
+	rplib.Shellexec("mkfs.fat", "-F", "32", "-n", configs.Recovery.InstallerFsLabel, device)
+
+	mountDir := filepath.Join(tmpDir, "mnt")
+	err = os.MkdirAll(mountDir, 0755)
+	rplib.Checkerr(err)
+	log.Printf("[mount device %s on installer dir %s]", device, mountDir)
+	err = syscall.Mount(device, mountDir, "vfat", 0, "")
+	rplib.Checkerr(err)
+	defer syscall.Unmount(mountDir, 0)
+
+	rplib.Shellexec("cp", "-r", stageDir+"/.", mountDir)
+}
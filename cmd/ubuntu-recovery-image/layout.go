@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery-rplib"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/disk"
+	"github.com/Lyoncore/ubuntu-recovery-image/gadget"
+	"github.com/Lyoncore/ubuntu-recovery-image/seed"
+	"github.com/Lyoncore/ubuntu-recovery-image/snap"
+)
+
+// gptReservedEnd is the end of the primary GPT header and entries, which
+// come from the copied partition table rather than from raw blobs.
+const gptReservedEnd = 34 * 512
+
+// rawRange is a raw bootloader blob of the base image outside of any
+// partition.
+type rawRange struct {
+	Name  string
+	Start int64
+	Size  int64
+}
+
+// imageLayout is the layout of the recovery image, planned before any
+// device is touched.
+type imageLayout struct {
+	Bootloader string
+	Schema     string
+	// RecoveryNR is the partition number of the recovery partition.
+	RecoveryNR int
+	// Raw are the bootloader blobs to copy from the base image. Without
+	// gadget.yaml everything in front of the first partition is copied.
+	Raw []rawRange
+	// GadgetYaml tells where the layout comes from, empty without one.
+	GadgetYaml string
+}
+
+var layout imageLayout
+
+// planLayout reads the partition table of the base image and the
+// gadget.yaml of its gadget snap, and derives the bootloader, the schema,
+// the recovery partition number and the raw blobs to copy. Values of the
+// configs section override the gadget; disagreements that cannot produce
+// a working image are returned as an error.
+func planLayout() (imageLayout, error) {
+	log.Printf("[plan image layout]")
+
+	table, err := disk.ReadTableFile(configs.Configs.BaseImage)
+	if err != nil {
+		rplib.Checkerr(imageError(configs.Configs.BaseImage, err))
+	}
+	base, err := os.Open(configs.Configs.BaseImage)
+	rplib.Checkerr(err)
+	defer base.Close()
+	writable, _, err := disk.FindByLabel(base, table, "writable")
+	rplib.Checkerr(err)
+
+	l := imageLayout{Schema: table.Schema}
+	var problems []string
+
+	info, source := readBaseGadget(*writable)
+	if info != nil {
+		name, vol, err := info.Volume()
+		rplib.Checkerr(err)
+		l.GadgetYaml = fmt.Sprintf("%s (volume %s)", source, name)
+		l.Bootloader = vol.Bootloader
+
+		if vol.EffectiveSchema() != table.Schema {
+			problems = append(problems, fmt.Sprintf("gadget.yaml declares schema %s but the base image has a %s partition table",
+				vol.EffectiveSchema(), table.Schema))
+		}
+		if data := vol.Role(gadget.RoleSystemData); data != nil && data.Number != writable.Number {
+			problems = append(problems, fmt.Sprintf("gadget.yaml puts writable on partition %d but the base image has it on partition %d",
+				data.Number, writable.Number))
+		}
+		l.Raw = rawRanges(vol, table.Schema)
+	} else {
+		log.Printf("no gadget.yaml, layout comes from config.yaml only")
+	}
+
+	if c := configs.Configs.Bootloader; c != "" && c != l.Bootloader {
+		if l.Bootloader != "" {
+			warnf("configs.bootloader %s overrides bootloader %s of gadget.yaml", c, l.Bootloader)
+		}
+		l.Bootloader = c
+	}
+	if c := configs.Configs.PartitionType; c != "" && c != table.Schema {
+		problems = append(problems, fmt.Sprintf("configs.partitiontype is %s but the base image has a %s partition table", c, table.Schema))
+	}
+
+	switch l.Bootloader {
+	case gadget.BootloaderGrub:
+		l.RecoveryNR = 1
+	case gadget.BootloaderUBoot:
+		// u-boot finds uboot.env on system-boot at a fixed location, so
+		// the recovery partition takes the place of writable instead
+		l.RecoveryNR = writable.Number
+	case "":
+		problems = append(problems, "no bootloader in gadget.yaml nor in configs.bootloader")
+	default:
+		problems = append(problems, fmt.Sprintf("unsupported bootloader %q", l.Bootloader))
+	}
+
+	if len(problems) > 0 {
+		return l, fmt.Errorf("layout conflicts:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	log.Printf("bootloader: %s, schema: %s, recovery partition: %d", l.Bootloader, l.Schema, l.RecoveryNR)
+	for _, r := range l.Raw {
+		log.Printf("raw blob %s: %d bytes at %d", r.Name, r.Size, r.Start)
+	}
+
+	return l, nil
+}
+
+// readBaseGadget returns the gadget.yaml of the local gadget snap, or
+// else of the gadget snap in the seed of the base image, read through
+// debugfs. It returns nil when the gadget snap has none.
+func readBaseGadget(writable disk.Partition) (*gadget.Info, string) {
+	gadgetPath := options.Snaps.Local.Gadget
+	if gadgetPath == "" {
+		planDir, err := ioutil.TempDir(workDir, "")
+		rplib.Checkerr(err)
+		defer os.RemoveAll(planDir)
+
+		sn, err := baseGadgetSnap(writable, planDir)
+		if _, ok := err.(*hostError); ok {
+			// as is, for the exit code of a host error
+			panic(err)
+		}
+		rplib.Checkerr(err)
+		gadgetPath = sn.Path
+	}
+
+	gadgetSnap, err := snap.Open(gadgetPath)
+	rplib.Checkerr(err)
+	defer gadgetSnap.Close()
+
+	b, err := gadgetSnap.GadgetYaml()
+	if os.IsNotExist(err) {
+		return nil, ""
+	}
+	rplib.Checkerr(err)
+
+	info, err := gadget.Read(b)
+	rplib.Checkerr(err)
+
+	return info, filepath.Base(gadgetPath)
+}
+
+// rawRanges lists the structures of vol that are not partitions. Only the
+// boot code of the MBR is taken and nothing overlapping the GPT, which
+// both come with the copied partition table.
+func rawRanges(vol *gadget.Volume, schema string) []rawRange {
+	var ranges []rawRange
+	for _, ls := range vol.LayOut() {
+		if ls.IsPartition() {
+			continue
+		}
+
+		r := rawRange{Name: ls.Name, Start: ls.Start, Size: int64(ls.Size)}
+		if ls.EffectiveRole() == gadget.RoleMBR {
+			r.Size = gadget.MBRBootCodeSize
+		} else if schema == gadget.SchemaGPT && r.Start < gptReservedEnd {
+			r.Size -= gptReservedEnd - r.Start
+			r.Start = gptReservedEnd
+		} else if r.Start < 512 {
+			r.Size -= 512 - r.Start
+			r.Start = 512
+		}
+		if r.Size > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+
+	return ranges
+}
+
+// copyRawData copies the bootloader blobs in front of the first partition,
+// which starts at firstBegin, from the base image.
+func copyRawData(recoveryOutputFile string, firstBegin int64) {
+	log.Printf("Copy raw data")
+	if layout.GadgetYaml == "" {
+		skip := int64(1)
+		if layout.Schema == gadget.SchemaGPT {
+			skip = gptReservedEnd / 512
+		}
+		rplib.DD(configs.Configs.BaseImage, recoveryOutputFile, "bs=512", fmt.Sprintf("skip=%d", skip), fmt.Sprintf("seek=%d", skip),
+			fmt.Sprintf("count=%d", firstBegin/512-skip), "conv=notrunc")
+		return
+	}
+
+	for _, r := range layout.Raw {
+		log.Printf("copy raw blob %s", r.Name)
+		rplib.DD(configs.Configs.BaseImage, recoveryOutputFile, "bs=1M", "iflag=skip_bytes,count_bytes", "oflag=seek_bytes",
+			fmt.Sprintf("skip=%d", r.Start), fmt.Sprintf("seek=%d", r.Start), fmt.Sprintf("count=%d", r.Size), "conv=notrunc")
+	}
+}
+
+// baseWritable finds the writable partition of the base image.
+func baseWritable() (disk.Partition, error) {
+	table, err := disk.ReadTableFile(configs.Configs.BaseImage)
+	if err != nil {
+		return disk.Partition{}, imageError(configs.Configs.BaseImage, err)
+	}
+	base, err := os.Open(configs.Configs.BaseImage)
+	if err != nil {
+		return disk.Partition{}, err
+	}
+	defer base.Close()
+
+	p, _, err := disk.FindByLabel(base, table, "writable")
+	if err != nil {
+		return disk.Partition{}, err
+	}
+
+	return *p, nil
+}
+
+// baseGadgetSnap copies the gadget snap of the seed of the base image to
+// dir through debugfs. Only seed.yaml, the assertions and the snap named by
+// configs.snaps.gadget or the model are dumped; the whole seed is read only
+// when they do not single out a gadget, for Resolve to tell the candidates.
+func baseGadgetSnap(writable disk.Partition, dir string) (*seed.Snap, error) {
+	if err := lookTools([]string{"debugfs"}); err != nil {
+		return nil, err
+	}
+	src := "/" + strings.TrimPrefix(seedDir, "image/writable/")
+	local := filepath.Join(dir, "gadget-seed")
+	if err := os.MkdirAll(filepath.Join(local, seed.SnapsDir), 0755); err != nil {
+		return nil, err
+	}
+
+	err := disk.Ext4Dump(configs.Configs.BaseImage, writable, path.Join(src, seed.SeedYaml), filepath.Join(local, seed.SeedYaml))
+	if err != nil {
+		return nil, err
+	}
+	want := configs.Snaps.Gadget
+	if want == "" {
+		// a seed without assertions leaves the model unknown
+		disk.Ext4DumpDir(configs.Configs.BaseImage, writable, path.Join(src, seed.AssertionsDir), local)
+	}
+	s, err := seed.ReadYaml(local)
+	if err != nil {
+		return nil, err
+	}
+	if model := s.Model(); want == "" && model != nil {
+		want = model.Gadget()
+	}
+
+	name, revision := seed.SplitWant(want)
+	candidates := s.ByName(name)
+	if revision != "" && len(candidates) > 1 {
+		var pinned []*seed.Snap
+		for _, c := range candidates {
+			if c.File == filepath.Base(want) {
+				pinned = append(pinned, c)
+			}
+		}
+		candidates = pinned
+	}
+	if len(candidates) == 1 {
+		sn := candidates[0]
+		err := disk.Ext4Dump(configs.Configs.BaseImage, writable, path.Join(src, seed.SnapsDir, sn.File), sn.Path)
+		if err != nil {
+			return nil, err
+		}
+		if err := seed.ReadSnapInfo(sn); err != nil {
+			return nil, err
+		}
+		if sn.Type == seed.TypeGadget {
+			return sn, nil
+		}
+	}
+
+	full, err := readBaseSeed(writable, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return full.Resolve(seed.TypeGadget, configs.Snaps.Gadget)
+}
+
+// readBaseSeed copies the seed of the base image writable partition to
+// dir through debugfs, and opens it. It runs before checkHost, so it
+// looks for debugfs itself.
+func readBaseSeed(writable disk.Partition, dir string) (*seed.Seed, error) {
+	if err := lookTools([]string{"debugfs"}); err != nil {
+		return nil, err
+	}
+	err := disk.Ext4DumpDir(configs.Configs.BaseImage, writable, "/"+strings.TrimPrefix(seedDir, "image/writable/"), dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return seed.Open(filepath.Join(dir, "seed"))
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/snapd/asserts"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery-rplib"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/seed"
+	"github.com/Lyoncore/ubuntu-recovery-image/snap"
+)
+
+// localSnap is a local snap file replacing a seed snap.
+type localSnap struct {
+	Replaced *seed.Snap
+	Snap     *seed.Snap
+	// AssertFile is the "snap download" assertion file of the snap, if any.
+	AssertFile string
+}
+
+// applyLocalSnaps replaces the resolved kernel, gadget and core snaps by
+// the local snap files named in config.yaml, in the seed as well.
+func applyLocalSnaps(snaps *seedSnaps) {
+	local := options.Snaps.Local
+	snaps.Kernel = applyLocalSnap(snaps, snaps.Kernel, local.Kernel)
+	snaps.Gadget = applyLocalSnap(snaps, snaps.Gadget, local.Gadget)
+	snaps.Core = applyLocalSnap(snaps, snaps.Core, local.Os)
+}
+
+func applyLocalSnap(snaps *seedSnaps, replaced *seed.Snap, path string) *seed.Snap {
+	if path == "" {
+		return replaced
+	}
+	log.Printf("[use local snap %s instead of %s]", path, replaced.File)
+
+	sn, assertFile, as := readLocalSnap(path)
+	if sn.Type != replaced.Type && !(sn.IsCore() && replaced.IsCore()) {
+		log.Panicf("local snap %s is of type %s, it cannot replace %s", path, sn.Type, replaced)
+	}
+	if sn.Name != replaced.Name {
+		log.Panicf("local snap %s is %q, it cannot replace %s", path, sn.Name, replaced)
+	}
+	sn.Channel = replaced.Channel
+	sn.DevMode = replaced.DevMode
+
+	snaps.Seed.AddAssertions(as...)
+	snaps.Seed.Replace(replaced, sn)
+	snaps.Local = append(snaps.Local, localSnap{Replaced: replaced, Snap: sn, AssertFile: assertFile})
+
+	return sn
+}
+
+// readLocalSnap describes the local snap file at path as a seed snap
+// named <name>_<revision>.snap. It also returns the "snap download"
+// assertion file next to it and its assertions, if there is one;
+// otherwise the snap is marked unasserted.
+func readLocalSnap(path string) (*seed.Snap, string, []asserts.Assertion) {
+	sn := &seed.Snap{Path: path}
+	err := seed.ReadSnapInfo(sn)
+	rplib.Checkerr(err)
+
+	// local builds carry no revision, use the x<N> convention of snapd
+	if sn.Revision == "" {
+		sn.Revision = "x1"
+	}
+	sn.File = fmt.Sprintf("%s_%s.snap", sn.Name, sn.Revision)
+
+	assertFile := strings.TrimSuffix(path, ".snap") + ".assert"
+	b, err := ioutil.ReadFile(assertFile)
+	if err != nil {
+		warnf("no %s found, %s is unasserted", assertFile, sn.Name)
+		sn.Unasserted = true
+		return sn, "", nil
+	}
+
+	as, err := seed.DecodeAssertions(b)
+	rplib.Checkerr(err)
+	for _, a := range as {
+		if decl, ok := a.(*asserts.SnapDeclaration); ok && decl.SnapName() == sn.Name {
+			sn.SnapID = decl.SnapID()
+		}
+	}
+	log.Printf("assertions of %s read from %s", sn.Name, assertFile)
+
+	return sn, assertFile, as
+}
+
+// stageFactoryImages copies the base image system-boot and writable trees
+// to a staging area and applies the local snaps to them: the seed snaps,
+// seed.yaml and assertions, and the snap_core/snap_kernel boot variables.
+// It returns the staged system-boot and writable directories.
+func stageFactoryImages(tmpDir string, snaps seedSnaps) (string, string) {
+	log.Printf("[stage factory images with local snaps]")
+
+	stageDir := filepath.Join(tmpDir, "misc/factory")
+	systembootDir := filepath.Join(stageDir, "system-boot")
+	writableDir := filepath.Join(stageDir, "writable")
+	err := os.MkdirAll(stageDir, 0755)
+	rplib.Checkerr(err)
+
+	rplib.Shellexec("rsync", "-aAX", filepath.Join(tmpDir, "image/system-boot")+"/", systembootDir)
+	rplib.Shellexec("rsync", "-aAX", filepath.Join(tmpDir, "image/writable")+"/", writableDir)
+
+	stagedSeed := filepath.Join(writableDir, "system-data/var/lib/snapd/seed")
+	for _, l := range snaps.Local {
+		err := os.Remove(filepath.Join(stagedSeed, seed.SnapsDir, l.Replaced.File))
+		rplib.Checkerr(err)
+		rplib.Shellexec("cp", "-f", l.Snap.Path, filepath.Join(stagedSeed, seed.SnapsDir, l.Snap.File))
+		if l.AssertFile != "" {
+			err = os.MkdirAll(filepath.Join(stagedSeed, seed.AssertionsDir), 0755)
+			rplib.Checkerr(err)
+			rplib.Shellexec("cp", "-f", l.AssertFile, filepath.Join(stagedSeed, seed.AssertionsDir, strings.TrimSuffix(l.Snap.File, ".snap")+".assert"))
+		}
+	}
+	err = snaps.Seed.WriteYaml(filepath.Join(stagedSeed, seed.SeedYaml))
+	rplib.Checkerr(err)
+
+	updateBootVars(systembootDir, snaps)
+
+	return systembootDir, writableDir
+}
+
+// updateBootVars points the snap_core and snap_kernel variables of the
+// system-boot partition to the local snaps.
+func updateBootVars(systembootDir string, snaps seedSnaps) {
+	vars := map[string]string{}
+	for _, l := range snaps.Local {
+		switch {
+		case l.Snap.Type == seed.TypeKernel:
+			vars["snap_kernel"] = l.Snap.File
+		case l.Snap.IsCore():
+			vars["snap_core"] = l.Snap.File
+		}
+	}
+	if len(vars) == 0 {
+		return
+	}
+
+	switch layout.Bootloader {
+	case "grub":
+		grubenv := filepath.Join(systembootDir, "efi/ubuntu/grubenv")
+		for k, v := range vars {
+			rplib.Shellexec("grub-editenv", grubenv, "set", k+"="+v)
+		}
+	case "u-boot":
+		uenv := filepath.Join(systembootDir, "uEnv.txt")
+		if _, err := os.Stat(uenv); err == nil {
+			err := setEnvFileVars(uenv, vars)
+			rplib.Checkerr(err)
+		}
+		for _, l := range snaps.Local {
+			if l.Snap.Type == seed.TypeKernel {
+				replaceKernelAssets(systembootDir, l)
+			}
+		}
+		log.Printf("uboot.env of system-boot is left as is, snapd updates it on first boot")
+	}
+}
+
+// setEnvFileVars rewrites the key=value lines of a uEnv.txt style file,
+// appending the keys it does not set yet.
+func setEnvFileVars(path string, vars map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var out bytes.Buffer
+	done := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "="); i > 0 {
+			key := line[:i]
+			if v, ok := vars[key]; ok {
+				line = key + "=" + v
+				done[key] = true
+			}
+		}
+		fmt.Fprintln(&out, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for k, v := range vars {
+		if !done[k] {
+			fmt.Fprintf(&out, "%s=%s\n", k, v)
+		}
+	}
+
+	return ioutil.WriteFile(path, out.Bytes(), 0644)
+}
+
+// replaceKernelAssets swaps the kernel assets snapd extracted to the
+// u-boot system-boot partition (<kernel snap file>/kernel.img, initrd.img
+// and dtbs) for the ones of the local kernel snap.
+func replaceKernelAssets(systembootDir string, l localSnap) {
+	oldDir := filepath.Join(systembootDir, l.Replaced.File)
+	if _, err := os.Stat(oldDir); err != nil {
+		return
+	}
+	log.Printf("[replace kernel assets %s]", oldDir)
+
+	err := os.RemoveAll(oldDir)
+	rplib.Checkerr(err)
+	newDir := filepath.Join(systembootDir, l.Snap.File)
+	err = os.MkdirAll(newDir, 0755)
+	rplib.Checkerr(err)
+
+	kernelSnap, err := snap.Open(l.Snap.Path)
+	rplib.Checkerr(err)
+	defer kernelSnap.Close()
+
+	for _, name := range []string{snap.KernelImg, snap.InitrdImg} {
+		f, err := os.Create(filepath.Join(newDir, name))
+		rplib.Checkerr(err)
+		err = kernelSnap.CopyFile(name, f)
+		f.Close()
+		rplib.Checkerr(err)
+	}
+	if _, err := kernelSnap.Filesystem().Stat("dtbs"); err == nil {
+		err = kernelSnap.Filesystem().Extract("dtbs", filepath.Join(newDir, "dtbs"))
+		rplib.Checkerr(err)
+	}
+}
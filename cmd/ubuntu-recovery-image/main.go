@@ -4,11 +4,11 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -18,9 +18,11 @@ import (
 	"gopkg.in/yaml.v2"
 
 	rplib "github.com/Lyoncore/ubuntu-recovery-rplib"
-	configdirs "github.com/Lyoncore/ubuntu-recovery-rplib/dirs/configdir"
 	recoverydirs "github.com/Lyoncore/ubuntu-recovery-rplib/dirs/recovery"
 
+	"github.com/Lyoncore/ubuntu-recovery-image/config"
+	"github.com/Lyoncore/ubuntu-recovery-image/seed"
+	"github.com/Lyoncore/ubuntu-recovery-image/snap"
 	utils "github.com/Lyoncore/ubuntu-recovery-image/utils"
 )
 
@@ -68,14 +70,14 @@ func setupLoopDevice(recoveryOutputFile string, recoveryNR string, label string)
 	rplib.Shellexec("sgdisk", recoveryOutputFile, "--randomize-guids", "--move-second-header")
 
 	var last_end int
-	const PARTITION = "/tmp/partition.txt"
-	rplib.Shellcmd(fmt.Sprintf("parted -ms %s unit B print | sed -n '1,2!p' > %s", configs.Configs.BaseImage, PARTITION))
+	// the partitions follow the unit and the disk lines
+	partitions := rplib.Shellexecoutput("parted", "-ms", configs.Configs.BaseImage, "unit", "B", "print")
 	//dd bootloader from base image
-	var f *(os.File)
-	f, err = os.Open(PARTITION)
-	rplib.Checkerr(err)
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
+	scanner := bufio.NewScanner(strings.NewReader(partitions))
+	for i := 0; scanner.Scan(); i++ {
+		if i < 2 {
+			continue
+		}
 		line := scanner.Text()
 		fields := strings.Split(line, ":")
 		nr, err := strconv.Atoi(fields[0])
@@ -91,14 +93,9 @@ func setupLoopDevice(recoveryOutputFile string, recoveryNR string, label string)
 
 		//dd data before partition
 		if nr == 1 {
-			log.Printf("Copy raw data")
-			begin_nr, err := strconv.Atoi(begin)
+			begin_nr, err := strconv.ParseInt(begin, 10, 64)
 			rplib.Checkerr(err)
-			if configs.Configs.PartitionType == "gpt" {
-				rplib.DD(configs.Configs.BaseImage, recoveryOutputFile, "bs=512", "skip=34", "seek=34", fmt.Sprintf("count=%s", (begin_nr/512)-34), "conv=notrunc")
-			} else if configs.Configs.PartitionType == "mbr" {
-				rplib.DD(configs.Configs.BaseImage, recoveryOutputFile, "bs=512", "skip=1", "seek=1", fmt.Sprintf("count=%s", (begin_nr/512)-1), "conv=notrunc")
-			}
+			copyRawData(recoveryOutputFile, begin_nr)
 		}
 
 		if recovery_nr, err := strconv.Atoi(recoveryNR); err == nil {
@@ -122,13 +119,13 @@ func setupLoopDevice(recoveryOutputFile string, recoveryNR string, label string)
 	}
 	recoveryEnd := recoveryBegin + (recoverySize * 1024 * 1024)
 
-	if configs.Configs.PartitionType == "gpt" {
+	if layout.Schema == "gpt" {
 		rplib.Shellexec("parted", "-ms", "-a", "optimal", recoveryOutputFile,
 			"unit", "B",
 			"mkpart", "primary", "fat32", fmt.Sprintf("%d", recoveryBegin), fmt.Sprintf("%d", recoveryEnd),
 			"name", recoveryNR, label,
 			"print")
-	} else if configs.Configs.PartitionType == "mbr" {
+	} else if layout.Schema == "mbr" {
 		rplib.Shellexec("parted", "-ms", "-a", "optimal", recoveryOutputFile,
 			"unit", "B",
 			"mkpart", "primary", "fat32", fmt.Sprintf("%d", recoveryBegin), fmt.Sprintf("%d", recoveryEnd),
@@ -142,66 +139,62 @@ func setupLoopDevice(recoveryOutputFile string, recoveryNR string, label string)
 	}
 
 	log.Printf("[setup a loopback device for recovery image %s]", recoveryOutputFile)
-	recoveryImageLoop := rplib.Shellcmdoutput(fmt.Sprintf("losetup --find --show %s | xargs basename", recoveryOutputFile))
+	recoveryImageLoop := attachImage(recoveryOutputFile, false)
 
+	// other builds may share the base image, it is never written
 	log.Printf("[setup a readonly loopback device for base image]")
-	baseImageLoop := rplib.Shellcmdoutput(fmt.Sprintf("losetup -r --find --show %s | xargs basename", configs.Configs.BaseImage))
+	baseImageLoop := attachImage(configs.Configs.BaseImage, true)
 
 	log.Printf("[create %s partition on %s]", recoveryOutputFile, recoveryImageLoop)
 
 	return baseImageLoop, recoveryImageLoop
 }
 
-// find snap with input name
-// input example:
-//   - ubuntu-core_144.snap
-//   - ubuntu-core
-func findSnap(folder, input string) string {
-	name := rplib.FindSnapName(input)
+func setupInitrd(initrdImagePath string, tmpDir string, kernelSnapPath string, initrdIncludeDir string) {
+	log.Printf("[SETUP_INITRD]")
 
-	// input is not a snap package file name
-	// should be a package name (such as "ubuntu-core")
-	if "" == name {
-		name = input
-	}
-	log.Printf("findSnap: %s/%s_*.snap", folder, name)
-	paths, err := filepath.Glob(fmt.Sprintf("%s/%s_*.snap", folder, name))
+	err := os.MkdirAll(filepath.Join(tmpDir, "misc"), 0755)
 	rplib.Checkerr(err)
-	if 1 != len(paths) {
-		log.Println("paths:", paths)
-		log.Panic("Should have one and only one specified snap")
-	}
-	path := paths[0]
-	log.Printf("snap path:", path)
-	return path
-}
 
-func setupInitrd(initrdImagePath string, tmpDir string) {
-	log.Printf("[SETUP_INITRD]")
+	log.Printf("[open kernel snap %s]", kernelSnapPath)
+	kernelSnap, err := snap.Open(kernelSnapPath)
+	rplib.Checkerr(err)
+	defer kernelSnap.Close()
 
+	kernelInfo, err := kernelSnap.Info()
+	rplib.Checkerr(err)
+	log.Printf("kernel snap: %s %s", kernelInfo.Name, kernelInfo.Version)
+
+	log.Printf("[unxz initrd in kernel snap]")
+	content, err := kernelSnap.Initrd()
+	rplib.Checkerr(err)
+	initrdImg := fmt.Sprintf("%s/misc/initrd.img", tmpDir)
+	err = ioutil.WriteFile(initrdImg, content, 0644)
+	rplib.Checkerr(err)
+	defer os.Remove(initrdImg)
+
+	repackInitrd(initrdImg, initrdImagePath, tmpDir, func(initrdTmpDir string) {
+		// overwrite initrd with initrd_local-include
+		rplib.Shellexec("rsync", "-r", "--exclude", ".gitkeep", initrdIncludeDir+"/", initrdTmpDir)
+	})
+}
+
+// repackInitrd unpacks the gzip or xz compressed initrd src, lets edit
+// change its files and packs them again to dst, compressed the same way.
+func repackInitrd(src string, dst string, tmpDir string, edit func(initrdTmpDir string)) {
 	initrdTmpDir := fmt.Sprintf("%s/misc/initrd/", tmpDir)
 	log.Printf("[setup %s/misc/initrd]", tmpDir)
 	err := os.MkdirAll(initrdTmpDir, 0755)
 	rplib.Checkerr(err)
 	defer os.RemoveAll(initrdTmpDir)
 
-	log.Printf("[processiing kernel snaps]")
-	kernelsnapTmpDir := fmt.Sprintf("%s/misc/kernel-snap", tmpDir)
-	err = os.MkdirAll(kernelsnapTmpDir, 0755)
+	f, err := os.Open(src)
 	rplib.Checkerr(err)
-	defer os.RemoveAll(kernelsnapTmpDir)
-
-	log.Printf("[locate kernel snap and mount]")
-	kernelSnapPath := findSnap(filepath.Join(tmpDir, "image/writable/system-data/var/lib/snapd/snaps/"), configs.Snaps.Kernel)
-
-	rplib.Shellexec("mount", kernelSnapPath, kernelsnapTmpDir)
-	defer syscall.Unmount(kernelsnapTmpDir, 0)
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	f.Close()
 
-	log.Printf("[unxz initrd in kernel snap]")
-	initrdImg := filepath.Join(kernelsnapTmpDir, "initrd.img")
-	content, err := ioutil.ReadFile(initrdImg)
-	rplib.Checkerr(err)
-	filetype := http.DetectContentType(content)
+	filetype := http.DetectContentType(head[:n])
 	log.Println("filetype:", filetype)
 	var extractCmd string
 	switch filetype {
@@ -212,57 +205,42 @@ func setupInitrd(initrdImagePath string, tmpDir string) {
 	default:
 		panic("Uknown file type")
 	}
-	extractInitrdCmd := fmt.Sprintf("%s < %s/initrd.img | (cd %s; cpio -i )", extractCmd, kernelsnapTmpDir, initrdTmpDir)
+	extractInitrdCmd := fmt.Sprintf("%s < %s | (cd %s; cpio -i )", extractCmd, src, initrdTmpDir)
 	_ = rplib.Shellcmdoutput(extractInitrdCmd)
 
-	// overwrite initrd with initrd_local-include
-	rplib.Shellexec("rsync", "-r", "--exclude", ".gitkeep", "initrd_local-includes/", initrdTmpDir)
+	edit(initrdTmpDir)
 
 	log.Printf("[recreate initrd]")
 	switch filetype {
 	case "application/x-gzip":
-		_ = rplib.Shellcmdoutput(fmt.Sprintf("( cd %s; find | cpio --quiet -o -H newc ) | gzip -9 > %s", initrdTmpDir, initrdImagePath))
+		_ = rplib.Shellcmdoutput(fmt.Sprintf("( cd %s; find | cpio --quiet -o -H newc ) | gzip -9 > %s", initrdTmpDir, dst))
 	case "application/octet-stream":
-		_ = rplib.Shellcmdoutput(fmt.Sprintf("( cd %s; find | cpio --quiet -o -H newc ) | xz -c9 --check=crc32 > %s", initrdTmpDir, initrdImagePath))
+		_ = rplib.Shellcmdoutput(fmt.Sprintf("( cd %s; find | cpio --quiet -o -H newc ) | xz -c9 --check=crc32 > %s", initrdTmpDir, dst))
 	default:
 		panic("Uknown file type")
 	}
 }
 
 func createRecoveryImage(recoveryNR string, recoveryOutputFile string, buildstamp utils.BuildStamp) {
-	var label string
-	switch configs.Recovery.ImageType {
-	case rplib.HEADLESS_INSTALLER:
-		label = configs.Recovery.InstallerFsLabel
-	default:
-		label = configs.Recovery.FsLabel
-	}
+	// a headless installer build labels its installer image with
+	// InstallerFsLabel, the recovery image stays as usual
+	label := configs.Recovery.FsLabel
 
-	// Setup loop devices
+	// Setup loop devices and device maps from partition tables
 	baseImageLoop, recoveryImageLoop := setupLoopDevice(recoveryOutputFile, recoveryNR, label)
-	// Delete loop devices
-	defer rplib.Shellcmd(fmt.Sprintf("losetup -d /dev/%s", baseImageLoop))
-	defer rplib.Shellcmd(fmt.Sprintf("losetup -d /dev/%s", recoveryImageLoop))
+	// Delete device maps and loop devices
+	defer detachImage(recoveryImageLoop)
+	defer detachImage(baseImageLoop)
 	log.Printf("[base image loop:%s, recovery image loop: %s created]\n", baseImageLoop, recoveryImageLoop)
 
-	// Create device maps from partition tables
-	log.Printf("[kpartx]")
-	rplib.Shellexec("kpartx", "-avs", fmt.Sprintf("/dev/%s", baseImageLoop))
-	rplib.Shellexec("kpartx", "-avs", fmt.Sprintf("/dev/%s", recoveryImageLoop))
-	rplib.Shellexec("udevadm", "settle")
-	// Delete device maps
-	defer rplib.Shellexec("udevadm", "settle")
-	defer rplib.Shellexec("kpartx", "-ds", fmt.Sprintf("/dev/%s", recoveryImageLoop))
-	defer rplib.Shellexec("kpartx", "-ds", fmt.Sprintf("/dev/%s", baseImageLoop))
-
 	// TODO: rewritten with launchpad/goget-ubuntu-touch/DiskImage image.Create
 	log.Printf("[mkfs.fat]")
 	rplib.Shellexec("mkfs.fat", "-F", "32", "-n", label, filepath.Join("/dev/mapper", fmt.Sprintf("%sp%s", recoveryImageLoop, recoveryNR)))
 
-	tmpDir, err := ioutil.TempDir("", "")
+	tmpDir, err := ioutil.TempDir(workDir, "")
 	rplib.Checkerr(err)
 
-	log.Printf("tmpDir:", tmpDir)
+	log.Printf("tmpDir: %s", tmpDir)
 	defer os.RemoveAll(tmpDir) // clean up
 
 	recoveryMapperDevice := fmt.Sprintf("/dev/mapper/%sp%s", recoveryImageLoop, recoveryNR)
@@ -301,41 +279,61 @@ func createRecoveryImage(recoveryNR string, recoveryOutputFile string, buildstam
 		rplib.Checkerr(err)
 		defer os.RemoveAll(baseDir) // clean up
 
+		// read-only, without replaying the ext4 journal
+		data := ""
+		if fsType == "ext4" {
+			data = "noload"
+		}
 		log.Printf("[mount device %s on base image dir %s]", part, partition)
-		err = syscall.Mount(part, baseDir, fsType, 0, "")
+		err = syscall.Mount(part, baseDir, fsType, syscall.MS_RDONLY, data)
 		rplib.Checkerr(err)
 		defer syscall.Unmount(baseDir, 0)
 
 	}
 
+	snaps := resolveSeedSnaps(tmpDir)
+	applyLocalSnaps(&snaps)
+	verifySeedSnaps(snaps)
+	if currentBuild != nil {
+		currentBuild.setSnaps(snaps)
+	}
+
+	systembootDir := filepath.Join(tmpDir, "image/system-boot")
+	writableDir := filepath.Join(tmpDir, "image/writable")
+	if len(snaps.Local) > 0 {
+		if configs.Recovery.SystembootImage != "" && configs.Recovery.WritableImage != "" {
+			log.Panicf("local snaps cannot be applied to the user provided system-boot (%s) and writable (%s) images",
+				configs.Recovery.SystembootImage, configs.Recovery.WritableImage)
+		}
+		systembootDir, writableDir = stageFactoryImages(tmpDir, snaps)
+	}
+
 	// add buildstamp
 	log.Printf("save buildstamp")
+	for _, sn := range []*seed.Snap{snaps.Kernel, snaps.Gadget, snaps.Core} {
+		buildstamp.Snaps = append(buildstamp.Snaps, utils.SnapInfo{Type: sn.Type, Name: sn.Name, Version: sn.Version, Revision: sn.Revision})
+	}
 	d, err := yaml.Marshal(&buildstamp)
 	rplib.Checkerr(err)
 	err = ioutil.WriteFile(filepath.Join(recoveryDir, utils.BuildStampFile), d, 0644)
 	rplib.Checkerr(err)
 
+	includes := renderIncludes(tmpDir, buildstamp, snaps)
+
 	log.Printf("[deploy default efi bootdir]")
 
-	if configs.Configs.Bootloader == "grub" {
+	if layout.Bootloader == "grub" {
 		// add efi/
-		rplib.Shellexec("cp", "-ar", fmt.Sprintf("%s/image/system-boot/efi", tmpDir), recoveryDir)
+		rplib.Shellexec("cp", "-ar", filepath.Join(systembootDir, "efi"), recoveryDir)
 
 		// edit efi/ubuntu/grub/grubenv
 		err = os.Remove(filepath.Join(recoveryDir, "efi/ubuntu/grubenv"))
 		rplib.Checkerr(err)
-		log.Printf("[create grubenv for switching between core and recovery system]")
-		rplib.Shellexec("grub-editenv", filepath.Join(recoveryDir, "efi/ubuntu/grubenv"), "create")
-		rplib.Shellexec("grub-editenv", filepath.Join(recoveryDir, "efi/ubuntu/grubenv"), "set", "firstfactoryrestore=no")
-		rplib.Shellexec("grub-editenv", filepath.Join(recoveryDir, "efi/ubuntu/grubenv"), "set", "recoverylabel="+configs.Recovery.FsLabel)
-		rplib.Shellexec("grub-editenv", filepath.Join(recoveryDir, "efi/ubuntu/grubenv"), "set", "recoverytype="+configs.Recovery.Type)
-		if configs.Recovery.InstallerFsLabel != "" {
-			rplib.Shellexec("grub-editenv", filepath.Join(recoveryDir, "efi/ubuntu/grubenv"), "set", "installerfslabel="+configs.Recovery.InstallerFsLabel)
-		}
-	} else if configs.Configs.Bootloader == "u-boot" {
-		rplib.Shellexec("rsync", "-aAX", "--exclude=*.snap", fmt.Sprintf("%s/image/system-boot/", tmpDir), recoveryDir)
+		createGrubEnv(filepath.Join(recoveryDir, "efi/ubuntu/grubenv"))
+	} else if layout.Bootloader == "u-boot" {
+		rplib.Shellexec("rsync", "-aAX", "--exclude=*.snap", systembootDir+"/", recoveryDir)
 		log.Printf("[create uEnv.txt]")
-		rplib.Shellexec("cp", "-f", "local-includes/uEnv.txt", fmt.Sprintf("%s/uEnv.txt", recoveryDir))
+		rplib.Shellexec("cp", "-f", filepath.Join(includes.Local, "uEnv.txt"), fmt.Sprintf("%s/uEnv.txt", recoveryDir))
 	}
 
 	// add recovery/factory/
@@ -344,7 +342,7 @@ func createRecoveryImage(recoveryNR string, recoveryOutputFile string, buildstam
 
 	// add recovery/config.yaml
 	log.Printf("[add config.yaml]")
-	rplib.Shellexec("cp", "-f", "config.yaml", filepath.Join(recoveryDir, "recovery"))
+	rplib.Shellexec("cp", "-f", effectiveConfig, filepath.Join(recoveryDir, "recovery"))
 
 	// add recovery/factory/system-boot.tar.xz
 	// add recovery/factory/writable.tar.xz
@@ -360,11 +358,11 @@ func createRecoveryImage(recoveryNR string, recoveryOutputFile string, buildstam
 		workingDir, err := os.Getwd()
 		rplib.Checkerr(err)
 
-		err = os.Chdir(fmt.Sprintf("%s/image/system-boot/", tmpDir))
+		err = os.Chdir(systembootDir)
 		rplib.Checkerr(err)
 		rplib.Shellexec("tar", "--xattrs", "-Jcpf", filepath.Join(recoveryDir, "recovery/factory/system-boot.tar.xz"), ".")
 
-		err = os.Chdir(fmt.Sprintf("%s/image/writable/", tmpDir))
+		err = os.Chdir(writableDir)
 		rplib.Checkerr(err)
 		rplib.Shellexec("tar", "--xattrs", "-Jcpf", filepath.Join(recoveryDir, "recovery/factory/writable.tar.xz"), ".")
 
@@ -373,37 +371,49 @@ func createRecoveryImage(recoveryNR string, recoveryOutputFile string, buildstam
 	}
 
 	// add /recovery/writable_local-include.squashfs
-	rplib.Shellexec("mksquashfs", configdirs.WritableLocalIncludeDir, recoverydirs.WritableLocalIncludeSquashfs, "-all-root")
+	rplib.Shellexec("mksquashfs", includes.Writable, recoverydirs.WritableLocalIncludeSquashfs, "-all-root")
 
 	// add kernel.snap
-	kernelSnap := findSnap(filepath.Join(tmpDir, "image/writable/system-data/var/lib/snapd/seed/snaps/"), configs.Snaps.Kernel)
-	rplib.Shellexec("cp", "-f", kernelSnap, filepath.Join(recoveryDir, "kernel.snap"))
+	rplib.Shellexec("cp", "-f", snaps.Kernel.Path, filepath.Join(recoveryDir, "kernel.snap"))
 	// add gadget.snap
-	gadgetSnap := findSnap(filepath.Join(tmpDir, "image/writable/system-data/var/lib/snapd/seed/snaps/"), configs.Snaps.Gadget)
-	rplib.Shellexec("cp", "-f", gadgetSnap, filepath.Join(recoveryDir, "gadget.snap"))
+	rplib.Shellexec("cp", "-f", snaps.Gadget.Path, filepath.Join(recoveryDir, "gadget.snap"))
 	// add os.snap
-	osSnap := findSnap(filepath.Join(tmpDir, "image/writable/system-data/var/lib/snapd/seed/snaps/"), configs.Snaps.Os)
-	rplib.Shellexec("cp", "-f", osSnap, filepath.Join(recoveryDir, "os.snap"))
+	rplib.Shellexec("cp", "-f", snaps.Core.Path, filepath.Join(recoveryDir, "os.snap"))
+	// add recovery/snaps/
+	addExtraSnaps(recoveryDir, snaps)
 
 	//Update uEnv.txt for os.snap/kernel.snap
-	if configs.Configs.Bootloader == "u-boot" {
+	if layout.Bootloader == "u-boot" {
 		log.Printf("[Set os/kernel snap in uEnv.txt]")
 		f, err := os.OpenFile(fmt.Sprintf("%s/uEnv.txt", recoveryDir), os.O_APPEND|os.O_WRONLY, 0644)
 		rplib.Checkerr(err)
 		defer f.Close()
-		_, err = f.WriteString(fmt.Sprintf("snap_core=%s\n", path.Base(osSnap)))
-		_, err = f.WriteString(fmt.Sprintf("snap_kernel=%s\n", path.Base(kernelSnap)))
+		_, err = f.WriteString(fmt.Sprintf("snap_core=%s\n", snaps.Core.File))
+		_, err = f.WriteString(fmt.Sprintf("snap_kernel=%s\n", snaps.Kernel.File))
 		rplib.Checkerr(err)
 	}
 
 	// add initrd.img
 	log.Printf("[setup initrd.img]")
 	initrdImagePath := fmt.Sprintf("%s/initrd.img", recoveryDir)
-	setupInitrd(initrdImagePath, tmpDir)
+	setupInitrd(initrdImagePath, tmpDir, snaps.Kernel.Path, includes.Initrd)
 
 	// overwrite with local-includes in configuration
 	log.Printf("[add local-includes]")
-	rplib.Shellexec("rsync", "-r", "--exclude", ".gitkeep", "local-includes/", recoveryDir)
+	rplib.Shellexec("rsync", "-r", "--exclude", ".gitkeep", includes.Local+"/", recoveryDir)
+}
+
+// createGrubEnv creates the grubenv switching between core and recovery
+// system.
+func createGrubEnv(grubenv string) {
+	log.Printf("[create grubenv for switching between core and recovery system]")
+	rplib.Shellexec("grub-editenv", grubenv, "create")
+	rplib.Shellexec("grub-editenv", grubenv, "set", "firstfactoryrestore=no")
+	rplib.Shellexec("grub-editenv", grubenv, "set", "recoverylabel="+configs.Recovery.FsLabel)
+	rplib.Shellexec("grub-editenv", grubenv, "set", "recoverytype="+configs.Recovery.Type)
+	if configs.Recovery.InstallerFsLabel != "" {
+		rplib.Shellexec("grub-editenv", grubenv, "set", "installerfslabel="+configs.Recovery.InstallerFsLabel)
+	}
 }
 
 func compressXZImage(imageFile string) {
@@ -411,82 +421,218 @@ func compressXZImage(imageFile string) {
 	rplib.Shellexec("xz", "-0", imageFile)
 }
 
-func printUsage() {
-	log.Println("ubuntu-recovery-image")
-	log.Println("[execute ubuntu-recovery-image in config folder]")
-	log.Println("")
-}
-
 var configs rplib.ConfigRecovery
+var options config.Options
 
-func main() {
-	// Print version
-	const configFile = "config.yaml"
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+// outputFile is the recovery image to create, see outputFileName.
+var outputFile string
 
+// newBuildStamp returns the buildstamp of a build run now, with this tool
+// and the config repo.
+func newBuildStamp() utils.BuildStamp {
 	if "" == version {
 		version = utils.Version
 	}
 
 	commitstampInt64, _ := strconv.ParseInt(commitstamp, 10, 64)
-	var buildstamp = utils.BuildStamp{
+	return utils.BuildStamp{
 		BuildDate: time.Now().UTC(),
+		Variant:   variant,
 		BuildTool: utils.ProjectInfo{
 			Version:     version,
 			Commit:      commit,
 			CommitStamp: time.Unix(commitstampInt64, 0).UTC(),
 		},
 		BuildConfig: utils.ProjectInfo{
-			Version:     utils.ReadVersionFromPackageJson(),
-			Commit:      utils.GetGitSha(),
-			CommitStamp: time.Unix(utils.CommitStamp(), 0).UTC(),
+			Version:     utils.ReadVersionFromPackageJson(configDir),
+			Commit:      utils.GetGitSha(configDir),
+			CommitStamp: time.Unix(utils.CommitStamp(configDir), 0).UTC(),
 		},
 	}
-	log.Printf("Version: %v, Commit: %v, Commit date: %v\n", version, commit, time.Unix(commitstampInt64, 0).UTC())
+}
 
-	// Load configuration
-	err := configs.Load(configFile)
-	rplib.Checkerr(err)
+func main() {
+	flag.StringVar(&configDir, "config-dir", ".", "Config repo with config.yaml, package.json and the include directories")
+	flag.StringVar(&workDir, "work-dir", "", "Directory for temporary build files (default: system temp dir)")
+	flag.Var(&configFiles, "c", "Config file, relative to the config dir; repeat to overlay files (default config.yaml)")
+	flag.Var(&configSets, "set", "Override a config value, like -set recovery.fslabel=FOO; may be repeated")
+	flag.StringVar(&variant, "variant", "", "Apply the section of this name of variants: in config.yaml")
+	flag.StringVar(&logFormat, "log-format", "text", "Log format: text or json")
+	flag.BoolVar(&verbose, "v", false, "Verbose logs, with the source line of every message")
+	flag.BoolVar(&quiet, "q", false, "Only print errors and results")
+	flag.StringVar(&outputFile, "o", "", "Same as build -o, for existing scripts")
+	flag.Usage = printUsage
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitUsage)
+	}
 
-	log.Println(configs)
+	if err := setupLogging(); err != nil {
+		os.Exit(fail(exitUsage, "%v", err))
+	}
 
-	log.Printf("[Setup project for %s]", configs.Project)
+	if workDir != "" {
+		if err := os.MkdirAll(workDir, 0755); err != nil {
+			os.Exit(fail(exitHost, "%v", err))
+		}
+	}
+
+	os.Exit(runCommand(flag.Args()))
+}
+
+// runBuild implements "ubuntu-recovery-image build [-o image]
+// [-all-variants [-jobs n]]".
+func runBuild(args []string) (code int) {
+	fs := newCommandFlags("build")
+	fs.StringVar(&outputFile, "o", outputFile, "Name of the recovery image file to create (default output.name of config.yaml in output.dir)")
+	allVariants := fs.Bool("all-variants", false, "Build every variant of config.yaml in parallel, each in its own process and work dir")
+	jobs := fs.Int("jobs", 0, "With -all-variants, the number of variants built at a time (default all)")
+	reportFile := fs.String("report", "", "JSON build report to write (default <image>.report.json)")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	if *allVariants {
+		if outputFile != "" || variant != "" {
+			return fail(exitUsage, "-all-variants names the images itself and cannot be used with -o or -variant")
+		}
+		return buildAllVariants(*jobs)
+	}
+
+	report := newBuildReport()
+	defer func() {
+		report.finish(code)
+		file := reportFileName(*reportFile, report.Image)
+		if err := report.write(file); err != nil {
+			code = fail(exitHost, "writing the build report: %v", err)
+			return
+		}
+		log.Printf("[build report %s]", file)
+	}()
+
+	// every build gets a private work dir, so that builds sharing the
+	// -work-dir or the system temp dir never see each other's files
+	keepWorkDir := workDir != ""
+	buildDir, err := ioutil.TempDir(workDir, "build-")
+	if err != nil {
+		return fail(exitHost, "%v", err)
+	}
+	workDir = buildDir
+	if !keepWorkDir {
+		defer os.RemoveAll(buildDir)
+	}
+	log.Printf("[work dir %s]", workDir)
 
-	log.Println("[Base image is %s]", configs.Configs.BaseImage)
+	buildstamp := newBuildStamp()
+	log.Printf("Version: %v, Commit: %v, Commit date: %v\n", version, commit, buildstamp.BuildTool.CommitStamp)
 
-	// Check if base image exists
-	if _, err := os.Stat(configs.Configs.BaseImage); err != nil {
-		log.Println("Error: can not find base image: %s, please build base image first", configs.Configs.BaseImage)
-		os.Exit(2)
+	// Load configuration
+	defer removeEffectiveConfig()
+	var recoveryOutputFile string
+	code = report.stage("config", func() int {
+		if code := loadBuildConfig(); code != exitOK {
+			return code
+		}
+
+		var err error
+		recoveryOutputFile, err = outputFileName(true)
+		if err != nil {
+			return fail(exitUsage, "%v", err)
+		}
+		log.Printf("[output %s]", recoveryOutputFile)
+		report.Image = recoveryOutputFile
+		buildstamp.Output = filepath.Base(recoveryOutputFile)
+		if configs.Debug.Xz {
+			buildstamp.Output += ".xz"
+		}
+		return exitOK
+	})
+	if code != exitOK {
+		return code
 	}
 
-	var recoveryNR string
-	// Create recovery image if 'recoverytype' field is 'recovery' or 'full'
-	if configs.Configs.Bootloader == "grub" {
-		recoveryNR = "1"
-	} else if configs.Configs.Bootloader == "u-boot" {
-		//u-boot must put uboot.env in system-boot and partition need in fixing location
-		//So, let recovry partition location in next to system-boot (the orignal writable)
-		const PARTITON = "/tmp/partition"
-		Loop := rplib.Shellcmdoutput(fmt.Sprintf("losetup --find --show %s | xargs basename", configs.Configs.BaseImage))
-		rplib.Shellcmdoutput(fmt.Sprintf("kpartx -avs /dev/%s", Loop))
-		recovery_part := rplib.Findfs("LABEL=writable") //new recovery partition locate in writable
-		recoveryNR = strings.Trim(recovery_part, fmt.Sprintf("/dev/mapper/%sp", Loop))
-		defer rplib.Shellcmdoutput(fmt.Sprintf("kpartx -ds %s", configs.Configs.BaseImage))
+	log.Printf("[Setup project for %s]", configs.Project)
+
+	// Plan the layout before any device is touched
+	code = report.stage("layout", func() int {
+		var err error
+		if layout, err = planLayout(); err != nil {
+			return fail(exitUsage, "%v", err)
+		}
+		report.Layout = &layout
+		return exitOK
+	})
+	if code != exitOK {
+		return code
 	}
 
-	log.Printf("[start create recovery image with skipxz options: %s.\n]", configs.Debug.Xz)
+	code = report.stage("inputs", func() int {
+		if err := report.hashInputs(); err != nil {
+			return fail(exitUsage, "%v", err)
+		}
+		return exitOK
+	})
+	if code != exitOK {
+		return code
+	}
 
-	todayTime := time.Now()
-	todayDate := fmt.Sprintf("%d%02d%02d", todayTime.Year(), todayTime.Month(), todayTime.Day())
-	defaultOutputFilename := configs.Project + "-" + todayDate + "-0.img"
-	recoveryOutputFile := flag.String("o", defaultOutputFilename, "Name of the recovery image file to create")
-	flag.Parse()
+	code = report.stage("host", func() int {
+		if err := checkHost(layout.Bootloader); err != nil {
+			return fail(exitHost, "%v", err)
+		}
+		return exitOK
+	})
+	if code != exitOK {
+		return code
+	}
 
-	createRecoveryImage(recoveryNR, *recoveryOutputFile, buildstamp)
+	log.Printf("[start create recovery image with xz compression: %v]", configs.Debug.Xz)
 
-	// Compress image to xz if 'xz' field is 'on'
-	if configs.Debug.Xz {
-		compressXZImage(*recoveryOutputFile)
+	// the artifacts are recorded once their stage succeeded, an image
+	// compressed later is gone when the report hashes them
+	images := []string{recoveryOutputFile}
+	if configs.Recovery.ImageType == rplib.HEADLESS_INSTALLER {
+		images = append(images, installerImageName(recoveryOutputFile))
+	}
+	stages := []struct {
+		name string
+		run  bool
+		f    func()
+	}{
+		{"image", true, func() {
+			createRecoveryImage(strconv.Itoa(layout.RecoveryNR), recoveryOutputFile, buildstamp)
+			report.addArtifact(recoveryOutputFile)
+		}},
+		{"installer", configs.Recovery.ImageType == rplib.HEADLESS_INSTALLER, func() {
+			createInstallerImage(recoveryOutputFile, installerImageName(recoveryOutputFile))
+			report.addArtifact(installerImageName(recoveryOutputFile))
+		}},
+		{"netboot", options.Netboot.Enable, func() {
+			createNetbootBundle(recoveryOutputFile, netbootDirName(recoveryOutputFile))
+			report.addArtifact(netbootDirName(recoveryOutputFile))
+		}},
+		// Compress image to xz if 'xz' field is 'on'
+		{"compress", configs.Debug.Xz, func() {
+			for _, image := range images {
+				compressXZImage(image)
+				report.addArtifact(image + ".xz")
+			}
+		}},
 	}
+	for _, s := range stages {
+		if !s.run {
+			continue
+		}
+		f := s.f
+		if code = report.stage(s.name, func() int { f(); return exitOK }); code != exitOK {
+			break
+		}
+	}
+
+	return code
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery-rplib"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/config"
+	utils "github.com/Lyoncore/ubuntu-recovery-image/utils"
+)
+
+// checkSchemaVersion refuses configs written for a newer tool and points
+// unversioned ones to migrate-config.
+func checkSchemaVersion() error {
+	if err := config.CheckSchemaVersion(options.SchemaVersion); err != nil {
+		return err
+	}
+	if options.SchemaVersion < config.SchemaVersion {
+		warnf("config schemaversion %d is outdated, run ubuntu-recovery-image migrate-config", options.SchemaVersion)
+	}
+
+	return nil
+}
+
+// runMigrate implements "ubuntu-recovery-image migrate-config [-dry-run]
+// [config.yaml...]": it rewrites the config files to the current schema
+// and prints the changes as a diff.
+func runMigrate(args []string) int {
+	fs := newCommandFlags("migrate-config")
+	dryRun := fs.Bool("dry-run", false, "Print the changes without writing them")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = configFiles
+	}
+	if len(files) == 0 {
+		files = []string{"config.yaml"}
+	}
+
+	for _, f := range files {
+		path := configPath(f)
+		if err := migrateFile(path, *dryRun); err != nil {
+			return fail(exitUsage, "%s: %v", path, err)
+		}
+	}
+
+	return exitOK
+}
+
+func migrateFile(path string, dryRun bool) error {
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	doc, err := config.ReadDocument(path)
+	if err != nil {
+		return err
+	}
+	applied, err := doc.Migrate(rplib.ConfigRecovery{}, config.Options{})
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		fmt.Printf("%s: schemaversion %d is current\n", path, config.SchemaVersion)
+		return nil
+	}
+
+	after, err := doc.Encode(false)
+	if err != nil {
+		return err
+	}
+	for _, a := range applied {
+		fmt.Printf("%s: %s\n", path, a)
+	}
+	fmt.Print(utils.UnifiedDiff(path, path, string(before), string(after)))
+
+	if dryRun {
+		return nil
+	}
+
+	return ioutil.WriteFile(path, after, 0644)
+}
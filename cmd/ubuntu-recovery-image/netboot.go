@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery-rplib"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/disk"
+	"github.com/Lyoncore/ubuntu-recovery-image/snap"
+)
+
+// Files of the netboot bundle.
+const (
+	netbootKernel    = "vmlinuz"
+	netbootPartition = "recovery.img"
+	netbootIPXE      = "boot.ipxe"
+	netbootGrub      = "grub.cfg"
+	netbootSums      = "SHA256SUMS"
+)
+
+// netbootHook is the initramfs-tools script of the netboot initrd: booted
+// with recoveryurl= it fetches the copy of the recovery partition and
+// attaches it to a loop device, before the local-premount scripts run.
+// The restore scripts then find it by its label as they find the
+// partition on disk.
+const netbootHook = `#!/bin/sh
+# netboot, generated by ubuntu-recovery-image
+PREREQ=""
+prereqs()
+{
+	echo "$PREREQ"
+}
+case "$1" in
+prereqs)
+	prereqs
+	exit 0
+	;;
+esac
+
+. /scripts/functions
+
+url=""
+sum=""
+label=""
+for arg in $(cat /proc/cmdline); do
+	case "$arg" in
+	recoveryurl=*)
+		url=${arg#recoveryurl=}
+		;;
+	recoverysha256=*)
+		sum=${arg#recoverysha256=}
+		;;
+	recoverylabel=*)
+		label=${arg#recoverylabel=}
+		;;
+	esac
+done
+# booted from the recovery partition
+[ -n "$url" ] || exit 0
+
+# the restore scripts could not tell the copy from a partition on disk
+if [ -n "$label" ] && part=$(blkid -L "$label"); then
+	panic "netboot: $part is labelled $label already, wipe it to restore from $url"
+fi
+
+dir=/run/netboot
+mkdir -p $dir
+configure_networking
+echo "netboot: fetching $url"
+case "$url" in
+tftp://*)
+	server=${url#tftp://}
+	file=${server#*/}
+	server=${server%%/*}
+	port=""
+	case "$server" in
+	*:*)
+		port=${server#*:}
+		server=${server%%:*}
+		;;
+	esac
+	tftp -g -r "$file" -l $dir/recovery.img "$server" $port || panic "netboot: cannot fetch $url"
+	;;
+*)
+	wget -O $dir/recovery.img "$url" || panic "netboot: cannot fetch $url"
+	;;
+esac
+if [ -n "$sum" ]; then
+	[ "$(sha256sum $dir/recovery.img | cut -d ' ' -f 1)" = "$sum" ] || panic "netboot: $url is corrupt"
+fi
+loop=$(losetup -f) && losetup "$loop" $dir/recovery.img || panic "netboot: cannot attach $url"
+udevadm settle
+echo "netboot: $url is the recovery partition $label on $loop"
+`
+
+var netbootIPXETemplate = template.Must(template.New("ipxe").Parse(`#!ipxe
+# {{.Project}} recovery over the network, generated by ubuntu-recovery-image
+kernel {{.URL}}/{{.Kernel}} initrd={{.Initrd}} {{.Cmdline}}
+initrd {{.URL}}/{{.Initrd}}
+boot
+`))
+
+var netbootGrubTemplate = template.Must(template.New("grub").Parse(`# {{.Project}} recovery over the network, generated by ubuntu-recovery-image
+set timeout=3
+insmod {{.Scheme}}
+menuentry "{{.Project}} recovery (network)" {
+	linux ({{.Scheme}},{{.Host}}){{.Path}}/{{.Kernel}} {{.Cmdline}}
+	initrd ({{.Scheme}},{{.Host}}){{.Path}}/{{.Initrd}}
+}
+`))
+
+// netbootDirName returns the netboot bundle directory: netboot.dir of the
+// config, or <image>-netboot next to the recovery image.
+func netbootDirName(recoveryOutputFile string) string {
+	if options.Netboot.Dir != "" {
+		return options.Netboot.Dir
+	}
+
+	return strings.TrimSuffix(recoveryOutputFile, ".img") + "-netboot"
+}
+
+// addNetbootHook adds the netboot hook to the unpacked initrd dir.
+func addNetbootHook(dir string) {
+	addInitrdHook(dir, "init-premount", "netboot", []byte(netbootHook))
+}
+
+// netbootCmdline returns the kernel command line of the boot configs.
+func netbootCmdline(baseURL, partitionSum string) string {
+	args := []string{
+		"recoverylabel=" + configs.Recovery.FsLabel,
+		"recoverytype=" + configs.Recovery.Type,
+		"recoveryurl=" + baseURL + "/" + netbootPartition,
+		"recoverysha256=" + partitionSum,
+	}
+	if options.Netboot.Cmdline != "" {
+		args = append(args, options.Netboot.Cmdline)
+	}
+
+	return strings.Join(args, " ")
+}
+
+// writeNetbootConfigs writes the iPXE script and the grub-net config
+// loading the bundle from netboot.url, over HTTP or TFTP.
+func writeNetbootConfigs(dir, partitionSum string) {
+	baseURL := strings.TrimSuffix(options.Netboot.URL, "/")
+	u, err := url.Parse(baseURL)
+	rplib.Checkerr(err)
+
+	data := map[string]string{
+		"Project": configs.Project,
+		"URL":     baseURL,
+		"Scheme":  u.Scheme,
+		"Host":    u.Host,
+		"Path":    u.Path,
+		"Kernel":  netbootKernel,
+		"Initrd":  initrdFile,
+		"Cmdline": netbootCmdline(baseURL, partitionSum),
+	}
+	for name, t := range map[string]*template.Template{netbootIPXE: netbootIPXETemplate, netbootGrub: netbootGrubTemplate} {
+		var b bytes.Buffer
+		err := t.Execute(&b, data)
+		rplib.Checkerr(err)
+		err = ioutil.WriteFile(filepath.Join(dir, name), b.Bytes(), 0644)
+		rplib.Checkerr(err)
+	}
+}
+
+// copyPartition copies the partition nr of image to dst.
+func copyPartition(image string, nr int, dst string) error {
+	table, err := disk.ReadTableFile(image)
+	if err != nil {
+		return imageError(image, err)
+	}
+	p := table.Partition(nr)
+	if p == nil {
+		return fmt.Errorf("%s: no partition %d", image, nr)
+	}
+
+	in, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, io.NewSectionReader(in, p.Start, p.Size)); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// createNetbootBundle writes to dir the kernel of the kernel snap, the
+// recovery initrd with the netboot hook, a copy of the recovery partition
+// of recoveryOutputFile and boot configs, so that the restore runs from
+// an HTTP or TFTP server instead of the recovery partition.
+func createNetbootBundle(recoveryOutputFile, dir string) {
+	log.Printf("[create netboot bundle %s]", dir)
+
+	tmpDir, err := ioutil.TempDir(workDir, "")
+	rplib.Checkerr(err)
+	defer os.RemoveAll(tmpDir)
+
+	err = os.MkdirAll(dir, 0755)
+	rplib.Checkerr(err)
+
+	r, err := openRecoveryImage(recoveryOutputFile)
+	rplib.Checkerr(err)
+	defer r.Close()
+
+	log.Printf("[add %s from kernel.snap]", netbootKernel)
+	kernelSnapPath := filepath.Join(tmpDir, "kernel.snap")
+	err = extractFile(r.fs, "kernel.snap", kernelSnapPath)
+	rplib.Checkerr(err)
+	kernelSnap, err := snap.Open(kernelSnapPath)
+	rplib.Checkerr(err)
+	kernel, err := kernelSnap.Kernel()
+	kernelSnap.Close()
+	rplib.Checkerr(err)
+	err = ioutil.WriteFile(filepath.Join(dir, netbootKernel), kernel, 0644)
+	rplib.Checkerr(err)
+
+	log.Printf("[setup netboot initrd.img]")
+	initrd := filepath.Join(tmpDir, initrdFile)
+	err = extractFile(r.fs, initrdFile, initrd)
+	rplib.Checkerr(err)
+	repackInitrd(initrd, filepath.Join(dir, initrdFile), tmpDir, addNetbootHook)
+
+	log.Printf("[add %s]", netbootPartition)
+	err = copyPartition(recoveryOutputFile, r.report.Recovery.Partition, filepath.Join(dir, netbootPartition))
+	rplib.Checkerr(err)
+
+	var sums bytes.Buffer
+	var partitionSum string
+	for _, name := range []string{netbootKernel, initrdFile, netbootPartition} {
+		sum, _, err := fileSHA256(filepath.Join(dir, name))
+		rplib.Checkerr(err)
+		fmt.Fprintf(&sums, "%s  %s\n", sum, name)
+		if name == netbootPartition {
+			partitionSum = sum
+		}
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, netbootSums), sums.Bytes(), 0644)
+	rplib.Checkerr(err)
+
+	writeNetbootConfigs(dir, partitionSum)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	utils "github.com/Lyoncore/ubuntu-recovery-image/utils"
+)
+
+// defaultOutputName is the output.name template used when config.yaml has
+// none.
+const defaultOutputName = "{{.Project}}{{with .Variant}}-{{.}}{{end}}-{{.Date}}-{{.Build}}.img"
+
+// buildNumberFile keeps the last build number of the day in the output
+// directory, as "<YYYYMMDD> <number>".
+const buildNumberFile = ".build-number"
+
+// outputNameData is what output.name templates see.
+type outputNameData struct {
+	Project string
+	Variant string
+	// Date is the build date, YYYYMMDD.
+	Date string
+	// Version and Commit are the package.json version and the git
+	// describe of the config repo.
+	Version string
+	Commit  string
+	// Build numbers the builds of the day in the output directory, from 0.
+	Build int
+}
+
+// parseOutputName parses the output.name template, the default one if
+// empty.
+func parseOutputName(name string) (*template.Template, error) {
+	if name == "" {
+		name = defaultOutputName
+	}
+
+	return template.New("output.name").Option("missingkey=error").Parse(name)
+}
+
+// outputName renders the output.name template for a build of project and
+// variant and returns the image path in dir. With reserve, the build
+// number is taken from the counter of dir, else the next one is only
+// looked at.
+func outputName(nameTemplate, dir, project, variant string, reserve bool) (string, error) {
+	if dir == "" {
+		dir = "."
+	}
+	tmpl, err := parseOutputName(nameTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	date := time.Now().Format("20060102")
+	build, err := nextBuildNumber(dir, date, reserve)
+	if err != nil {
+		return "", err
+	}
+	data := outputNameData{
+		Project: project,
+		Variant: variant,
+		Date:    date,
+		Version: utils.ReadVersionFromPackageJson(configDir),
+		Commit:  utils.GetGitSha(configDir),
+		Build:   build,
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(b.String())
+	if name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("output.name %q is not a file name", name)
+	}
+
+	return filepath.Join(dir, name), nil
+}
+
+// nextBuildNumber returns the number of the next build of date in dir,
+// counting it if reserve is set. The counter is locked, so builds running
+// in parallel get different numbers.
+func nextBuildNumber(dir, date string, reserve bool) (int, error) {
+	file := filepath.Join(dir, buildNumberFile)
+	if !reserve {
+		b, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		return parseBuildNumber(b, date), nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return 0, err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+	n := parseBuildNumber(b, date)
+	if err := f.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err := f.WriteAt([]byte(fmt.Sprintf("%s %d\n", date, n)), 0); err != nil {
+		return 0, err
+	}
+
+	return n, f.Sync()
+}
+
+// parseBuildNumber returns the build number following the one counted in
+// b, or 0 for the first build of date.
+func parseBuildNumber(b []byte, date string) int {
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 || fields[0] != date {
+		return 0
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0
+	}
+
+	return n + 1
+}
+
+// outputFileName returns the -o file, or the output.name of config.yaml in
+// output.dir, see outputName.
+func outputFileName(reserve bool) (string, error) {
+	if outputFile != "" {
+		return outputFile, nil
+	}
+
+	return outputName(options.Output.Name, options.Output.Dir, configs.Project, variant, reserve)
+}
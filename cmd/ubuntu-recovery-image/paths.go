@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+)
+
+var (
+	// configDir is the config repo: config.yaml, package.json and the
+	// include directories.
+	configDir = "."
+	// workDir holds the temporary build files, the system temp dir if empty.
+	workDir string
+)
+
+// configPath resolves a path of the config repo against configDir.
+func configPath(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+
+	return filepath.Join(configDir, p)
+}
+
+// resolveConfigPaths makes the file paths of config.yaml relative to the
+// config dir instead of the current directory.
+func resolveConfigPaths() {
+	configs.Configs.BaseImage = configPath(configs.Configs.BaseImage)
+	configs.Recovery.SystembootImage = configPath(configs.Recovery.SystembootImage)
+	configs.Recovery.WritableImage = configPath(configs.Recovery.WritableImage)
+
+	options.Snaps.Local.Kernel = configPath(options.Snaps.Local.Kernel)
+	options.Snaps.Local.Gadget = configPath(options.Snaps.Local.Gadget)
+	options.Snaps.Local.Os = configPath(options.Snaps.Local.Os)
+	for i := range options.Snaps.Extra {
+		options.Snaps.Extra[i].File = configPath(options.Snaps.Extra[i].File)
+	}
+	for _, dirs := range [][]string{options.Includes.Local, options.Includes.Initrd, options.Includes.Writable} {
+		for i := range dirs {
+			dirs[i] = configPath(dirs[i])
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+)
+
+// runPlan implements "ubuntu-recovery-image plan": it prints the layout
+// the build would use, without touching any device.
+func runPlan(args []string) int {
+	fs := newCommandFlags("plan")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+
+	code := loadBuildConfig()
+	defer removeEffectiveConfig()
+	if code != exitOK {
+		return code
+	}
+
+	l, err := planLayout()
+	if err != nil {
+		return fail(exitUsage, "%v", err)
+	}
+
+	fmt.Printf("base image:         %s\n", configs.Configs.BaseImage)
+	if l.GadgetYaml != "" {
+		fmt.Printf("gadget.yaml:        %s\n", l.GadgetYaml)
+	}
+	fmt.Printf("bootloader:         %s\n", l.Bootloader)
+	fmt.Printf("partition table:    %s\n", l.Schema)
+	fmt.Printf("recovery partition: %d, %s MB\n", l.RecoveryNR, configs.Configs.RecoverySize)
+	for _, r := range l.Raw {
+		fmt.Printf("raw blob:           %s, %d bytes at %d\n", r.Name, r.Size, r.Start)
+	}
+	output, err := outputFileName(false)
+	if err != nil {
+		return fail(exitUsage, "%v", err)
+	}
+	fmt.Printf("output:             %s\n", output)
+
+	return exitOK
+}
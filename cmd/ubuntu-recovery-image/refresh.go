@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery-rplib"
+	recoverydirs "github.com/Lyoncore/ubuntu-recovery-rplib/dirs/recovery"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/disk"
+	"github.com/Lyoncore/ubuntu-recovery-image/gadget"
+	"github.com/Lyoncore/ubuntu-recovery-image/seed"
+	utils "github.com/Lyoncore/ubuntu-recovery-image/utils"
+)
+
+// refreshOptions are what refresh replaces on the recovery partition.
+type refreshOptions struct {
+	// Kernel, Gadget and Os are snap files replacing the snaps of the
+	// recovery partition.
+	Kernel, Gadget, Os string
+	Initrd             bool
+	Includes           bool
+	Env                bool
+}
+
+// replaced lists what opts replace, for the refresh history.
+func (opts refreshOptions) replaced(bootloader string) []string {
+	var l []string
+	for _, s := range []struct{ file, name string }{
+		{opts.Kernel, "kernel.snap"},
+		{opts.Gadget, "gadget.snap"},
+		{opts.Os, "os.snap"},
+	} {
+		if s.file != "" {
+			l = append(l, s.name)
+		}
+	}
+	if opts.Kernel != "" || opts.Initrd {
+		l = append(l, initrdFile)
+	}
+	if opts.Includes {
+		l = append(l, "local-includes", "writable_local-includes")
+	}
+	if opts.Env {
+		l = append(l, envFileOf(bootloader))
+	}
+
+	return l
+}
+
+// tools lists the host tools refreshing with opts runs.
+func (opts refreshOptions) tools(bootloader string) []string {
+	tools := []string{"mcopy", "mmd"}
+	if opts.Kernel != "" || opts.Initrd {
+		tools = append(tools, "cpio", "rsync", "gzip", "xz")
+	}
+	if opts.Includes {
+		tools = append(tools, "rsync", "mksquashfs")
+	}
+	if opts.Env && bootloader == gadget.BootloaderGrub {
+		tools = append(tools, "grub-editenv")
+	}
+
+	return tools
+}
+
+// bootloaderOf tells the bootloader of a recovery partition from its boot
+// environment file.
+func bootloaderOf(r *recoveryReport) string {
+	switch r.EnvFile {
+	case grubEnvFile:
+		return gadget.BootloaderGrub
+	case uEnvFile:
+		return gadget.BootloaderUBoot
+	}
+
+	return ""
+}
+
+func envFileOf(bootloader string) string {
+	if bootloader == gadget.BootloaderGrub {
+		return grubEnvFile
+	}
+
+	return uEnvFile
+}
+
+// refreshLayout returns the layout of a built image with the recovery
+// partition r, as planLayout planned it for the build, so that the
+// templates render the same in a refresh.
+func refreshLayout(table *disk.Table, r *recoveryReport) imageLayout {
+	return imageLayout{
+		Bootloader: bootloaderOf(r),
+		Schema:     table.Schema,
+		RecoveryNR: r.Partition,
+	}
+}
+
+// stampSnaps turns the snaps of a buildstamp back into seed snaps for the
+// templates; a snap the buildstamp does not list is left empty.
+func stampSnaps(list []utils.SnapInfo) seedSnaps {
+	snaps := seedSnaps{
+		Kernel: &seed.Snap{Type: seed.TypeKernel},
+		Gadget: &seed.Snap{Type: seed.TypeGadget},
+		Core:   &seed.Snap{Type: seed.TypeOS},
+	}
+	for _, s := range list {
+		sn := &seed.Snap{Name: s.Name, Type: s.Type, Version: s.Version, Revision: s.Revision}
+		switch {
+		case s.Type == seed.TypeKernel:
+			snaps.Kernel = sn
+		case s.Type == seed.TypeGadget:
+			snaps.Gadget = sn
+		case sn.IsCore():
+			snaps.Core = sn
+		}
+	}
+
+	return snaps
+}
+
+// refreshSnap stages the snap file replacing name in the recovery
+// partition, after checking that it has the type of the snap it replaces.
+func refreshSnap(stageDir, name, file string, old *seed.Snap) *seed.Snap {
+	sn := &seed.Snap{Path: file}
+	err := seed.ReadSnapInfo(sn)
+	rplib.Checkerr(err)
+	if sn.Type != old.Type && !(sn.IsCore() && old.IsCore()) {
+		log.Panicf("%s is a %s snap, it cannot replace the %s snap %s", file, sn.Type, old.Type, name)
+	}
+	log.Printf("[replace %s %s %s by %s %s]", name, old.Name, old.Version, sn.Name, sn.Version)
+
+	rplib.Shellexec("cp", "-f", file, filepath.Join(stageDir, name))
+
+	return sn
+}
+
+// refreshImage replaces what opts name on the recovery partition of image,
+// in place. The new files are staged in a directory mirroring the
+// partition and then written with mtools, so no root is needed. The
+// factory archives are kept as they are.
+func refreshImage(image string, report *imageReport, opts refreshOptions, stamp utils.BuildStamp) {
+	r := report.Recovery
+	bootloader := bootloaderOf(r)
+	table, err := disk.ReadTableFile(image)
+	if err != nil {
+		rplib.Checkerr(imageError(image, err))
+	}
+	layout = refreshLayout(table, r)
+
+	tmpDir, err := ioutil.TempDir(workDir, "")
+	rplib.Checkerr(err)
+	defer os.RemoveAll(tmpDir)
+
+	stageDir := filepath.Join(tmpDir, "recovery")
+	err = os.MkdirAll(stageDir, 0755)
+	rplib.Checkerr(err)
+	recoverydirs.SetRootDir(stageDir)
+
+	var buildstamp utils.BuildStamp
+	if r.BuildStamp != nil {
+		buildstamp = *r.BuildStamp
+	}
+
+	snaps := stampSnaps(r.Snaps)
+	if opts.Kernel != "" {
+		snaps.Kernel = refreshSnap(stageDir, "kernel.snap", opts.Kernel, snaps.Kernel)
+	}
+	if opts.Gadget != "" {
+		snaps.Gadget = refreshSnap(stageDir, "gadget.snap", opts.Gadget, snaps.Gadget)
+	}
+	if opts.Os != "" {
+		snaps.Core = refreshSnap(stageDir, "os.snap", opts.Os, snaps.Core)
+	}
+	buildstamp.Snaps = nil
+	for _, sn := range []*seed.Snap{snaps.Kernel, snaps.Gadget, snaps.Core} {
+		if sn.Name != "" {
+			buildstamp.Snaps = append(buildstamp.Snaps, utils.SnapInfo{Type: sn.Type, Name: sn.Name, Version: sn.Version, Revision: sn.Revision})
+		}
+	}
+	buildstamp.Refreshes = append(buildstamp.Refreshes, utils.Refresh{
+		Date:        stamp.BuildDate,
+		BuildTool:   stamp.BuildTool,
+		BuildConfig: stamp.BuildConfig,
+		Replaced:    opts.replaced(bootloader),
+	})
+
+	// the templates see the buildstamp as it is after the refresh
+	var includes includeDirs
+	if opts.Kernel != "" || opts.Initrd || opts.Includes || opts.Env && bootloader == gadget.BootloaderUBoot {
+		includes = renderIncludes(tmpDir, buildstamp, snaps)
+	}
+
+	if opts.Kernel != "" || opts.Initrd {
+		kernelPath := opts.Kernel
+		if kernelPath == "" {
+			kernelPath = filepath.Join(tmpDir, "kernel.snap")
+			ri, err := openRecoveryImage(image)
+			rplib.Checkerr(err)
+			err = extractFile(ri.fs, "kernel.snap", kernelPath)
+			ri.Close()
+			rplib.Checkerr(err)
+		}
+		log.Printf("[setup initrd.img]")
+		setupInitrd(filepath.Join(stageDir, initrdFile), tmpDir, kernelPath, includes.Initrd)
+	}
+
+	if opts.Includes {
+		log.Printf("[add local-includes]")
+		rplib.Shellexec("rsync", "-r", "--exclude", ".gitkeep", includes.Local+"/", stageDir)
+		err = os.MkdirAll(filepath.Dir(recoverydirs.WritableLocalIncludeSquashfs), 0755)
+		rplib.Checkerr(err)
+		rplib.Shellexec("mksquashfs", includes.Writable, recoverydirs.WritableLocalIncludeSquashfs, "-all-root")
+	}
+
+	// after the local-includes, as in a build
+	if opts.Env {
+		switch bootloader {
+		case gadget.BootloaderGrub:
+			grubenv := filepath.Join(stageDir, grubEnvFile)
+			err = os.MkdirAll(filepath.Dir(grubenv), 0755)
+			rplib.Checkerr(err)
+			createGrubEnv(grubenv)
+		case gadget.BootloaderUBoot:
+			log.Printf("[create uEnv.txt]")
+			b, err := ioutil.ReadFile(filepath.Join(includes.Local, uEnvFile))
+			rplib.Checkerr(err)
+			// the snaps of the factory archives are unchanged
+			for _, v := range r.Env {
+				if v.Name == "snap_core" || v.Name == "snap_kernel" {
+					b = append(b, fmt.Sprintf("%s=%s\n", v.Name, v.Value)...)
+				}
+			}
+			err = ioutil.WriteFile(filepath.Join(stageDir, uEnvFile), b, 0644)
+			rplib.Checkerr(err)
+		default:
+			log.Panicf("no %s or %s on the recovery partition, the bootloader is unknown", grubEnvFile, uEnvFile)
+		}
+	}
+
+	target := fmt.Sprintf("%s@@%d", image, table.Partition(r.Partition).Start)
+	writeFatTree(target, stageDir)
+
+	// last, so that a failed refresh is not recorded
+	log.Printf("save buildstamp")
+	d, err := yaml.Marshal(&buildstamp)
+	rplib.Checkerr(err)
+	stampFile := filepath.Join(tmpDir, utils.BuildStampFile)
+	err = ioutil.WriteFile(stampFile, d, 0644)
+	rplib.Checkerr(err)
+	rplib.Shellexec("mcopy", "-o", "-i", target, stampFile, "::"+utils.BuildStampFile)
+}
+
+// writeFatTree copies the content of dir to the root of the FAT file
+// system target, an mtools image@@offset, replacing existing files.
+func writeFatTree(target, dir string) {
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		name := "::" + filepath.ToSlash(rel)
+		if info.IsDir() {
+			// -D s skips the directories which exist already
+			rplib.Shellexec("mmd", "-D", "s", "-i", target, name)
+		} else {
+			log.Printf("[write %s]", rel)
+			rplib.Shellexec("mcopy", "-o", "-i", target, p, name)
+		}
+		return nil
+	})
+	rplib.Checkerr(err)
+}
+
+// runRefresh implements "ubuntu-recovery-image refresh [flags] <image>".
+func runRefresh(args []string) int {
+	fs := newCommandFlags("refresh")
+	var opts refreshOptions
+	fs.StringVar(&opts.Kernel, "kernel", "", "Kernel snap file replacing kernel.snap; initrd.img is rebuilt from it")
+	fs.StringVar(&opts.Gadget, "gadget", "", "Gadget snap file replacing gadget.snap")
+	fs.StringVar(&opts.Os, "os", "", "Core snap file replacing os.snap")
+	fs.BoolVar(&opts.Initrd, "initrd", false, "Rebuild initrd.img from kernel.snap and initrd_local-includes")
+	fs.BoolVar(&opts.Includes, "includes", false, "Copy local-includes and rebuild the writable_local-includes squashfs")
+	fs.BoolVar(&opts.Env, "env", false, "Create the grubenv or uEnv.txt again from the config")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	if opts.Kernel == "" && opts.Gadget == "" && opts.Os == "" && !opts.Initrd && !opts.Includes && !opts.Env {
+		return fail(exitUsage, "nothing to refresh, pass -kernel, -gadget, -os, -initrd, -includes or -env")
+	}
+	image := fs.Arg(0)
+	if strings.HasSuffix(image, ".xz") {
+		return fail(exitUsage, "%s: refresh changes the image in place, decompress it first", image)
+	}
+
+	report, err := inspectImage(image)
+	if err != nil {
+		return fail(exitFailed, "%v", imageError(image, err))
+	}
+	if report.Recovery == nil {
+		return fail(exitFailed, "%s: no recovery partition found", image)
+	}
+
+	// the image is refreshed with the variant it was built from
+	if s := report.Recovery.BuildStamp; variant == "" && s != nil {
+		variant = s.Variant
+	}
+	stamp := newBuildStamp()
+	if err := loadConfig(); err != nil {
+		return fail(exitUsage, "%v", err)
+	}
+	defer removeEffectiveConfig()
+	if err := checkSchemaVersion(); err != nil {
+		return fail(exitUsage, "%v", err)
+	}
+	if err := lookTools(opts.tools(bootloaderOf(report.Recovery))); err != nil {
+		return fail(exitHost, "%v", err)
+	}
+
+	// mtools checks the geometry of whole disks, not of partitions
+	os.Setenv("MTOOLS_SKIP_CHECK", "1")
+	err = catchPanic(func() {
+		refreshImage(image, report, opts, stamp)
+	})
+	if err != nil {
+		return fail(panicExitCode(err), "refresh failed: %v", err)
+	}
+	log.Printf("refreshed %s: %s", image, strings.Join(opts.replaced(bootloaderOf(report.Recovery)), ", "))
+
+	return exitOK
+}
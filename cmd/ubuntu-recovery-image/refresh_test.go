@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/disk"
+	"github.com/Lyoncore/ubuntu-recovery-image/gadget"
+	utils "github.com/Lyoncore/ubuntu-recovery-image/utils"
+)
+
+// renderLayout renders a template of the layout as an include of the
+// config repo in dir, with the layout l.
+func renderLayout(t *testing.T, dir string, l imageLayout) string {
+	layout = l
+	out, err := ioutil.TempDir(dir, "render")
+	if err != nil {
+		t.Fatal(err)
+	}
+	includes := renderIncludes(out, utils.BuildStamp{}, stampSnaps(nil))
+	b, err := ioutil.ReadFile(filepath.Join(includes.Local, "layout.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+// TestRefreshLayout checks that refresh renders the templates with the
+// layout the build of the image rendered them with.
+func TestRefreshLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refresh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { configDir, layout = d, imageLayout{} }(configDir)
+	configDir = dir
+	for _, d := range []string{"local-includes", "initrd_local-includes", "writable_local-includes"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmpl := "{{.Layout.Bootloader}} {{.Layout.Schema}} {{.Layout.RecoveryNR}}\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "local-includes", "layout.txt.tmpl"), []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		build  imageLayout
+		table  *disk.Table
+		report *recoveryReport
+		want   string
+	}{
+		{
+			imageLayout{Bootloader: gadget.BootloaderGrub, Schema: gadget.SchemaGPT, RecoveryNR: 1, GadgetYaml: "pc.snap (volume pc)"},
+			&disk.Table{Schema: gadget.SchemaGPT},
+			&recoveryReport{Partition: 1, EnvFile: grubEnvFile},
+			"grub gpt 1\n",
+		},
+		{
+			imageLayout{Bootloader: gadget.BootloaderUBoot, Schema: gadget.SchemaMBR, RecoveryNR: 3},
+			&disk.Table{Schema: gadget.SchemaMBR},
+			&recoveryReport{Partition: 3, EnvFile: uEnvFile},
+			"u-boot mbr 3\n",
+		},
+	} {
+		built := renderLayout(t, dir, c.build)
+		refreshed := renderLayout(t, dir, refreshLayout(c.table, c.report))
+		if built != c.want || refreshed != built {
+			t.Errorf("build rendered %q, refresh %q, want %q", built, refreshed, c.want)
+		}
+	}
+}
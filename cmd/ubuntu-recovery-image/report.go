@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	configdirs "github.com/Lyoncore/ubuntu-recovery-rplib/dirs/configdir"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/seed"
+)
+
+// Outcomes of a build report, one per exit code.
+var buildOutcomes = map[int]string{
+	exitOK:     "ok",
+	exitFailed: "build-failed",
+	exitUsage:  "config-error",
+	exitHost:   "host-error",
+}
+
+// buildReport is the JSON report of a build, for CI.
+type buildReport struct {
+	Image    string `json:",omitempty"`
+	Variant  string `json:",omitempty"`
+	Started  time.Time
+	Duration float64
+	Outcome  string
+	ExitCode int
+	Error    string `json:",omitempty"`
+
+	Inputs    reportInputs
+	Snaps     []reportSnap `json:",omitempty"`
+	Layout    *imageLayout `json:",omitempty"`
+	Stages    []reportStage
+	Artifacts []reportFile
+	Warnings  []string
+
+	// artifacts are the files and directories written, hashed once the
+	// build is done.
+	artifacts []string
+	lastError string
+}
+
+type reportInputs struct {
+	BaseImage *reportFile  `json:",omitempty"`
+	Config    []reportFile `json:",omitempty"`
+	// EffectiveConfig is the merged config the build used.
+	EffectiveConfig *reportFile  `json:",omitempty"`
+	Includes        []reportTree `json:",omitempty"`
+}
+
+type reportFile struct {
+	Path   string
+	Size   int64
+	SHA256 string
+}
+
+// reportTree is an include directory. SHA256 covers the path, mode and
+// content of every file below it.
+type reportTree struct {
+	Path   string
+	Files  int
+	SHA256 string
+}
+
+type reportSnap struct {
+	Type     string
+	Name     string
+	Version  string
+	Revision string
+	File     string
+	SHA256   string
+	// Local is the local snap file replacing the seed snap, if any.
+	Local string `json:",omitempty"`
+}
+
+type reportStage struct {
+	Name     string
+	Started  time.Time
+	Duration float64
+	Outcome  string
+	Error    string `json:",omitempty"`
+}
+
+// currentBuild is the report of the build running, nil for the other
+// commands.
+var currentBuild *buildReport
+
+func newBuildReport() *buildReport {
+	currentBuild = &buildReport{
+		Variant:   variant,
+		Started:   time.Now().UTC(),
+		Stages:    []reportStage{},
+		Artifacts: []reportFile{},
+		Warnings:  []string{},
+	}
+
+	return currentBuild
+}
+
+// warnf logs a warning, and adds it to the report of the build running.
+func warnf(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	log.Printf("Warning: %s", msg)
+	if currentBuild != nil {
+		currentBuild.Warnings = append(currentBuild.Warnings, msg)
+	}
+}
+
+// stage runs f as the stage name of the build and records its duration
+// and outcome. f returns an exit code; the panics of rplib.Checkerr and
+// the like are build failures, or host errors when they are hostErrors.
+func (r *buildReport) stage(name string, f func() int) (code int) {
+	s := reportStage{Name: name, Started: time.Now().UTC()}
+	r.lastError = ""
+	if err := catchPanic(func() { code = f() }); err != nil {
+		code = fail(panicExitCode(err), "%s failed: %v", name, err)
+	}
+	s.Duration = time.Since(s.Started).Seconds()
+	s.Outcome = buildOutcomes[code]
+	s.Error = r.lastError
+	r.Stages = append(r.Stages, s)
+
+	return code
+}
+
+// panicExitCode tells the failures of the host, missing tools or
+// privileges, from the failures of the build.
+func panicExitCode(err error) int {
+	if _, ok := err.(*hostError); ok {
+		return exitHost
+	}
+
+	return exitFailed
+}
+
+// addArtifact records a file or directory written by a stage which
+// succeeded. One gone when the build is done, as an image compressed
+// since, is left out.
+func (r *buildReport) addArtifact(path string) {
+	r.artifacts = append(r.artifacts, path)
+}
+
+// setSnaps records the snaps the build resolved.
+func (r *buildReport) setSnaps(snaps seedSnaps) {
+	local := map[string]string{}
+	for _, l := range snaps.Local {
+		local[l.Snap.Type] = l.Snap.Path
+	}
+	for _, sn := range []*seed.Snap{snaps.Kernel, snaps.Gadget, snaps.Core} {
+		s := reportSnap{Type: sn.Type, Name: sn.Name, Version: sn.Version, Revision: sn.Revision, File: sn.File, Local: local[sn.Type]}
+		if f, err := hashFile(sn.Path); err == nil {
+			s.SHA256 = f.SHA256
+		}
+		r.Snaps = append(r.Snaps, s)
+	}
+}
+
+// hashInputs records the base image, the config files and the include
+// directories of the build.
+func (r *buildReport) hashInputs() error {
+	var err error
+	if r.Inputs.BaseImage, err = hashFile(configs.Configs.BaseImage); err != nil {
+		return err
+	}
+	for _, file := range configFilePaths() {
+		f, err := hashFile(file)
+		if err != nil {
+			return err
+		}
+		r.Inputs.Config = append(r.Inputs.Config, *f)
+	}
+	if r.Inputs.EffectiveConfig, err = hashFile(effectiveConfig); err != nil {
+		return err
+	}
+
+	dirs := []string{configPath("local-includes"), configPath("initrd_local-includes"), configPath(configdirs.WritableLocalIncludeDir)}
+	dirs = append(dirs, options.Includes.Local...)
+	dirs = append(dirs, options.Includes.Initrd...)
+	dirs = append(dirs, options.Includes.Writable...)
+	for _, dir := range dirs {
+		t, err := hashTree(dir)
+		if err != nil {
+			return err
+		}
+		r.Inputs.Includes = append(r.Inputs.Includes, *t)
+	}
+
+	return nil
+}
+
+// finish sets the outcome of the build and hashes its artifacts.
+func (r *buildReport) finish(code int) {
+	r.ExitCode = code
+	r.Outcome = buildOutcomes[code]
+	for _, s := range r.Stages {
+		if s.Error != "" {
+			r.Error = s.Error
+		}
+	}
+
+	for _, path := range r.artifacts {
+		err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			f, err := hashFile(p)
+			if err != nil {
+				return err
+			}
+			r.Artifacts = append(r.Artifacts, *f)
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			warnf("cannot hash %s: %v", path, err)
+		}
+	}
+	r.Duration = time.Since(r.Started).Seconds()
+}
+
+// write writes the report to file as JSON.
+func (r *buildReport) write(file string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, append(b, '\n'), 0644)
+}
+
+func hashFile(path string) (*reportFile, error) {
+	sum, size, err := fileSHA256(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reportFile{Path: path, Size: size, SHA256: sum}, nil
+}
+
+// hashTree hashes the files below dir, in path order.
+func hashTree(dir string) (*reportTree, error) {
+	var lines []string
+	files := 0
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		content := ""
+		if !info.IsDir() {
+			files++
+		}
+		switch {
+		case info.Mode().IsRegular():
+			if content, _, err = fileSHA256(p); err != nil {
+				return err
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			if content, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %s\n", rel, info.Mode(), content))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(lines)
+	h := sha256.New()
+	for _, l := range lines {
+		h.Write([]byte(l))
+	}
+
+	return &reportTree{Path: dir, Files: files, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// reportFileName returns the report file of the build: -report, or
+// <image>.report.json, or build-report.json when the build stopped before
+// naming the image.
+func reportFileName(report string, image string) string {
+	switch {
+	case report != "":
+		return report
+	case image != "":
+		return strings.TrimSuffix(image, ".img") + ".report.json"
+	}
+
+	return "build-report.json"
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/serial"
+)
+
+// runSerial implements "ubuntu-recovery-image serial sign|mock
+// [config.yaml]". Without a config file it prints an example.
+func runSerial(args []string) int {
+	fs := newCommandFlags("serial")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() == 0 || fs.NArg() > 2 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	var example interface{}
+	switch fs.Arg(0) {
+	case "sign":
+		example = serial.ExampleSignConfig
+	case "mock":
+		example = serial.ExampleMockConfig
+	default:
+		return fail(exitUsage, "unknown serial command %q, expected sign or mock", fs.Arg(0))
+	}
+
+	if fs.NArg() == 1 {
+		out, err := yaml.Marshal(example)
+		if err != nil {
+			return fail(exitFailed, "%v", err)
+		}
+		fmt.Fprintf(os.Stderr, "You need to provide a config file, for example:\n%s", out)
+		return exitUsage
+	}
+
+	fmt.Println("You could feed entropy using rngd when testing. e.g.:")
+	fmt.Println("rngd -r /dev/urandom")
+
+	file := fs.Arg(1)
+	var err error
+	switch fs.Arg(0) {
+	case "sign":
+		var c serial.SignConfig
+		if c, err = serial.LoadSignConfig(file); err != nil {
+			return fail(exitUsage, "%v", err)
+		}
+		err = serial.Sign(c)
+	case "mock":
+		var c serial.MockConfig
+		if c, err = serial.LoadMockConfig(file); err != nil {
+			return fail(exitUsage, "%v", err)
+		}
+		err = serial.Mock(c)
+	}
+	if err != nil {
+		return fail(exitFailed, "%v", err)
+	}
+
+	return exitOK
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery-rplib"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/seed"
+)
+
+const seedDir = "image/writable/system-data/var/lib/snapd/seed"
+
+// seedSnaps are the snaps of the base image seed that end up in the
+// recovery partition.
+type seedSnaps struct {
+	Seed   *seed.Seed
+	Kernel *seed.Snap
+	Gadget *seed.Snap
+	Core   *seed.Snap
+	// Local lists the seed snaps replaced by local snap files.
+	Local []localSnap
+}
+
+// resolveSeedSnaps picks the kernel, gadget and core snaps of the seed of
+// the mounted base image.
+func resolveSeedSnaps(tmpDir string) seedSnaps {
+	log.Printf("[resolve seed snaps]")
+
+	s, err := seed.Open(filepath.Join(tmpDir, seedDir))
+	rplib.Checkerr(err)
+	snaps, err := resolveSnaps(s)
+	rplib.Checkerr(err)
+
+	log.Println("kernel snap:", snaps.Kernel)
+	log.Println("gadget snap:", snaps.Gadget)
+	log.Println("core snap:", snaps.Core)
+
+	return snaps
+}
+
+// resolveSnaps picks the kernel, gadget and core snaps of s by snap type.
+// configs.Snaps narrows the choice and both are cross-checked against the
+// model assertion of the seed.
+func resolveSnaps(s *seed.Seed) (seedSnaps, error) {
+	snaps := seedSnaps{Seed: s}
+	var err error
+	if snaps.Kernel, err = s.Resolve(seed.TypeKernel, configs.Snaps.Kernel); err != nil {
+		return snaps, err
+	}
+	if snaps.Gadget, err = s.Resolve(seed.TypeGadget, configs.Snaps.Gadget); err != nil {
+		return snaps, err
+	}
+	if snaps.Core, err = s.Resolve(seed.TypeOS, configs.Snaps.Os); err != nil {
+		return snaps, err
+	}
+
+	model := s.Model()
+	if model == nil {
+		log.Printf("no model assertion in seed, skip model cross-check")
+		return snaps, nil
+	}
+	if err := checkModelSnap("kernel", model.Kernel(), snaps.Kernel); err != nil {
+		return snaps, err
+	}
+	if err := checkModelSnap("gadget", model.Gadget(), snaps.Gadget); err != nil {
+		return snaps, err
+	}
+
+	return snaps, checkModelSnap("core", model.Core(), snaps.Core)
+}
+
+// verifySeedSnaps checks every seed snap against the seed assertions
+// before anything is packaged.
+func verifySeedSnaps(snaps seedSnaps) {
+	log.Printf("[verify seed snaps against assertions]")
+	if options.Snaps.AllowUnasserted {
+		warnf("unasserted snaps are allowed by config")
+	}
+
+	err := snaps.Seed.Verify(options.Snaps.AllowUnasserted)
+	rplib.Checkerr(err)
+}
+
+func checkModelSnap(what, expected string, sn *seed.Snap) error {
+	if expected == "" || expected == sn.Name {
+		return nil
+	}
+
+	return fmt.Errorf("model assertion requires %s snap %q but the seed resolves to %s", what, expected, sn)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery-rplib"
+	configdirs "github.com/Lyoncore/ubuntu-recovery-rplib/dirs/configdir"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/seed"
+	utils "github.com/Lyoncore/ubuntu-recovery-image/utils"
+)
+
+// templateData is what .tmpl files of the include directories see.
+type templateData struct {
+	Config     rplib.ConfigRecovery
+	BuildStamp utils.BuildStamp
+	Snaps      templateSnaps
+	Layout     imageLayout
+}
+
+// templateSnaps are the resolved snaps, with Name, Version, Revision and
+// File, as in {{.Snaps.Kernel.Revision}}.
+type templateSnaps struct {
+	Kernel *seed.Snap
+	Gadget *seed.Snap
+	Core   *seed.Snap
+}
+
+// includeDirs are the rendered copies of the include directories.
+type includeDirs struct {
+	Local    string
+	Initrd   string
+	Writable string
+}
+
+// renderIncludes copies local-includes, initrd_local-includes and
+// writable_local-includes to tmpDir, rendering their .tmpl files.
+func renderIncludes(tmpDir string, buildstamp utils.BuildStamp, snaps seedSnaps) includeDirs {
+	log.Printf("[render include templates]")
+
+	data := templateData{
+		Config:     configs,
+		BuildStamp: buildstamp,
+		Snaps: templateSnaps{
+			Kernel: snaps.Kernel,
+			Gadget: snaps.Gadget,
+			Core:   snaps.Core,
+		},
+		Layout: layout,
+	}
+
+	renderDir := filepath.Join(tmpDir, "misc/includes")
+	dirs := includeDirs{
+		Local:    filepath.Join(renderDir, "local-includes"),
+		Initrd:   filepath.Join(renderDir, "initrd_local-includes"),
+		Writable: filepath.Join(renderDir, "writable_local-includes"),
+	}
+
+	for _, tree := range []struct {
+		dst  string
+		srcs []string
+	}{
+		{dirs.Local, append([]string{configPath("local-includes")}, options.Includes.Local...)},
+		{dirs.Initrd, append([]string{configPath("initrd_local-includes")}, options.Includes.Initrd...)},
+		{dirs.Writable, append([]string{configPath(configdirs.WritableLocalIncludeDir)}, options.Includes.Writable...)},
+	} {
+		// the includes: directories of config.yaml overwrite the defaults
+		for _, src := range tree.srcs {
+			err := utils.RenderTree(src, tree.dst, data)
+			rplib.Checkerr(err)
+		}
+	}
+
+	return dirs
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/cpio"
+)
+
+// treeFile is a file of an archive, with a digest of its content.
+type treeFile struct {
+	Size int64
+	Mode os.FileMode
+	Link string
+	Sum  [sha256.Size]byte
+}
+
+// fileTree maps the cleaned paths of an archive to its files.
+type fileTree map[string]treeFile
+
+func cleanTreePath(name string) string {
+	return path.Clean("/" + strings.TrimPrefix(name, "./"))
+}
+
+func (t fileTree) add(name string, f treeFile, content io.Reader) error {
+	if f.Mode.IsRegular() {
+		h := sha256.New()
+		if _, err := io.Copy(h, content); err != nil {
+			return err
+		}
+		copy(f.Sum[:], h.Sum(nil))
+	}
+	if p := cleanTreePath(name); p != "/" {
+		t[p] = f
+	}
+
+	return nil
+}
+
+// decompress returns a reader for the gzip or xz stream of r, or r itself
+// when it is not compressed.
+func decompress(r *bufio.Reader) (io.Reader, error) {
+	magic, _ := r.Peek(6)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(r)
+	case bytes.Equal(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0}):
+		return xz.NewReader(r)
+	}
+
+	return r, nil
+}
+
+// tarTree lists the tar archive read from r, compressed or not.
+func tarTree(r io.Reader) (fileTree, error) {
+	dr, err := decompress(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+
+	t := fileTree{}
+	tr := tar.NewReader(dr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return t, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		f := treeFile{Size: h.Size, Mode: h.FileInfo().Mode(), Link: h.Linkname}
+		if h.Typeflag == tar.TypeLink {
+			// hard links share the content of their target
+			f.Mode = os.FileMode(h.Mode) & os.ModePerm
+			f.Size = 0
+		}
+		if err := t.add(h.Name, f, tr); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// initrdTree lists the files of an initrd.
+func initrdTree(r io.Reader) (fileTree, error) {
+	t := fileTree{}
+	err := walkInitrd(r, func(h *cpio.Header, content io.Reader) error {
+		f := treeFile{Size: h.Size, Mode: h.FileMode(), Link: h.Linkname}
+		return t.add(h.Name, f, content)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// walkInitrd calls fn for the entries of an initrd: uncompressed cpio
+// archives, such as early microcode, possibly followed by a compressed one.
+func walkInitrd(r io.Reader, fn func(h *cpio.Header, content io.Reader) error) error {
+	br := bufio.NewReader(r)
+	for {
+		// archives are padded with zeros to 512 bytes blocks
+		for {
+			b, err := br.Peek(1)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if b[0] != 0 {
+				break
+			}
+			br.ReadByte()
+		}
+
+		magic, _ := br.Peek(6)
+		if bytes.HasPrefix(magic, []byte("0707")) {
+			if err := walkCpio(br, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		dr, err := decompress(br)
+		if err != nil {
+			return err
+		}
+		if dr == io.Reader(br) {
+			return fmt.Errorf("unknown initrd compression %x", magic)
+		}
+		return walkCpio(bufio.NewReader(dr), fn)
+	}
+}
+
+func walkCpio(r io.Reader, fn func(h *cpio.Header, content io.Reader) error) error {
+	cr := cpio.NewReader(r)
+	for {
+		h, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(h, cr); err != nil {
+			return err
+		}
+	}
+}
+
+// treeChange is a file added, removed or modified between two trees.
+type treeChange struct {
+	Path     string
+	Old, New *treeFile
+}
+
+// diffTrees returns the changes from a to b, sorted by path.
+func diffTrees(a, b fileTree) []treeChange {
+	var changes []treeChange
+	for p, fa := range a {
+		fa := fa
+		fb, ok := b[p]
+		switch {
+		case !ok:
+			changes = append(changes, treeChange{Path: p, Old: &fa})
+		case fa != fb:
+			fb := fb
+			changes = append(changes, treeChange{Path: p, Old: &fa, New: &fb})
+		}
+	}
+	for p, fb := range b {
+		fb := fb
+		if _, ok := a[p]; !ok {
+			changes = append(changes, treeChange{Path: p, New: &fb})
+		}
+	}
+	sort.Sort(byPath(changes))
+
+	return changes
+}
+
+type byPath []treeChange
+
+func (c byPath) Len() int           { return len(c) }
+func (c byPath) Less(i, j int) bool { return c[i].Path < c[j].Path }
+func (c byPath) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
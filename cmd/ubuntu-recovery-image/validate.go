@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery-rplib"
+	configdirs "github.com/Lyoncore/ubuntu-recovery-rplib/dirs/configdir"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/config"
+	"github.com/Lyoncore/ubuntu-recovery-image/seed"
+)
+
+var (
+	bootloaders    = []string{"grub", "u-boot"}
+	partitionTypes = []string{"gpt", "mbr"}
+	imageTypes     = []string{rplib.HEADLESS_INSTALLER}
+	recoveryTypes  = []string{"factory_install", "field_transition", rplib.HEADLESS_INSTALLER}
+	targetOrders   = []string{"first", "smallest", "largest"}
+	finishActions  = []string{"reboot", "poweroff", "halt"}
+)
+
+// fatLabelMaxLen is the size of the volume label field of FAT file systems.
+const fatLabelMaxLen = 11
+
+// validateConfig checks the merged config without building anything and
+// returns every problem found, each located in the file it comes from.
+func validateConfig() ([]config.Problem, error) {
+	doc, err := mergeConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	problems := doc.CheckTypes(rplib.ConfigRecovery{}, config.Options{})
+	if len(problems) > 0 {
+		// the values cannot be loaded as long as their types are wrong
+		return problems, nil
+	}
+
+	dir, err := ioutil.TempDir(workDir, "")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if _, err := writeEffectiveConfig(doc, dir); err != nil {
+		return nil, err
+	}
+
+	if err := config.CheckSchemaVersion(options.SchemaVersion); err != nil {
+		problems = append(problems, doc.Problemf("schemaversion", "%v", err))
+	} else if options.SchemaVersion < config.SchemaVersion {
+		problems = append(problems, doc.Problemf("schemaversion", "version %d is outdated, run migrate-config", options.SchemaVersion))
+	}
+
+	checkEnum := func(key, value string, allowed []string) {
+		if value == "" {
+			return
+		}
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		problems = append(problems, doc.Problemf(key, "unknown value %q, expected one of %s", value, strings.Join(allowed, ", ")))
+	}
+	checkEnum("configs.bootloader", configs.Configs.Bootloader, bootloaders)
+	checkEnum("configs.partitiontype", configs.Configs.PartitionType, partitionTypes)
+	checkEnum("recovery.imagetype", configs.Recovery.ImageType, imageTypes)
+	checkEnum("recovery.type", configs.Recovery.Type, recoveryTypes)
+	checkEnum("installer.target.order", options.Installer.Target.Order, targetOrders)
+	checkEnum("installer.finish", options.Installer.Finish, finishActions)
+	if t := options.Installer.Target; t.MinSize < 0 || t.MaxSize < 0 || t.MaxSize > 0 && t.MaxSize < t.MinSize {
+		problems = append(problems, doc.Problemf("installer.target", "sizes must be positive, with maxsize 0 or at least minsize"))
+	}
+	if tmpl, err := parseOutputName(options.Output.Name); err != nil {
+		problems = append(problems, doc.Problemf("output.name", "%v", err))
+	} else if err := tmpl.Execute(ioutil.Discard, outputNameData{}); err != nil {
+		problems = append(problems, doc.Problemf("output.name", "%v", err))
+	}
+	if options.Netboot.Enable {
+		if u, err := url.Parse(options.Netboot.URL); err != nil || u.Scheme != "http" && u.Scheme != "tftp" || u.Host == "" {
+			problems = append(problems, doc.Problemf("netboot.url", "%q is not an http:// or tftp:// URL; the initrd fetches the recovery partition from it", options.Netboot.URL))
+		}
+	}
+
+	if size, err := strconv.Atoi(configs.Configs.RecoverySize); err != nil || size <= 0 {
+		problems = append(problems, doc.Problemf("configs.recoverysize", "%q is not a size in megabytes", configs.Configs.RecoverySize))
+	}
+
+	checkLabel := func(key, label string, required bool) {
+		if label == "" {
+			if required {
+				problems = append(problems, doc.Problemf(key, "a file system label is required"))
+			}
+			return
+		}
+		if msg := fatLabelProblem(label); msg != "" {
+			problems = append(problems, doc.Problemf(key, "%q %s", label, msg))
+		}
+	}
+	checkLabel("recovery.fslabel", configs.Recovery.FsLabel, true)
+	checkLabel("recovery.installerfslabel", configs.Recovery.InstallerFsLabel, configs.Recovery.ImageType == rplib.HEADLESS_INSTALLER)
+
+	checkFile := func(key, path string) {
+		if path == "" {
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			problems = append(problems, doc.Problemf(key, "%v", err))
+		}
+	}
+	checkFile("recovery.systembootimage", configs.Recovery.SystembootImage)
+	checkFile("recovery.writableimage", configs.Recovery.WritableImage)
+	if (configs.Recovery.SystembootImage == "") != (configs.Recovery.WritableImage == "") {
+		problems = append(problems, doc.Problemf("recovery", "systembootimage and writableimage are only used together"))
+	}
+	checkFile("snaps.local.kernel", options.Snaps.Local.Kernel)
+	checkFile("snaps.local.gadget", options.Snaps.Local.Gadget)
+	checkFile("snaps.local.os", options.Snaps.Local.Os)
+	for i, extra := range options.Snaps.Extra {
+		checkFile(fmt.Sprintf("snaps.extra[%d].file", i), extra.File)
+	}
+
+	// the include directories of the config repo have no key, they are
+	// reported at includes, or at the top of the file without one
+	for _, dir := range []string{"local-includes", "initrd_local-includes", configdirs.WritableLocalIncludeDir} {
+		if st, err := os.Stat(configPath(dir)); err != nil || !st.IsDir() {
+			problems = append(problems, doc.Problemf("includes", "include directory %s is missing", dir))
+		}
+	}
+	includes := []struct {
+		key  string
+		dirs []string
+	}{
+		{"includes.local", options.Includes.Local},
+		{"includes.initrd", options.Includes.Initrd},
+		{"includes.writable", options.Includes.Writable},
+	}
+	for _, inc := range includes {
+		for i, dir := range inc.dirs {
+			if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+				problems = append(problems, doc.Problemf(fmt.Sprintf("%s[%d]", inc.key, i), "include directory %s is missing", dir))
+			}
+		}
+	}
+
+	if configs.Configs.BaseImage == "" {
+		problems = append(problems, doc.Problemf("configs.baseimage", "a base image is required"))
+		return problems, nil
+	}
+	if _, err := os.Stat(configs.Configs.BaseImage); err != nil {
+		problems = append(problems, doc.Problemf("configs.baseimage", "%v", err))
+		return problems, nil
+	}
+
+	return append(problems, validateSeedSnaps(doc)...), nil
+}
+
+// validateSeedSnaps checks that the snaps named in config.yaml are in the
+// seed of the base image.
+func validateSeedSnaps(doc *config.Document) []config.Problem {
+	fail := func(key string, err error) []config.Problem {
+		return []config.Problem{doc.Problemf(key, "%v", err)}
+	}
+
+	writable, err := baseWritable()
+	if err != nil {
+		return fail("configs.baseimage", err)
+	}
+	dir, err := ioutil.TempDir(workDir, "")
+	if err != nil {
+		return fail("configs.baseimage", err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := readBaseSeed(writable, dir)
+	if err != nil {
+		return fail("configs.baseimage", err)
+	}
+
+	var problems []config.Problem
+	for _, c := range []struct{ key, typ, name string }{
+		{"snaps.kernel", seed.TypeKernel, configs.Snaps.Kernel},
+		{"snaps.gadget", seed.TypeGadget, configs.Snaps.Gadget},
+		{"snaps.os", seed.TypeOS, configs.Snaps.Os},
+	} {
+		if _, err := s.Resolve(c.typ, c.name); err != nil {
+			problems = append(problems, doc.Problemf(c.key, "%v", err))
+		}
+	}
+	for i, extra := range options.Snaps.Extra {
+		if extra.Name != "" && len(s.ByName(extra.Name)) == 0 {
+			problems = append(problems, doc.Problemf(fmt.Sprintf("snaps.extra[%d].name", i), "no snap %q in the base image seed", extra.Name))
+		}
+	}
+
+	return problems
+}
+
+// fatLabelProblem tells what is wrong with a FAT volume label, or "".
+func fatLabelProblem(label string) string {
+	if len(label) > fatLabelMaxLen {
+		return fmt.Sprintf("is longer than %d characters", fatLabelMaxLen)
+	}
+	for _, c := range label {
+		if c < 0x20 || c > 0x7e || strings.ContainsRune(`"*+,./:;<=>?[\]|`, c) {
+			return fmt.Sprintf("contains %q, which FAT labels cannot hold", c)
+		}
+	}
+
+	return ""
+}
+
+// runValidate implements "ubuntu-recovery-image validate [config.yaml...]".
+func runValidate(args []string) int {
+	fs := newCommandFlags("validate")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	configFiles = append(configFiles, fs.Args()...)
+
+	problems, err := validateConfig()
+	if err != nil {
+		return fail(exitUsage, "%v", err)
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s)\n", len(problems))
+		return exitUsage
+	}
+
+	fmt.Println("ok")
+	return exitOK
+}
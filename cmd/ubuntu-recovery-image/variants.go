@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery-rplib"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/config"
+)
+
+// variantBuild is the build of one variant by build -all-variants.
+type variantBuild struct {
+	Name    string
+	Image   string
+	Xz      bool
+	Log     string
+	WorkDir string
+	Code    int
+	Err     error
+	Time    time.Duration
+}
+
+// planVariantBuilds returns the builds of the variants of config.yaml,
+// with work dirs in baseDir, checking that every variant merges and that
+// no two variants write the same image, installer image or netboot dir.
+func planVariantBuilds(baseDir string) ([]*variantBuild, error) {
+	names, err := config.Variants(configFilePaths())
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no variants in %s", strings.Join(configFilePaths(), "+"))
+	}
+
+	var builds []*variantBuild
+	// the variant and config key writing each output path
+	outputs := map[string]string{}
+	claim := func(name, key, path string) error {
+		path = filepath.Clean(path)
+		if prev, ok := outputs[path]; ok {
+			return fmt.Errorf("%s.%s: %s %s is also the %s", config.VariantsKey, name, key, path, prev)
+		}
+		outputs[path] = fmt.Sprintf("%s of variant %s", key, name)
+		return nil
+	}
+	for _, name := range names {
+		doc, err := config.Merge(configFilePaths(), name, configSets)
+		if err != nil {
+			return nil, err
+		}
+		// the names are taken here, so that the build numbers follow the
+		// order of the variants
+		image, err := outputName(doc.Value("output.name"), doc.Value("output.dir"), doc.Value("project"), name, true)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", config.VariantsKey, name, err)
+		}
+		if err := claim(name, "output.name", image); err != nil {
+			return nil, err
+		}
+		if doc.Value("recovery.imagetype") == rplib.HEADLESS_INSTALLER {
+			installer := doc.Value("installer.image")
+			if installer == "" {
+				installer = strings.TrimSuffix(image, ".img") + "-installer.img"
+			}
+			if err := claim(name, "installer.image", installer); err != nil {
+				return nil, err
+			}
+		}
+		if isTrue(doc.Value("netboot.enable")) {
+			netboot := doc.Value("netboot.dir")
+			if netboot == "" {
+				netboot = strings.TrimSuffix(image, ".img") + "-netboot"
+			}
+			if err := claim(name, "netboot.dir", netboot); err != nil {
+				return nil, err
+			}
+		}
+		builds = append(builds, &variantBuild{
+			Name:    name,
+			Image:   image,
+			Xz:      isTrue(doc.Value("debug.xz")),
+			Log:     strings.TrimSuffix(image, ".img") + ".log",
+			WorkDir: filepath.Join(baseDir, name),
+		})
+	}
+
+	return builds, nil
+}
+
+func isTrue(s string) bool {
+	switch strings.ToLower(s) {
+	case "true", "yes", "on":
+		return true
+	}
+
+	return false
+}
+
+// variantArgs returns the command line building v in a child process,
+// with the global flags of this one.
+func variantArgs(v *variantBuild) []string {
+	args := []string{"-config-dir", configDir, "-work-dir", v.WorkDir, "-variant", v.Name, "-log-format", logFormat}
+	for _, c := range configFiles {
+		args = append(args, "-c", c)
+	}
+	for _, set := range configSets {
+		args = append(args, "-set", set)
+	}
+	if verbose {
+		args = append(args, "-v")
+	}
+
+	return append(args, "build", "-o", v.Image)
+}
+
+// runVariantBuild builds v in a child process logging to v.Log. The build
+// state is global to a process, so every variant gets its own.
+func runVariantBuild(v *variantBuild) {
+	start := time.Now()
+	defer func() {
+		v.Time = time.Since(start)
+	}()
+
+	out, err := os.Create(v.Log)
+	if err != nil {
+		v.Code, v.Err = exitFailed, err
+		return
+	}
+	defer out.Close()
+
+	cmd := exec.Command("/proc/self/exe", variantArgs(v)...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Exited() {
+			v.Code = status.ExitStatus()
+			return
+		}
+	}
+	if err != nil {
+		v.Code, v.Err = exitFailed, err
+	}
+}
+
+// printVariantSummary writes the result of every variant build as a table.
+func printVariantSummary(builds []*variantBuild) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "variant\tresult\ttime\timage\tlog")
+	for _, v := range builds {
+		result := "ok"
+		switch {
+		case v.Err != nil:
+			result = fmt.Sprintf("failed: %v", v.Err)
+		case v.Code != exitOK:
+			result = fmt.Sprintf("failed (exit %d)", v.Code)
+		}
+		image := v.Image
+		switch {
+		case v.Code != exitOK || v.Err != nil:
+			image = "-"
+		case v.Xz:
+			image += ".xz"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", v.Name, result, v.Time/time.Second*time.Second, image, v.Log)
+	}
+	tw.Flush()
+}
+
+// buildAllVariants builds every variant of config.yaml, jobs at a time or
+// all at once if jobs is 0, each in its own work dir, and prints a
+// summary.
+func buildAllVariants(jobs int) int {
+	baseDir := workDir
+	if baseDir == "" {
+		var err error
+		if baseDir, err = ioutil.TempDir("", "variants"); err != nil {
+			return fail(exitHost, "%v", err)
+		}
+		defer os.RemoveAll(baseDir)
+	}
+
+	builds, err := planVariantBuilds(baseDir)
+	if err != nil {
+		return fail(exitUsage, "%v", err)
+	}
+	if jobs <= 0 || jobs > len(builds) {
+		jobs = len(builds)
+	}
+
+	log.Printf("[build %d variants, %d at a time]", len(builds), jobs)
+	queue := make(chan *variantBuild)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for v := range queue {
+				log.Printf("[build variant %s, log %s]", v.Name, v.Log)
+				runVariantBuild(v)
+				log.Printf("[variant %s done, exit %d]", v.Name, v.Code)
+			}
+		}()
+	}
+	for _, v := range builds {
+		queue <- v
+	}
+	close(queue)
+	wg.Wait()
+
+	printVariantSummary(builds)
+
+	failed := 0
+	for _, v := range builds {
+		if v.Code != exitOK || v.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fail(exitFailed, "%d of %d variants failed", failed, len(builds))
+	}
+
+	return exitOK
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// runVerify implements "ubuntu-recovery-image verify": it checks the seed
+// snaps of the base image, with the local snaps of config.yaml applied,
+// against their assertions as the build does.
+func runVerify(args []string) int {
+	fs := newCommandFlags("verify")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+
+	code := loadBuildConfig()
+	defer removeEffectiveConfig()
+	if code != exitOK {
+		return code
+	}
+
+	writable, err := baseWritable()
+	if err != nil {
+		return fail(exitUsage, "%s: %v", configs.Configs.BaseImage, err)
+	}
+	dir, err := ioutil.TempDir(workDir, "")
+	if err != nil {
+		return fail(exitHost, "%v", err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := readBaseSeed(writable, dir)
+	if _, ok := err.(*hostError); ok {
+		return fail(exitHost, "%v", err)
+	}
+	if err != nil {
+		return fail(exitUsage, "%s: %v", configs.Configs.BaseImage, err)
+	}
+
+	snaps, err := resolveSnaps(s)
+	if err != nil {
+		return fail(exitFailed, "%v", err)
+	}
+	if err := catchPanic(func() { applyLocalSnaps(&snaps) }); err != nil {
+		return fail(exitFailed, "%v", err)
+	}
+	if err := s.Verify(options.Snaps.AllowUnasserted); err != nil {
+		return fail(exitFailed, "%v", err)
+	}
+
+	fmt.Printf("ok: kernel %s, gadget %s, core %s\n", snaps.Kernel, snaps.Gadget, snaps.Core)
+	return exitOK
+}
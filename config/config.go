@@ -0,0 +1,134 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package config holds the config.yaml settings that only matter to
+// ubuntu-recovery-image. They live in the same file as the sections of
+// rplib.ConfigRecovery, which ignores keys it does not know.
+package config
+
+import (
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// LocalSnaps name local snap files replacing the seed kernel, gadget or
+// core snap. A "<name>_<revision>.assert" file next to the snap, as
+// written by "snap download", provides its assertions.
+type LocalSnaps struct {
+	Kernel string
+	Gadget string
+	Os     string
+}
+
+// ExtraSnap is an additional snap bundled in recovery/snaps/: either the
+// seed snap called Name or the local snap File.
+type ExtraSnap struct {
+	Name string
+	File string
+}
+
+// Snaps extends the snaps: section.
+type Snaps struct {
+	// AllowUnasserted lets seed snaps without matching assertions into
+	// the recovery partition.
+	AllowUnasserted bool
+	Local           LocalSnaps
+	Extra           []ExtraSnap
+}
+
+// InstallerTarget picks the disk the installer writes the recovery image
+// to.
+type InstallerTarget struct {
+	// Device is the target disk, like /dev/mmcblk0. When it is empty,
+	// the rules below pick one of the disks of the device.
+	Device string
+	// Removable lets removable disks be picked; they are skipped by
+	// default.
+	Removable bool
+	// MinSize and MaxSize bound the size of the disk in gigabytes; 0 is
+	// no bound.
+	MinSize int
+	MaxSize int
+	// Order picks the first, the smallest or the largest disk left.
+	Order string
+}
+
+// Installer configures the installer image of a headless_installer build.
+type Installer struct {
+	// Image is the installer image file, <image>-installer.img by default.
+	Image  string
+	Target InstallerTarget
+	// Finish is what the installer does once done: reboot, poweroff or
+	// halt.
+	Finish string
+}
+
+// Netboot configures the netboot bundle a build writes next to the image.
+type Netboot struct {
+	// Enable writes the bundle.
+	Enable bool
+	// Dir is the bundle directory, <image>-netboot by default.
+	Dir string
+	// URL is the HTTP or TFTP directory the bundle is served from; the
+	// boot configs load the kernel, the initrd and the recovery partition
+	// from it.
+	URL string
+	// Cmdline is appended to the kernel command line.
+	Cmdline string
+}
+
+// Includes are include directories of the config repo copied over
+// local-includes, initrd_local-includes and writable_local-includes, in
+// order.
+type Includes struct {
+	Local    []string
+	Initrd   []string
+	Writable []string
+}
+
+// Output names the images of the builds.
+type Output struct {
+	// Name is a text/template of the image file name, see "Output names"
+	// in README.md.
+	Name string
+	// Dir is the directory of the images and of their build counter.
+	Dir string
+}
+
+// Options are the build options read from config.yaml.
+type Options struct {
+	// SchemaVersion is the layout of config.yaml, see SchemaVersion.
+	SchemaVersion int
+	Snaps         Snaps
+	Installer     Installer
+	Netboot       Netboot
+	Includes      Includes
+	Output        Output
+}
+
+// Load reads the build options from the config file.
+func (o *Options) Load(configFile string) error {
+	b, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	return yaml.Unmarshal(b, o)
+}
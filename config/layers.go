@@ -0,0 +1,324 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	yamlnode "gopkg.in/yaml.v3"
+)
+
+// SetSource is the source recorded for values given with Set.
+const SetSource = "--set"
+
+var envRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces ${VAR} and ${VAR:-default} in the scalar n.
+func (d *Document) expandEnv(n *yamlnode.Node) error {
+	if n.Kind != yamlnode.ScalarNode || !strings.Contains(n.Value, "${") {
+		return nil
+	}
+
+	var missing []string
+	value := envRe.ReplaceAllStringFunc(n.Value, func(ref string) string {
+		m := envRe.FindStringSubmatch(ref)
+		if v, ok := os.LookupEnv(m[1]); ok {
+			return v
+		}
+		if m[2] != "" {
+			return m[3]
+		}
+		missing = append(missing, m[1])
+		return ref
+	})
+	if len(missing) > 0 {
+		return fmt.Errorf("%s:%d:%d: environment variable %s is not set", d.source(n), n.Line, n.Column, strings.Join(missing, ", "))
+	}
+
+	n.Value = value
+	// let the expanded value decide whether it is a string, a number or
+	// a boolean
+	if n.Style == 0 {
+		n.Tag = ""
+	}
+
+	return nil
+}
+
+// VariantsKey is the section of config.yaml listing the variants of the
+// build, each one a mapping overriding the rest of the file.
+const VariantsKey = "variants"
+
+var variantNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Merge parses the config files in order, each one overriding the keys
+// set by the previous ones, then applies the section of variant, if not
+// empty, and the key=value overrides of sets last. Mappings are merged key
+// by key; lists and single values are replaced as a whole. The variants
+// section is dropped from the result.
+func Merge(files []string, variant string, sets []string) (*Document, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no config file")
+	}
+
+	d, err := ParseDocument(files[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files[1:] {
+		overlay, err := ParseDocument(file)
+		if err != nil {
+			return nil, err
+		}
+		for n, src := range overlay.sources {
+			d.sources[n] = src
+		}
+		if err := mergeNode(d.root, overlay.root); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	d.File = strings.Join(files, "+")
+
+	if err := d.selectVariant(variant); err != nil {
+		return nil, err
+	}
+
+	for _, set := range sets {
+		if err := d.Set(set); err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+// Variants returns the names of the variants of the config files, in
+// order.
+func Variants(files []string) ([]string, error) {
+	var names []string
+	seen := map[string]bool{}
+	for _, file := range files {
+		d, err := ParseDocument(file)
+		if err != nil {
+			return nil, err
+		}
+		i := mappingIndex(d.root, VariantsKey)
+		if i < 0 {
+			continue
+		}
+		variants := resolveAlias(d.root.Content[i+1])
+		if variants.Kind != yamlnode.MappingNode {
+			return nil, fmt.Errorf("%s:%d: %s is not a mapping", file, variants.Line, VariantsKey)
+		}
+		for j := 0; j+1 < len(variants.Content); j += 2 {
+			name := variants.Content[j].Value
+			if !variantNameRe.MatchString(name) {
+				return nil, fmt.Errorf("%s:%d: %q is not a variant name, use letters, digits, '.', '_' and '-'", file, variants.Content[j].Line, name)
+			}
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// selectVariant merges the section of variant into the document and drops
+// the variants section.
+func (d *Document) selectVariant(variant string) error {
+	i := mappingIndex(d.root, VariantsKey)
+	var variants *yamlnode.Node
+	if i >= 0 {
+		variants = resolveAlias(d.root.Content[i+1])
+		d.root.Content = append(d.root.Content[:i:i], d.root.Content[i+2:]...)
+	}
+	if variant == "" {
+		return nil
+	}
+
+	if variants == nil || variants.Kind != yamlnode.MappingNode {
+		return fmt.Errorf("%s: no %s section", d.File, VariantsKey)
+	}
+	j := mappingIndex(variants, variant)
+	if j < 0 {
+		return fmt.Errorf("%s: no variant %q in %s", d.File, variant, VariantsKey)
+	}
+	if err := mergeNode(d.root, resolveAlias(variants.Content[j+1])); err != nil {
+		return fmt.Errorf("%s.%s: %v", VariantsKey, variant, err)
+	}
+
+	return nil
+}
+
+func mergeNode(dst, src *yamlnode.Node) error {
+	if src.Kind == yamlnode.ScalarNode && src.ShortTag() == "!!null" {
+		return nil
+	}
+	if dst.Kind != yamlnode.MappingNode || src.Kind != yamlnode.MappingNode {
+		return fmt.Errorf("line %d: cannot merge into a mapping", src.Line)
+	}
+
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], resolveAlias(src.Content[i+1])
+		j := mappingIndex(dst, key.Value)
+		switch {
+		case j < 0:
+			dst.Content = append(dst.Content, key, value)
+		case dst.Content[j+1].Kind == yamlnode.MappingNode && value.Kind == yamlnode.MappingNode:
+			if err := mergeNode(dst.Content[j+1], value); err != nil {
+				return err
+			}
+		default:
+			dst.Content[j+1] = value
+		}
+	}
+
+	return nil
+}
+
+// mappingIndex returns the index of key in the mapping n, or -1.
+func mappingIndex(n *yamlnode.Node, key string) int {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Set applies an override like "recovery.fslabel=FOO", creating the
+// mappings on the way as needed. The value is read as a YAML scalar.
+func (d *Document) Set(set string) error {
+	i := strings.Index(set, "=")
+	if i <= 0 {
+		return fmt.Errorf("%s %q: expected key=value", SetSource, set)
+	}
+	path, value := set[:i], set[i+1:]
+
+	n := d.root
+	keys := strings.Split(path, ".")
+	for k, key := range keys {
+		if key == "" || n.Kind != yamlnode.MappingNode {
+			return fmt.Errorf("%s %q: %s is not a mapping", SetSource, set, strings.Join(keys[:k], "."))
+		}
+
+		j := mappingIndex(n, key)
+		if k == len(keys)-1 {
+			v := &yamlnode.Node{Kind: yamlnode.ScalarNode, Value: value}
+			d.sources[v] = SetSource
+			if j < 0 {
+				n.Content = append(n.Content, &yamlnode.Node{Kind: yamlnode.ScalarNode, Value: key}, v)
+			} else {
+				n.Content[j+1] = v
+			}
+			break
+		}
+
+		if j < 0 {
+			m := &yamlnode.Node{Kind: yamlnode.MappingNode}
+			d.sources[m] = SetSource
+			n.Content = append(n.Content, &yamlnode.Node{Kind: yamlnode.ScalarNode, Value: key}, m)
+			n = m
+		} else {
+			n = resolveAlias(n.Content[j+1])
+		}
+	}
+
+	return nil
+}
+
+// Encode returns the merged document as YAML. With annotate, every value
+// carries a comment naming the file and line it comes from.
+func (d *Document) Encode(annotate bool) ([]byte, error) {
+	if annotate {
+		saved := map[*yamlnode.Node]string{}
+		d.annotate(d.root, saved)
+		defer func() {
+			for n, c := range saved {
+				n.LineComment = c
+			}
+		}()
+	}
+
+	var buf bytes.Buffer
+	enc := yamlnode.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(d.root); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// annotate sets the origin comments of the values below n, saving the
+// comments they replace.
+func (d *Document) annotate(n *yamlnode.Node, saved map[*yamlnode.Node]string) {
+	var values []*yamlnode.Node
+	switch n.Kind {
+	case yamlnode.MappingNode:
+		for i := 1; i < len(n.Content); i += 2 {
+			values = append(values, n.Content[i])
+		}
+	case yamlnode.SequenceNode:
+		values = n.Content
+	}
+
+	for _, v := range values {
+		if v.Kind != yamlnode.ScalarNode {
+			d.annotate(v, saved)
+			continue
+		}
+		if _, ok := saved[v]; !ok {
+			saved[v] = v.LineComment
+		}
+		v.LineComment = d.origin(v)
+	}
+}
+
+func (d *Document) origin(n *yamlnode.Node) string {
+	src := d.source(n)
+	if n.Line == 0 {
+		return src
+	}
+
+	return fmt.Sprintf("%s:%d", filepath.Base(src), n.Line)
+}
+
+// WriteFile writes the merged document to path.
+func (d *Document) WriteFile(path string) error {
+	b, err := d.Encode(false)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, b, 0644)
+}
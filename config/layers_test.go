@@ -0,0 +1,278 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeConfig(t *testing.T, dir, name, content string) string {
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+const baseConfig = `recovery:
+  fslabel: RECOVERY
+  type: full
+snaps:
+  kernel: pc-kernel
+  extras: [hello, world]
+variants:
+  small:
+    recovery:
+      type: factory_install
+  big:
+    snaps:
+      extras: [hello, world, more]
+`
+
+const overlayConfig = `recovery:
+  fslabel: OVERLAY
+  installer: true
+snaps:
+  extras: [only]
+  gadget:
+`
+
+func TestMerge(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	base := writeConfig(t, dir, "config.yaml", baseConfig)
+	overlay := writeConfig(t, dir, "overlay.yaml", overlayConfig)
+
+	for _, c := range []struct {
+		name    string
+		files   []string
+		variant string
+		sets    []string
+		want    map[string]string
+	}{
+		{
+			name:  "one file",
+			files: []string{base},
+			want:  map[string]string{"recovery.fslabel": "RECOVERY", "recovery.type": "full", "snaps.kernel": "pc-kernel"},
+		},
+		{
+			// mappings merge key by key, a null value keeps the key
+			name:  "layered",
+			files: []string{base, overlay},
+			want: map[string]string{"recovery.fslabel": "OVERLAY", "recovery.type": "full", "recovery.installer": "true",
+				"snaps.kernel": "pc-kernel", "snaps.gadget": ""},
+		},
+		{
+			name:  "layered in the other order",
+			files: []string{overlay, base},
+			want:  map[string]string{"recovery.fslabel": "RECOVERY", "recovery.type": "full", "recovery.installer": "true"},
+		},
+		{
+			name:    "variant over the files",
+			files:   []string{base, overlay},
+			variant: "small",
+			want:    map[string]string{"recovery.fslabel": "OVERLAY", "recovery.type": "factory_install"},
+		},
+		{
+			name:    "sets over the variant",
+			files:   []string{base},
+			variant: "small",
+			sets:    []string{"recovery.type=full", "recovery.fslabel=SET"},
+			want:    map[string]string{"recovery.fslabel": "SET", "recovery.type": "full"},
+		},
+	} {
+		d, err := Merge(c.files, c.variant, c.sets)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		for path, want := range c.want {
+			if got := d.Value(path); got != want {
+				t.Errorf("%s: %s is %q, want %q", c.name, path, got, want)
+			}
+		}
+		if d.Has(VariantsKey) {
+			t.Errorf("%s: the variants section is kept", c.name)
+		}
+	}
+}
+
+func TestMergeLists(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	base := writeConfig(t, dir, "config.yaml", baseConfig)
+	overlay := writeConfig(t, dir, "overlay.yaml", overlayConfig)
+
+	// lists are replaced as a whole, by a later file or by a variant
+	for _, c := range []struct {
+		files   []string
+		variant string
+		want    string
+	}{
+		{[]string{base}, "", "[hello, world]"},
+		{[]string{base, overlay}, "", "[only]"},
+		{[]string{base, overlay}, "big", "[hello, world, more]"},
+	} {
+		d, err := Merge(c.files, c.variant, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := d.Encode(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), "extras: "+c.want+"\n") {
+			t.Errorf("%v %q: got\n%s\nwant extras: %s", c.files, c.variant, b, c.want)
+		}
+	}
+}
+
+func TestMergeErrors(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	base := writeConfig(t, dir, "config.yaml", baseConfig)
+	list := writeConfig(t, dir, "list.yaml", "- recovery\n")
+
+	for _, c := range []struct {
+		files   []string
+		variant string
+		sets    []string
+	}{
+		{nil, "", nil},
+		{[]string{filepath.Join(dir, "missing.yaml")}, "", nil},
+		{[]string{base}, "medium", nil},
+		// only mappings merge
+		{[]string{base, list}, "", nil},
+		{[]string{base}, "", []string{"recovery"}},
+	} {
+		if _, err := Merge(c.files, c.variant, c.sets); err == nil {
+			t.Errorf("%v %q %v: no error", c.files, c.variant, c.sets)
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	base := writeConfig(t, dir, "config.yaml", baseConfig)
+
+	for _, c := range []struct {
+		set, path, want string
+	}{
+		{"recovery.fslabel=FOO", "recovery.fslabel", "FOO"},
+		{"recovery.fslabel=", "recovery.fslabel", ""},
+		{"recovery.new=yes", "recovery.new", "yes"},
+		// the mappings on the way are created
+		{"netboot.http.url=http://host/x", "netboot.http.url", "http://host/x"},
+		// the value is all after the first =
+		{"configs.arch=a=b", "configs.arch", "a=b"},
+	} {
+		d, err := ParseDocument(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Set(c.set); err != nil {
+			t.Errorf("%s: %v", c.set, err)
+			continue
+		}
+		if got := d.Value(c.path); got != c.want {
+			t.Errorf("%s: %s is %q, want %q", c.set, c.path, got, c.want)
+		}
+		if n, _ := d.lookup(c.path); n == nil || d.source(n) != SetSource {
+			t.Errorf("%s: %s does not come from %s", c.set, c.path, SetSource)
+		}
+	}
+
+	for _, set := range []string{
+		"recovery",
+		"=FOO",
+		"recovery..fslabel=FOO",
+		// a scalar is not a mapping
+		"recovery.fslabel.sub=FOO",
+		"snaps.extras.x=FOO",
+	} {
+		d, err := ParseDocument(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Set(set); err == nil {
+			t.Errorf("%s: no error", set)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	os.Setenv("URI_TEST_SET", "value")
+	os.Setenv("URI_TEST_EMPTY", "")
+	os.Unsetenv("URI_TEST_UNSET")
+	defer os.Unsetenv("URI_TEST_SET")
+	defer os.Unsetenv("URI_TEST_EMPTY")
+
+	for _, c := range []struct {
+		value, want string
+	}{
+		{"${URI_TEST_SET}", "value"},
+		{"pre-${URI_TEST_SET}-${URI_TEST_SET}", "pre-value-value"},
+		{"${URI_TEST_SET:-default}", "value"},
+		{"${URI_TEST_UNSET:-default}", "default"},
+		{"${URI_TEST_UNSET:-}", ""},
+		// set but empty is not replaced by the default
+		{"${URI_TEST_EMPTY:-default}", ""},
+		{`"${URI_TEST_SET}"`, "value"},
+		{"$URI_TEST_SET", "$URI_TEST_SET"},
+	} {
+		d, err := ParseDocument(writeConfig(t, dir, "config.yaml", "key: "+c.value+"\n"))
+		if err != nil {
+			t.Errorf("%s: %v", c.value, err)
+			continue
+		}
+		if got := d.Value("key"); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.value, got, c.want)
+		}
+	}
+
+	file := writeConfig(t, dir, "config.yaml", "a: 1\nkey: x${URI_TEST_UNSET}\n")
+	_, err := ParseDocument(file)
+	if err == nil || err.Error() != file+":2:6: environment variable URI_TEST_UNSET is not set" {
+		t.Errorf("got %v", err)
+	}
+	// ReadDocument keeps the references
+	d, err := ReadDocument(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.Value("key"); got != "x${URI_TEST_UNSET}" {
+		t.Errorf("ReadDocument: got %q", got)
+	}
+}
@@ -0,0 +1,177 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	yamlnode "gopkg.in/yaml.v3"
+)
+
+// SchemaVersion is the config.yaml schema this version of the tool reads.
+// Configs without a schemaversion key are version 0.
+const SchemaVersion = 1
+
+const schemaVersionKey = "schemaversion"
+
+// CheckSchemaVersion refuses config versions newer than SchemaVersion.
+func CheckSchemaVersion(version int) error {
+	if version < 0 || version > SchemaVersion {
+		return fmt.Errorf("unknown config schemaversion %d, this tool reads up to %d", version, SchemaVersion)
+	}
+
+	return nil
+}
+
+// migration updates a document from the previous schema version to.
+type migration struct {
+	to      int
+	summary string
+	apply   func(d *Document, types []reflect.Type)
+}
+
+var migrations = []migration{
+	{1, "write booleans as true/false and add schemaversion", migrateTo1},
+}
+
+// Version returns the schemaversion of the document.
+func (d *Document) Version() (int, error) {
+	v := d.Value(schemaVersionKey)
+	if v == "" {
+		return 0, nil
+	}
+
+	version, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errors.New(d.Problemf(schemaVersionKey, "%q is not a schema version", v).String())
+	}
+
+	return version, nil
+}
+
+// Migrate rewrites the document to SchemaVersion in place, keeping its
+// comments, and returns the summaries of the steps applied. The targets
+// are the Go types the document is unmarshalled into, as for CheckTypes.
+func (d *Document) Migrate(targets ...interface{}) ([]string, error) {
+	version, err := d.Version()
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckSchemaVersion(version); err != nil {
+		return nil, err
+	}
+
+	var types []reflect.Type
+	for _, t := range targets {
+		types = append(types, reflect.TypeOf(t))
+	}
+
+	var applied []string
+	for _, m := range migrations {
+		if m.to <= version {
+			continue
+		}
+		m.apply(d, types)
+		d.setVersion(m.to)
+		applied = append(applied, fmt.Sprintf("%d -> %d: %s", m.to-1, m.to, m.summary))
+	}
+
+	return applied, nil
+}
+
+// setVersion sets schemaversion, adding it as the first key.
+func (d *Document) setVersion(version int) {
+	value := strconv.Itoa(version)
+	if d.root.Kind != yamlnode.MappingNode {
+		return
+	}
+	if i := mappingIndex(d.root, schemaVersionKey); i >= 0 {
+		d.root.Content[i+1].Value = value
+		return
+	}
+
+	key := &yamlnode.Node{Kind: yamlnode.ScalarNode, Value: schemaVersionKey}
+	val := &yamlnode.Node{Kind: yamlnode.ScalarNode, Value: value}
+	if len(d.root.Content) > 0 {
+		// keep the comment heading the file at the top
+		key.HeadComment = d.root.Content[0].HeadComment
+		d.root.Content[0].HeadComment = ""
+	}
+	d.root.Content = append([]*yamlnode.Node{key, val}, d.root.Content...)
+}
+
+// migrateTo1 replaces the YAML 1.1 booleans (yes, no, on, off, ...) of
+// boolean fields by true and false, which every YAML parser agrees on,
+// in the whole file and in every variant overriding it.
+func migrateTo1(d *Document, types []reflect.Type) {
+	normalizeBools(d.root, types)
+
+	i := mappingIndex(d.root, VariantsKey)
+	if i < 0 {
+		return
+	}
+	variants := resolveAlias(d.root.Content[i+1])
+	if variants.Kind != yamlnode.MappingNode {
+		return
+	}
+	for j := 1; j < len(variants.Content); j += 2 {
+		normalizeBools(variants.Content[j], types)
+	}
+}
+
+func normalizeBools(n *yamlnode.Node, types []reflect.Type) {
+	n = resolveAlias(n)
+	if n.Kind != yamlnode.MappingNode {
+		return
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		var fieldTypes []reflect.Type
+		for _, t := range types {
+			for t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+			if t.Kind() != reflect.Struct {
+				continue
+			}
+			if ft, ok := fieldType(t, n.Content[i].Value); ok {
+				fieldTypes = append(fieldTypes, ft)
+			}
+		}
+		if len(fieldTypes) == 0 {
+			continue
+		}
+
+		value := resolveAlias(n.Content[i+1])
+		if fieldTypes[0].Kind() == reflect.Bool && value.Kind == yamlnode.ScalarNode {
+			switch value.Value {
+			case "y", "Y", "yes", "Yes", "YES", "on", "On", "ON", "True", "TRUE":
+				value.Value, value.Tag, value.Style = "true", "", 0
+			case "n", "N", "no", "No", "NO", "off", "Off", "OFF", "False", "FALSE":
+				value.Value, value.Tag, value.Style = "false", "", 0
+			}
+			continue
+		}
+		normalizeBools(value, fieldTypes)
+	}
+}
@@ -0,0 +1,155 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package config
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testRecovery struct {
+	Recovery struct {
+		FsLabel   string
+		Installer bool
+		QuietBoot bool `yaml:"quiet-boot"`
+	}
+	Retries int
+}
+
+type testSnaps struct {
+	Snaps struct {
+		DevMode bool
+	}
+}
+
+const version0Config = `# build config
+recovery:
+  fslabel: yes
+  installer: yes
+  quiet-boot: "Off"
+retries: 3
+snaps:
+  devmode: ON
+unknown: no
+variants:
+  small:
+    recovery:
+      installer: n
+`
+
+func TestMigrate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	d, err := ReadDocument(writeConfig(t, dir, "config.yaml", version0Config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := d.Migrate(testRecovery{}, &testSnaps{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"0 -> 1: write booleans as true/false and add schemaversion"}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("got steps %q, want %q", applied, want)
+	}
+	if v, err := d.Version(); v != 1 || err != nil {
+		t.Errorf("got version %d, %v, want 1", v, err)
+	}
+
+	b, err := d.Encode(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// booleans of bool fields only, in the variants too; the comment
+	// heading the file stays on top
+	want := `# build config
+schemaversion: 1
+recovery:
+  fslabel: yes
+  installer: true
+  quiet-boot: false
+retries: 3
+snaps:
+  devmode: true
+unknown: no
+variants:
+  small:
+    recovery:
+      installer: false
+`
+	if string(b) != want {
+		t.Errorf("got\n%s\nwant\n%s", b, want)
+	}
+
+	// migrating again changes nothing
+	if applied, err := d.Migrate(testRecovery{}, &testSnaps{}); err != nil || len(applied) != 0 {
+		t.Errorf("second migration: got %q, %v", applied, err)
+	}
+}
+
+func TestMigrateVersions(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		config string
+		steps  int
+		err    string
+	}{
+		{"recovery:\n  installer: yes\n", 1, ""},
+		{"schemaversion: 0\n", 1, ""},
+		{"schemaversion: 1\nrecovery:\n  installer: yes\n", 0, ""},
+		{"schemaversion: 2\n", 0, "unknown config schemaversion 2"},
+		{"schemaversion: next\n", 0, "is not a schema version"},
+	} {
+		d, err := ReadDocument(writeConfig(t, dir, "config.yaml", c.config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		applied, err := d.Migrate(testRecovery{})
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%q: got %v, want %q", c.config, err, c.err)
+			}
+			continue
+		}
+		if err != nil || len(applied) != c.steps {
+			t.Errorf("%q: got %q, %v, want %d steps", c.config, applied, err, c.steps)
+		}
+	}
+}
+
+func TestCheckSchemaVersion(t *testing.T) {
+	for _, c := range []struct {
+		version int
+		ok      bool
+	}{
+		{-1, false},
+		{0, true},
+		{SchemaVersion, true},
+		{SchemaVersion + 1, false},
+	} {
+		if err := CheckSchemaVersion(c.version); (err == nil) != c.ok {
+			t.Errorf("%d: got %v", c.version, err)
+		}
+	}
+}
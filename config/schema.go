@@ -0,0 +1,339 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+
+	yamlnode "gopkg.in/yaml.v3"
+)
+
+// Problem is a mistake found in a config file.
+type Problem struct {
+	File   string
+	Line   int
+	Column int
+	// Key is the dotted path of the offending key, like "configs.bootloader".
+	Key     string
+	Message string
+}
+
+func (p Problem) String() string {
+	key := ""
+	if p.Key != "" {
+		key = p.Key + ": "
+	}
+
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s%s", p.File, key, p.Message)
+	}
+
+	return fmt.Sprintf("%s:%d:%d: %s%s", p.File, p.Line, p.Column, key, p.Message)
+}
+
+// Document is a config file parsed with the position of every node, so
+// problems can point at the line and column they come from. Documents
+// merged from several files remember the file of every node.
+type Document struct {
+	File    string
+	root    *yamlnode.Node
+	sources map[*yamlnode.Node]string
+}
+
+// ParseDocument parses the config file, expanding ${VAR} and
+// ${VAR:-default} references to environment variables in its values.
+func ParseDocument(file string) (*Document, error) {
+	return parseDocument(file, true)
+}
+
+// ReadDocument parses the config file as it is, for rewriting it.
+func ReadDocument(file string) (*Document, error) {
+	return parseDocument(file, false)
+}
+
+func parseDocument(file string, expand bool) (*Document, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yamlnode.Node
+	if err := yamlnode.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	d := &Document{
+		File:    file,
+		root:    &yamlnode.Node{Kind: yamlnode.MappingNode, Line: 1, Column: 1},
+		sources: map[*yamlnode.Node]string{},
+	}
+	if doc.Kind == yamlnode.DocumentNode && len(doc.Content) > 0 {
+		d.root = resolveAlias(doc.Content[0])
+	}
+	if err := d.walk(d.root, func(n *yamlnode.Node) error {
+		d.sources[n] = file
+		if !expand {
+			return nil
+		}
+		return d.expandEnv(n)
+	}); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// walk calls f for n and every node below it.
+func (d *Document) walk(n *yamlnode.Node, f func(*yamlnode.Node) error) error {
+	if err := f(n); err != nil {
+		return err
+	}
+	for _, c := range n.Content {
+		if err := d.walk(c, f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// source returns the file n comes from.
+func (d *Document) source(n *yamlnode.Node) string {
+	if f, ok := d.sources[n]; ok {
+		return f
+	}
+
+	return d.File
+}
+
+func resolveAlias(n *yamlnode.Node) *yamlnode.Node {
+	for n.Kind == yamlnode.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+
+	return n
+}
+
+// lookup returns the value node of the dotted key path and, when the key
+// is missing, the deepest node found on the way.
+func (d *Document) lookup(path string) (value *yamlnode.Node, closest *yamlnode.Node) {
+	n := d.root
+	for _, key := range strings.Split(path, ".") {
+		if n.Kind != yamlnode.MappingNode {
+			return nil, n
+		}
+		var next *yamlnode.Node
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Value == key {
+				next = resolveAlias(n.Content[i+1])
+				break
+			}
+		}
+		if next == nil {
+			return nil, n
+		}
+		n = next
+	}
+
+	return n, n
+}
+
+// Value returns the scalar value of the dotted key path, or "".
+func (d *Document) Value(path string) string {
+	n, _ := d.lookup(path)
+	if n == nil || n.Kind != yamlnode.ScalarNode || n.ShortTag() == "!!null" {
+		return ""
+	}
+
+	return n.Value
+}
+
+// Has tells whether the dotted key path is set.
+func (d *Document) Has(path string) bool {
+	n, _ := d.lookup(path)
+
+	return n != nil
+}
+
+// Problemf returns a problem located at the value of path, or at its
+// closest parent when path is not set.
+func (d *Document) Problemf(path string, format string, a ...interface{}) Problem {
+	_, n := d.lookup(path)
+
+	return d.problemAt(n, path, format, a...)
+}
+
+// CheckTypes compares the document with the Go types its sections are
+// unmarshalled into. Keys unknown to all of them and values that do not
+// fit the field type are reported.
+func (d *Document) CheckTypes(targets ...interface{}) []Problem {
+	var types []reflect.Type
+	for _, t := range targets {
+		types = append(types, reflect.TypeOf(t))
+	}
+
+	return d.check(d.root, "", types)
+}
+
+func (d *Document) problemAt(n *yamlnode.Node, path string, format string, a ...interface{}) Problem {
+	return Problem{
+		File:    d.source(n),
+		Line:    n.Line,
+		Column:  n.Column,
+		Key:     path,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+func (d *Document) check(n *yamlnode.Node, path string, types []reflect.Type) []Problem {
+	n = resolveAlias(n)
+	for i, t := range types {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		types[i] = t
+	}
+	t := types[0]
+
+	if n.Kind == yamlnode.ScalarNode && n.ShortTag() == "!!null" {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yamlnode.MappingNode {
+			return []Problem{d.problemAt(n, path, "expected a mapping")}
+		}
+		var problems []Problem
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+
+			var fieldTypes []reflect.Type
+			for _, st := range types {
+				if ft, ok := fieldType(st, key); ok {
+					fieldTypes = append(fieldTypes, ft)
+				}
+			}
+			if len(fieldTypes) == 0 {
+				problems = append(problems, d.problemAt(n.Content[i], keyPath, "unknown key"))
+				continue
+			}
+			problems = append(problems, d.check(n.Content[i+1], keyPath, fieldTypes)...)
+		}
+		return problems
+	case reflect.Map:
+		if n.Kind != yamlnode.MappingNode {
+			return []Problem{d.problemAt(n, path, "expected a mapping")}
+		}
+		var problems []Problem
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			keyPath := path + "." + n.Content[i].Value
+			problems = append(problems, d.check(n.Content[i+1], keyPath, []reflect.Type{t.Elem()})...)
+		}
+		return problems
+	case reflect.Slice, reflect.Array:
+		if n.Kind != yamlnode.SequenceNode {
+			return []Problem{d.problemAt(n, path, "expected a list")}
+		}
+		var problems []Problem
+		for i, item := range n.Content {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			problems = append(problems, d.check(item, itemPath, []reflect.Type{t.Elem()})...)
+		}
+		return problems
+	case reflect.Interface:
+		return nil
+	}
+
+	if n.Kind != yamlnode.ScalarNode {
+		return []Problem{d.problemAt(n, path, "expected a single value")}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		if !isBool(n.Value) {
+			return []Problem{d.problemAt(n, path, "%q is not a boolean, use true or false", n.Value)}
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, err := strconv.ParseInt(n.Value, 0, t.Bits()); err != nil {
+			return []Problem{d.problemAt(n, path, "%q is not an integer", n.Value)}
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if _, err := strconv.ParseUint(n.Value, 0, t.Bits()); err != nil {
+			return []Problem{d.problemAt(n, path, "%q is not a positive integer", n.Value)}
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, err := strconv.ParseFloat(n.Value, t.Bits()); err != nil {
+			return []Problem{d.problemAt(n, path, "%q is not a number", n.Value)}
+		}
+	}
+
+	return nil
+}
+
+// fieldType finds the field of struct type t that yaml.v2 maps key to:
+// the yaml tag name or else the lowercased field name.
+func fieldType(t reflect.Type, key string) (reflect.Type, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := strings.ToLower(f.Name)
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		if len(tag) > 1 && tag[1] == "inline" {
+			if ft, ok := fieldType(f.Type, key); ok {
+				return ft, true
+			}
+			continue
+		}
+		if tag[0] != "" {
+			name = tag[0]
+		}
+		if name == key {
+			return f.Type, true
+		}
+	}
+
+	return nil, false
+}
+
+// isBool accepts the YAML 1.1 booleans understood by yaml.v2.
+func isBool(v string) bool {
+	switch v {
+	case "y", "Y", "yes", "Yes", "YES", "on", "On", "ON", "true", "True", "TRUE",
+		"n", "N", "no", "No", "NO", "off", "Off", "OFF", "false", "False", "FALSE":
+		return true
+	}
+
+	return false
+}
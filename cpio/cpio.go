@@ -0,0 +1,197 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package cpio reads the "newc" cpio archives of initrd images.
+package cpio
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+const (
+	headerLen = 110
+	trailer   = "TRAILER!!!"
+
+	magicNewc = "070701"
+	magicCRC  = "070702"
+)
+
+var (
+	// ErrNotCpio is returned when an archive does not start with a newc
+	// header.
+	ErrNotCpio = errors.New("not a newc cpio archive")
+)
+
+// Mode bits of the file type, as in stat(2).
+const (
+	TypeMask    = 0170000
+	TypeDir     = 0040000
+	TypeReg     = 0100000
+	TypeSymlink = 0120000
+)
+
+// Header is an entry of the archive.
+type Header struct {
+	Name string
+	Mode int64
+	Size int64
+	// Linkname is the target of a symlink.
+	Linkname string
+}
+
+// FileMode returns the permissions and type of the entry.
+func (h *Header) FileMode() os.FileMode {
+	mode := os.FileMode(h.Mode & 0777)
+	switch h.Mode & TypeMask {
+	case TypeDir:
+		mode |= os.ModeDir
+	case TypeSymlink:
+		mode |= os.ModeSymlink
+	case TypeReg:
+	default:
+		mode |= os.ModeDevice
+	}
+
+	return mode
+}
+
+// Reader reads the entries of an archive in order.
+type Reader struct {
+	r io.Reader
+	// left is what is left of the data of the current entry
+	left int64
+	// pad is the padding after the data of the current entry
+	pad int64
+	off int64
+}
+
+// NewReader returns a reader for the archive read from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+func (r *Reader) skip(n int64) error {
+	m, err := io.CopyN(ioutil.Discard, r.r, n)
+	r.off += m
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+func (r *Reader) readFull(b []byte) error {
+	n, err := io.ReadFull(r.r, b)
+	r.off += int64(n)
+
+	return err
+}
+
+func pad4(n int64) int64 {
+	return (4 - n%4) % 4
+}
+
+// Next advances to the next entry. It returns io.EOF after the trailer.
+func (r *Reader) Next() (*Header, error) {
+	if err := r.skip(r.left + r.pad); err != nil {
+		return nil, err
+	}
+	r.left, r.pad = 0, 0
+
+	raw := make([]byte, headerLen)
+	if err := r.readFull(raw); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	magic := string(raw[:6])
+	if magic != magicNewc && magic != magicCRC {
+		return nil, ErrNotCpio
+	}
+
+	// the 13 fields following the magic are 8 hex digits each
+	var fields [13]int64
+	for i := range fields {
+		v, err := strconv.ParseInt(string(raw[6+8*i:14+8*i]), 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad cpio header at %d: %v", r.off-headerLen, err)
+		}
+		fields[i] = v
+	}
+	mode, size, nameSize := fields[1], fields[6], fields[11]
+	if nameSize <= 0 {
+		return nil, fmt.Errorf("bad cpio name size at %d", r.off-headerLen)
+	}
+
+	name := make([]byte, nameSize)
+	if err := r.readFull(name); err != nil {
+		return nil, err
+	}
+	if err := r.skip(pad4(headerLen + nameSize)); err != nil {
+		return nil, err
+	}
+
+	h := &Header{
+		Name: string(bytes.TrimRight(name, "\x00")),
+		Mode: mode,
+		Size: size,
+	}
+	if h.Name == trailer {
+		// the trailer ends on a 512 bytes block, padding included
+		return nil, io.EOF
+	}
+
+	r.left, r.pad = size, pad4(size)
+	if mode&TypeMask == TypeSymlink {
+		link := make([]byte, size)
+		if err := r.readFull(link); err != nil {
+			return nil, err
+		}
+		h.Linkname = string(link)
+		r.left = 0
+	}
+
+	return h, nil
+}
+
+// Read reads the data of the current entry.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+
+	n, err := r.r.Read(p)
+	r.left -= int64(n)
+	r.off += int64(n)
+	if err == io.EOF && r.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
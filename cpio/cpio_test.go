@@ -0,0 +1,202 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package cpio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+type testEntry struct {
+	name string
+	mode int64
+	data string
+}
+
+// makeArchive writes a newc archive of entries, as cpio -H newc does:
+// names and data padded to 4 bytes, and the trailer padded to 512.
+func makeArchive(entries ...testEntry) []byte {
+	var b bytes.Buffer
+	write := func(ino int, name string, mode int64, data string) {
+		fmt.Fprintf(&b, "%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			magicNewc, ino, mode, 0, 0, 1, 1500000000, len(data), 0, 0, 0, 0, len(name)+1, 0)
+		b.WriteString(name + "\x00")
+		b.Write(make([]byte, pad4(int64(headerLen+len(name)+1))))
+		b.WriteString(data)
+		b.Write(make([]byte, pad4(int64(len(data)))))
+	}
+	for i, e := range entries {
+		write(i+1, e.name, e.mode, e.data)
+	}
+	write(0, trailer, 0, "")
+	if n := b.Len() % 512; n != 0 {
+		b.Write(make([]byte, 512-n))
+	}
+
+	return b.Bytes()
+}
+
+var testEntries = []testEntry{
+	{".", TypeDir | 0755, ""},
+	{"bin", TypeDir | 0755, ""},
+	{"bin/busybox", TypeReg | 0755, "busybox binary"},
+	{"bin/sh", TypeSymlink | 0777, "busybox"},
+	{"init", TypeReg | 0755, "#!/bin/sh\n"},
+	{"dev/console", 0020000 | 0600, ""},
+	{"empty", TypeReg | 0644, ""},
+}
+
+func readAll(t *testing.T, r *Reader) ([]*Header, []string) {
+	var headers []*Header
+	var contents []string
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			return headers, contents
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, h)
+		contents = append(contents, string(b))
+	}
+}
+
+func TestRead(t *testing.T) {
+	headers, contents := readAll(t, NewReader(bytes.NewReader(makeArchive(testEntries...))))
+	if len(headers) != len(testEntries) {
+		t.Fatalf("got %d entries, want %d", len(headers), len(testEntries))
+	}
+
+	for i, e := range testEntries {
+		h := headers[i]
+		if h.Name != e.name || h.Mode != e.mode {
+			t.Errorf("entry %d: got %s %o, want %s %o", i, h.Name, h.Mode, e.name, e.mode)
+		}
+		if h.Mode&TypeMask == TypeSymlink {
+			if h.Linkname != e.data || contents[i] != "" {
+				t.Errorf("%s: got link %q and content %q", h.Name, h.Linkname, contents[i])
+			}
+			continue
+		}
+		if contents[i] != e.data || h.Size != int64(len(e.data)) {
+			t.Errorf("%s: got %q, want %q", h.Name, contents[i], e.data)
+		}
+	}
+
+	for _, c := range []struct {
+		i    int
+		mode os.FileMode
+	}{
+		{1, os.ModeDir | 0755},
+		{2, 0755},
+		{3, os.ModeSymlink | 0777},
+		{5, os.ModeDevice | 0600},
+	} {
+		if got := headers[c.i].FileMode(); got != c.mode {
+			t.Errorf("%s: got %v, want %v", headers[c.i].Name, got, c.mode)
+		}
+	}
+}
+
+func TestSkipUnreadData(t *testing.T) {
+	r := NewReader(bytes.NewReader(makeArchive(testEntries...)))
+	var names []string
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+	}
+	if got, want := strings.Join(names, " "), ". bin bin/busybox bin/sh init dev/console empty"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestConcatenated reads archives following each other, as in an initrd
+// with early microcode: the reader stops at the trailer of the first one,
+// before its padding.
+func TestConcatenated(t *testing.T) {
+	first := makeArchive(testEntry{"kernel/x86/microcode/GenuineIntel.bin", TypeReg | 0644, "ucode"})
+	second := makeArchive(testEntries...)
+	in := bytes.NewReader(append(append([]byte{}, first...), second...))
+
+	headers, _ := readAll(t, NewReader(in))
+	if len(headers) != 1 || headers[0].Name != "kernel/x86/microcode/GenuineIntel.bin" {
+		t.Fatalf("first archive: got %v", headers)
+	}
+
+	// skip the zeros padding the trailer
+	for {
+		c, err := in.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != 0 {
+			in.UnreadByte()
+			break
+		}
+	}
+	headers, _ = readAll(t, NewReader(in))
+	if len(headers) != len(testEntries) {
+		t.Fatalf("second archive: got %d entries, want %d", len(headers), len(testEntries))
+	}
+}
+
+func TestErrors(t *testing.T) {
+	if _, err := NewReader(strings.NewReader(strings.Repeat("x", headerLen))).Next(); err != ErrNotCpio {
+		t.Errorf("got %v, want ErrNotCpio", err)
+	}
+
+	archive := makeArchive(testEntries...)
+	for _, c := range []struct {
+		what string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated header", archive[:50]},
+		// cut in the data of bin/busybox, without a trailer
+		{"truncated data", archive[:3*headerLen+20]},
+	} {
+		r := NewReader(bytes.NewReader(c.data))
+		var err error
+		for err == nil {
+			if _, err = r.Next(); err == nil {
+				_, err = ioutil.ReadAll(r)
+			}
+		}
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: got %v, want an unexpected EOF", c.what, err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package disk
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Device is a disk to write an image to or, for tests, a regular file
+// standing in for one.
+type Device struct {
+	Path string
+	// Block is false for a regular file.
+	Block bool
+	Size  int64
+	// ID is the major:minor number of a block device.
+	ID string
+}
+
+// devID returns the major:minor number of the device rdev.
+func devID(rdev uint64) string {
+	major := (rdev>>8)&0xfff | (rdev>>32)&^0xfff
+	minor := rdev&0xff | (rdev>>12)&^0xff
+	return fmt.Sprintf("%d:%d", major, minor)
+}
+
+// statID returns the major:minor number of the block device path, or ""
+// when path is not a block device.
+func statID(path string) string {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+		return ""
+	}
+
+	return devID(uint64(fi.Sys().(*syscall.Stat_t).Rdev))
+}
+
+// OpenDevice checks that path can be overwritten: a whole disk which
+// neither it nor its partitions are mounted, used as swap or held by
+// device mapper or md, or a regular file.
+func OpenDevice(path string) (*Device, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode().IsRegular() {
+		return &Device{Path: path, Size: fi.Size()}, nil
+	}
+	if fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+		return nil, fmt.Errorf("%s is not a block device", path)
+	}
+
+	d := &Device{Path: path, Block: true, ID: statID(path)}
+	sysDir := filepath.Join("/sys/dev/block", d.ID)
+	if _, err := os.Stat(filepath.Join(sysDir, "partition")); err == nil {
+		return nil, fmt.Errorf("%s is a partition, give the whole disk", path)
+	}
+
+	// the disk and its partitions
+	ids := map[string]bool{d.ID: true}
+	entries, _ := ioutil.ReadDir(sysDir + "/")
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join(sysDir, e.Name(), "partition")); err != nil {
+			continue
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(sysDir, e.Name(), "dev")); err == nil {
+			ids[strings.TrimSpace(string(b))] = true
+		}
+		if err := checkHolders(path, filepath.Join(sysDir, e.Name())); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkHolders(path, sysDir); err != nil {
+		return nil, err
+	}
+	if err := checkMounts(path, ids); err != nil {
+		return nil, err
+	}
+	if err := checkSwaps(path, ids); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if d.Size, err = f.Seek(0, os.SEEK_END); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func checkHolders(path, sysDir string) error {
+	holders, _ := ioutil.ReadDir(filepath.Join(sysDir, "holders"))
+	if len(holders) > 0 {
+		return fmt.Errorf("%s is in use by %s", path, holders[0].Name())
+	}
+
+	return nil
+}
+
+// checkMounts fails when one of the devices ids is mounted, as told by
+// the major:minor number of the mount or by its source device.
+func checkMounts(path string, ids map[string]bool) error {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		source := ""
+		for i, field := range fields {
+			if field == "-" && i+2 < len(fields) {
+				source = fields[i+2]
+				break
+			}
+		}
+		if !ids[fields[2]] && !ids[statID(source)] {
+			continue
+		}
+		if fields[4] == "/" {
+			return fmt.Errorf("%s holds the root file system of this system", path)
+		}
+		return fmt.Errorf("%s is mounted on %s", path, fields[4])
+	}
+
+	return scanner.Err()
+}
+
+func checkSwaps(path string, ids map[string]bool) error {
+	b, err := ioutil.ReadFile("/proc/swaps")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(string(b), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && ids[statID(fields[0])] {
+			return fmt.Errorf("%s is used as swap", path)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package disk
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// debugfs opens the ext2/3/4 file system of partition p read-only, using
+// the "?offset=" io option of e2fsprogs, so no loop device is needed.
+func debugfs(image string, p Partition, request string) (string, error) {
+	cmd := exec.Command("debugfs", "-R", request, fmt.Sprintf("%s?offset=%d", image, p.Start))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("debugfs %q on %s: %v\n%s", request, image, err, out)
+	}
+
+	return string(out), nil
+}
+
+// Ext4Dump copies the file src of the ext4 partition p of image to dst.
+func Ext4Dump(image string, p Partition, src, dst string) error {
+	out, err := debugfs(image, p, fmt.Sprintf("dump -p %q %q", src, dst))
+	if err != nil {
+		return err
+	}
+
+	// debugfs reports lookup failures on its output only
+	if _, err := os.Stat(dst); err != nil {
+		return fmt.Errorf("cannot dump %s from %s: %s", src, image, strings.TrimSpace(out))
+	}
+
+	return nil
+}
+
+// Ext4DumpDir copies the directory tree src of the ext4 partition p of
+// image into the directory dst, which gets created.
+func Ext4DumpDir(image string, p Partition, src, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	out, err := debugfs(image, p, fmt.Sprintf("rdump %q %q", src, dst))
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(filepath.Join(dst, path.Base(src))); err != nil {
+		return fmt.Errorf("cannot dump %s from %s: %s", src, image, strings.TrimSpace(out))
+	}
+
+	return nil
+}
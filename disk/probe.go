@@ -0,0 +1,148 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	FsVfat     = "vfat"
+	FsExt4     = "ext4"
+	FsExt3     = "ext3"
+	FsExt2     = "ext2"
+	FsSquashfs = "squashfs"
+)
+
+// FsInfo describes the file system found at the start of a partition.
+type FsInfo struct {
+	Type  string
+	Label string
+	UUID  string
+}
+
+// Probe identifies the file system of partition p, like blkid does for
+// the types found in Ubuntu Core images. Type is empty for raw content.
+func Probe(r io.ReaderAt, p Partition) (*FsInfo, error) {
+	buf := make([]byte, 2048)
+	if _, err := r.ReadAt(buf, p.Start); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if info := probeExt(buf[1024:]); info != nil {
+		return info, nil
+	}
+	if info := probeVfat(buf[:512]); info != nil {
+		return info, nil
+	}
+	if string(buf[0:4]) == "hsqs" {
+		return &FsInfo{Type: FsSquashfs}, nil
+	}
+
+	return &FsInfo{}, nil
+}
+
+func probeExt(sb []byte) *FsInfo {
+	if binary.LittleEndian.Uint16(sb[0x38:]) != 0xef53 {
+		return nil
+	}
+
+	const (
+		compatHasJournal = 0x4
+		incompatExtents  = 0x40
+		incompat64bit    = 0x80
+	)
+	compat := binary.LittleEndian.Uint32(sb[0x5c:])
+	incompat := binary.LittleEndian.Uint32(sb[0x60:])
+
+	info := &FsInfo{
+		Label: cString(sb[0x78 : 0x78+16]),
+		UUID:  uuidString(sb[0x68 : 0x68+16]),
+	}
+	switch {
+	case incompat&(incompatExtents|incompat64bit) != 0:
+		info.Type = FsExt4
+	case compat&compatHasJournal != 0:
+		info.Type = FsExt3
+	default:
+		info.Type = FsExt2
+	}
+
+	return info
+}
+
+func probeVfat(bs []byte) *FsInfo {
+	if bs[510] != 0x55 || bs[511] != 0xaa {
+		return nil
+	}
+
+	// FAT32 keeps its extended BIOS parameter block further in
+	var label, id []byte
+	switch {
+	case string(bs[0x52:0x57]) == "FAT32":
+		label, id = bs[0x47:0x47+11], bs[0x43:0x43+4]
+	case strings.HasPrefix(string(bs[0x36:0x3b]), "FAT1"):
+		label, id = bs[0x2b:0x2b+11], bs[0x27:0x27+4]
+	default:
+		return nil
+	}
+
+	info := &FsInfo{
+		Type: FsVfat,
+		UUID: fmt.Sprintf("%04X-%04X", binary.LittleEndian.Uint16(id[2:]), binary.LittleEndian.Uint16(id[:2])),
+	}
+	if l := strings.TrimRight(string(label), " "); l != "NO NAME" {
+		info.Label = l
+	}
+
+	return info
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+
+	return string(b)
+}
+
+func uuidString(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// FindByLabel probes the partitions of t and returns the first one whose
+// file system carries label.
+func FindByLabel(r io.ReaderAt, t *Table, label string) (*Partition, *FsInfo, error) {
+	for i := range t.Partitions {
+		info, err := Probe(r, t.Partitions[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		if info.Label == label {
+			return &t.Partitions[i], info, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("no partition labelled %q", label)
+}
@@ -0,0 +1,287 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package disk reads partition tables and file system headers of disk
+// image files, so they can be inspected without loop devices or root.
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf16"
+)
+
+const (
+	SchemaGPT = "gpt"
+	SchemaMBR = "mbr"
+
+	sectorSize = 512
+
+	mbrTypeProtective = 0xee
+)
+
+var (
+	// ErrNoPartitionTable is returned when an image carries neither a GPT
+	// nor an MBR partition table.
+	ErrNoPartitionTable = errors.New("no partition table found")
+)
+
+// Partition is an entry of a partition table. Start and Size are in bytes.
+type Partition struct {
+	Number   int
+	Start    int64
+	Size     int64
+	Type     string
+	Name     string
+	UUID     string
+	Bootable bool
+}
+
+// End returns the offset of the first byte after the partition.
+func (p *Partition) End() int64 {
+	return p.Start + p.Size
+}
+
+// Table is the partition table of an image.
+type Table struct {
+	Schema     string
+	DiskID     string
+	Partitions []Partition
+}
+
+// Partition returns the partition numbered nr, or nil.
+func (t *Table) Partition(nr int) *Partition {
+	for i := range t.Partitions {
+		if t.Partitions[i].Number == nr {
+			return &t.Partitions[i]
+		}
+	}
+
+	return nil
+}
+
+// ReadTableFile reads the partition table of the image file at path.
+func ReadTableFile(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadTable(f)
+}
+
+// ReadTable reads a GPT or, failing that, an MBR partition table.
+func ReadTable(r io.ReaderAt) (*Table, error) {
+	mbr := make([]byte, sectorSize)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		return nil, err
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return nil, ErrNoPartitionTable
+	}
+
+	if mbr[446+4] == mbrTypeProtective {
+		return readGPT(r)
+	}
+
+	return readMBR(r, mbr)
+}
+
+type gptHeader struct {
+	Signature      [8]byte
+	Revision       uint32
+	HeaderSize     uint32
+	HeaderCRC      uint32
+	Reserved       uint32
+	CurrentLBA     uint64
+	BackupLBA      uint64
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+	DiskGUID       [16]byte
+	EntriesLBA     uint64
+	EntryCount     uint32
+	EntrySize      uint32
+	EntriesCRC     uint32
+}
+
+type gptEntry struct {
+	TypeGUID   [16]byte
+	UniqueGUID [16]byte
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	Name       [36]uint16
+}
+
+func readGPT(r io.ReaderAt) (*Table, error) {
+	buf := make([]byte, sectorSize)
+	if _, err := r.ReadAt(buf, sectorSize); err != nil {
+		return nil, err
+	}
+
+	var h gptHeader
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	if string(h.Signature[:]) != "EFI PART" {
+		return nil, errors.New("protective MBR without GPT header")
+	}
+	if h.EntrySize < 128 || h.EntryCount > 1024 {
+		return nil, fmt.Errorf("invalid GPT header (%d entries of %d bytes)", h.EntryCount, h.EntrySize)
+	}
+
+	entries := make([]byte, int(h.EntryCount)*int(h.EntrySize))
+	if _, err := r.ReadAt(entries, int64(h.EntriesLBA)*sectorSize); err != nil {
+		return nil, err
+	}
+
+	t := &Table{Schema: SchemaGPT, DiskID: guidString(h.DiskGUID)}
+	for i := 0; i < int(h.EntryCount); i++ {
+		var e gptEntry
+		raw := entries[i*int(h.EntrySize) : i*int(h.EntrySize)+128]
+		if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &e); err != nil {
+			return nil, err
+		}
+		if e.TypeGUID == [16]byte{} {
+			continue
+		}
+
+		t.Partitions = append(t.Partitions, Partition{
+			Number:   i + 1,
+			Start:    int64(e.FirstLBA) * sectorSize,
+			Size:     int64(e.LastLBA-e.FirstLBA+1) * sectorSize,
+			Type:     guidString(e.TypeGUID),
+			Name:     utf16String(e.Name[:]),
+			UUID:     guidString(e.UniqueGUID),
+			Bootable: e.Attributes&(1<<2) != 0,
+		})
+	}
+
+	return t, nil
+}
+
+type mbrEntry struct {
+	Status   uint8
+	CHSFirst [3]byte
+	Type     uint8
+	CHSLast  [3]byte
+	FirstLBA uint32
+	Sectors  uint32
+}
+
+func readMBREntries(sector []byte) ([4]mbrEntry, error) {
+	var entries [4]mbrEntry
+	err := binary.Read(bytes.NewReader(sector[446:510]), binary.LittleEndian, &entries)
+
+	return entries, err
+}
+
+func isExtended(typ uint8) bool {
+	return typ == 0x05 || typ == 0x0f || typ == 0x85
+}
+
+func readMBR(r io.ReaderAt, mbr []byte) (*Table, error) {
+	entries, err := readMBREntries(mbr)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Table{
+		Schema: SchemaMBR,
+		DiskID: fmt.Sprintf("%08x", binary.LittleEndian.Uint32(mbr[440:444])),
+	}
+	var extended *mbrEntry
+	for i, e := range entries {
+		if e.Type == 0 {
+			continue
+		}
+		if isExtended(e.Type) {
+			extended = &entries[i]
+		}
+		t.Partitions = append(t.Partitions, Partition{
+			Number:   i + 1,
+			Start:    int64(e.FirstLBA) * sectorSize,
+			Size:     int64(e.Sectors) * sectorSize,
+			Type:     fmt.Sprintf("%02x", e.Type),
+			Bootable: e.Status&0x80 != 0,
+		})
+	}
+
+	if extended == nil {
+		return t, nil
+	}
+
+	// logical partitions are chained through extended boot records, each
+	// relative to the start of the extended partition
+	base := int64(extended.FirstLBA)
+	next := base
+	ebr := make([]byte, sectorSize)
+	for nr := 5; nr < 5+128; nr++ {
+		if _, err := r.ReadAt(ebr, next*sectorSize); err != nil {
+			return nil, err
+		}
+		if ebr[510] != 0x55 || ebr[511] != 0xaa {
+			return nil, fmt.Errorf("invalid extended boot record at sector %d", next)
+		}
+		logical, err := readMBREntries(ebr)
+		if err != nil {
+			return nil, err
+		}
+		if logical[0].Type != 0 {
+			t.Partitions = append(t.Partitions, Partition{
+				Number:   nr,
+				Start:    (next + int64(logical[0].FirstLBA)) * sectorSize,
+				Size:     int64(logical[0].Sectors) * sectorSize,
+				Type:     fmt.Sprintf("%02x", logical[0].Type),
+				Bootable: logical[0].Status&0x80 != 0,
+			})
+		}
+		if logical[1].Type == 0 {
+			break
+		}
+		next = base + int64(logical[1].FirstLBA)
+	}
+
+	return t, nil
+}
+
+// guidString formats a GUID in its canonical mixed-endian text form.
+func guidString(g [16]byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]),
+		g[8:10], g[10:16])
+}
+
+func utf16String(u []uint16) string {
+	for i, c := range u {
+		if c == 0 {
+			u = u[:i]
+			break
+		}
+	}
+
+	return string(utf16.Decode(u))
+}
@@ -0,0 +1,563 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package fat reads FAT12, FAT16 and FAT32 file systems, such as the
+// recovery partition, without mounting them.
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	dirEntrySize = 32
+
+	attrReadOnly  = 0x01
+	attrVolumeID  = 0x08
+	attrDirectory = 0x10
+	attrLongName  = 0x0f
+
+	// lower case flags of the short name, as written by Windows NT and Linux
+	lowerBase = 0x08
+	lowerExt  = 0x10
+
+	deletedEntry = 0xe5
+)
+
+var (
+	// ErrNotFat is returned when r does not start with a FAT boot sector.
+	ErrNotFat = errors.New("not a FAT file system")
+)
+
+// Filesystem is a read-only view of a FAT file system.
+type Filesystem struct {
+	r io.ReaderAt
+
+	// Type is FAT12, FAT16 or FAT32.
+	Type string
+	// Label is the volume label of the boot sector.
+	Label string
+
+	bytesPerSector int64
+	clusterSize    int64
+	dataStart      int64
+	rootStart      int64
+	rootSize       int64
+	rootCluster    uint32
+	clusters       uint32
+	fat            []byte
+}
+
+// New reads the FAT file system available through r, which starts at its
+// boot sector.
+func New(r io.ReaderAt) (*Filesystem, error) {
+	bs := make([]byte, 512)
+	if _, err := r.ReadAt(bs, 0); err != nil {
+		return nil, err
+	}
+	if bs[510] != 0x55 || bs[511] != 0xaa {
+		return nil, ErrNotFat
+	}
+
+	le := binary.LittleEndian
+	bytesPerSector := int64(le.Uint16(bs[11:]))
+	sectorsPerCluster := int64(bs[13])
+	reserved := int64(le.Uint16(bs[14:]))
+	fats := int64(bs[16])
+	rootEntries := int64(le.Uint16(bs[17:]))
+	totalSectors := int64(le.Uint16(bs[19:]))
+	if totalSectors == 0 {
+		totalSectors = int64(le.Uint32(bs[32:]))
+	}
+	fatSectors := int64(le.Uint16(bs[22:]))
+	if fatSectors == 0 {
+		fatSectors = int64(le.Uint32(bs[36:]))
+	}
+	switch bytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil, ErrNotFat
+	}
+	if sectorsPerCluster == 0 || fats == 0 || fatSectors == 0 {
+		return nil, ErrNotFat
+	}
+
+	rootSectors := (rootEntries*dirEntrySize + bytesPerSector - 1) / bytesPerSector
+	dataSector := reserved + fats*fatSectors + rootSectors
+	if totalSectors <= dataSector {
+		return nil, ErrNotFat
+	}
+
+	fs := &Filesystem{
+		r:              r,
+		bytesPerSector: bytesPerSector,
+		clusterSize:    bytesPerSector * sectorsPerCluster,
+		dataStart:      dataSector * bytesPerSector,
+		rootStart:      (reserved + fats*fatSectors) * bytesPerSector,
+		rootSize:       rootSectors * bytesPerSector,
+		clusters:       uint32((totalSectors - dataSector) / sectorsPerCluster),
+	}
+
+	var label []byte
+	switch {
+	case fs.clusters < 4085:
+		fs.Type = "FAT12"
+		label = bs[0x2b : 0x2b+11]
+	case fs.clusters < 65525:
+		fs.Type = "FAT16"
+		label = bs[0x2b : 0x2b+11]
+	default:
+		fs.Type = "FAT32"
+		label = bs[0x47 : 0x47+11]
+		fs.rootCluster = le.Uint32(bs[44:])
+	}
+	if l := strings.TrimRight(string(label), " "); l != "NO NAME" {
+		fs.Label = l
+	}
+
+	fs.fat = make([]byte, fatSectors*bytesPerSector)
+	if _, err := r.ReadAt(fs.fat, reserved*bytesPerSector); err != nil {
+		return nil, fmt.Errorf("cannot read the FAT: %v", err)
+	}
+
+	return fs, nil
+}
+
+// next returns the cluster following c in its chain, and false at the
+// end of the chain.
+func (fs *Filesystem) next(c uint32) (uint32, bool, error) {
+	var n, eoc uint32
+	switch fs.Type {
+	case "FAT12":
+		off := c + c/2
+		if int(off)+2 > len(fs.fat) {
+			return 0, false, fmt.Errorf("cluster %d is outside of the FAT", c)
+		}
+		n = uint32(binary.LittleEndian.Uint16(fs.fat[off:]))
+		if c%2 == 1 {
+			n >>= 4
+		} else {
+			n &= 0xfff
+		}
+		eoc = 0xff8
+	case "FAT16":
+		if int(2*c)+2 > len(fs.fat) {
+			return 0, false, fmt.Errorf("cluster %d is outside of the FAT", c)
+		}
+		n = uint32(binary.LittleEndian.Uint16(fs.fat[2*c:]))
+		eoc = 0xfff8
+	default:
+		if int(4*c)+4 > len(fs.fat) {
+			return 0, false, fmt.Errorf("cluster %d is outside of the FAT", c)
+		}
+		n = binary.LittleEndian.Uint32(fs.fat[4*c:]) & 0x0fffffff
+		eoc = 0x0ffffff8
+	}
+
+	switch {
+	case n >= eoc:
+		return 0, false, nil
+	case n < 2 || n >= fs.clusters+2:
+		return 0, false, fmt.Errorf("bad cluster %#x after cluster %d", n, c)
+	}
+
+	return n, true, nil
+}
+
+// chain returns the clusters of the chain starting at first.
+func (fs *Filesystem) chain(first uint32) ([]uint32, error) {
+	if first == 0 {
+		return nil, nil
+	}
+
+	chain := []uint32{first}
+	for c := first; ; {
+		n, ok, err := fs.next(c)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return chain, nil
+		}
+		if uint32(len(chain)) > fs.clusters {
+			return nil, fmt.Errorf("cluster chain at %d loops", first)
+		}
+		chain = append(chain, n)
+		c = n
+	}
+}
+
+func (fs *Filesystem) clusterOffset(c uint32) int64 {
+	return fs.dataStart + int64(c-2)*fs.clusterSize
+}
+
+// fileInfo implements os.FileInfo for directory entries.
+type fileInfo struct {
+	name    string
+	size    int64
+	attr    byte
+	modTime time.Time
+	cluster uint32
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.attr&attrDirectory != 0 }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+func (fi *fileInfo) Mode() os.FileMode {
+	mode := os.FileMode(0644)
+	if fi.attr&attrReadOnly != 0 {
+		mode = 0444
+	}
+	if fi.IsDir() {
+		mode |= os.ModeDir | 0111
+	}
+
+	return mode
+}
+
+// readRoot returns the raw entries of the root directory.
+func (fs *Filesystem) readRoot() ([]byte, error) {
+	if fs.Type == "FAT32" {
+		return fs.readChain(fs.rootCluster, -1)
+	}
+
+	b := make([]byte, fs.rootSize)
+	_, err := fs.r.ReadAt(b, fs.rootStart)
+
+	return b, err
+}
+
+// readChain reads the clusters of the chain at first, up to size bytes or
+// all of them when size is negative.
+func (fs *Filesystem) readChain(first uint32, size int64) ([]byte, error) {
+	chain, err := fs.chain(first)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for _, c := range chain {
+		b := make([]byte, fs.clusterSize)
+		if _, err := fs.r.ReadAt(b, fs.clusterOffset(c)); err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+	}
+	b := buf.Bytes()
+	if size >= 0 && int64(len(b)) > size {
+		b = b[:size]
+	}
+
+	return b, nil
+}
+
+// parseDir decodes the raw entries of a directory, long names included,
+// skipping "." and "..".
+func parseDir(b []byte) []*fileInfo {
+	var entries []*fileInfo
+	var long []uint16
+	var sum byte
+	for i := 0; i+dirEntrySize <= len(b); i += dirEntrySize {
+		e := b[i : i+dirEntrySize]
+		switch {
+		case e[0] == 0:
+			return entries
+		case e[0] == deletedEntry:
+			long = nil
+			continue
+		case e[11]&attrLongName == attrLongName:
+			if e[0]&0x40 != 0 {
+				long = nil
+				sum = e[13]
+			}
+			var part []uint16
+			for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+				for j := r[0]; j < r[1]; j += 2 {
+					part = append(part, binary.LittleEndian.Uint16(e[j:]))
+				}
+			}
+			// the parts come last one first
+			long = append(part, long...)
+			continue
+		case e[11]&attrVolumeID != 0:
+			long = nil
+			continue
+		}
+
+		name := shortName(e)
+		if long != nil && checksum(e[:11]) == sum {
+			for j, u := range long {
+				if u == 0 {
+					long = long[:j]
+					break
+				}
+			}
+			name = string(utf16.Decode(long))
+		}
+		long = nil
+		if name == "." || name == ".." {
+			continue
+		}
+
+		le := binary.LittleEndian
+		entries = append(entries, &fileInfo{
+			name:    name,
+			size:    int64(le.Uint32(e[28:])),
+			attr:    e[11],
+			modTime: dosTime(le.Uint16(e[24:]), le.Uint16(e[22:])),
+			cluster: uint32(le.Uint16(e[20:]))<<16 | uint32(le.Uint16(e[26:])),
+		})
+	}
+
+	return entries
+}
+
+func shortName(e []byte) string {
+	base := strings.TrimRight(string(e[0:8]), " ")
+	ext := strings.TrimRight(string(e[8:11]), " ")
+	if base != "" && base[0] == 0x05 {
+		base = "\xe5" + base[1:]
+	}
+	if e[12]&lowerBase != 0 {
+		base = strings.ToLower(base)
+	}
+	if e[12]&lowerExt != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+
+	return base + "." + ext
+}
+
+func checksum(name []byte) byte {
+	var sum byte
+	for _, c := range name {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+
+	return sum
+}
+
+func dosTime(date, t uint16) time.Time {
+	return time.Date(int(date>>9)+1980, time.Month(date>>5&0xf), int(date&0x1f),
+		int(t>>11), int(t>>5&0x3f), int(t&0x1f)*2, 0, time.UTC)
+}
+
+// readDir returns the entries of the directory dir, nil for the root.
+func (fs *Filesystem) readDir(dir *fileInfo) ([]*fileInfo, error) {
+	var b []byte
+	var err error
+	if dir == nil {
+		b, err = fs.readRoot()
+	} else {
+		b, err = fs.readChain(dir.cluster, -1)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseDir(b), nil
+}
+
+// lookup finds name, matching the names without regard to case as FAT
+// does. It returns nil for the root directory.
+func (fs *Filesystem) lookup(name string) (*fileInfo, error) {
+	var cur *fileInfo
+	for _, part := range strings.Split(path.Clean("/" + name)[1:], "/") {
+		if part == "" {
+			continue
+		}
+		if cur != nil && !cur.IsDir() {
+			return nil, &os.PathError{Op: "lookup", Path: name, Err: errors.New("not a directory")}
+		}
+
+		entries, err := fs.readDir(cur)
+		if err != nil {
+			return nil, err
+		}
+		var found *fileInfo
+		for _, e := range entries {
+			if strings.EqualFold(e.name, part) {
+				found = e
+				break
+			}
+		}
+		if found == nil {
+			return nil, &os.PathError{Op: "lookup", Path: name, Err: os.ErrNotExist}
+		}
+		cur = found
+	}
+
+	return cur, nil
+}
+
+// Stat returns the file information of name.
+func (fs *Filesystem) Stat(name string) (os.FileInfo, error) {
+	fi, err := fs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi == nil {
+		return &fileInfo{name: "/", attr: attrDirectory}, nil
+	}
+
+	return fi, nil
+}
+
+// ReadDir returns the entries of the directory name sorted by file name.
+func (fs *Filesystem) ReadDir(name string) ([]os.FileInfo, error) {
+	dir, err := fs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if dir != nil && !dir.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	entries, err := fs.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, len(entries))
+	for i, e := range entries {
+		infos[i] = e
+	}
+	sort.Sort(byName(infos))
+
+	return infos, nil
+}
+
+type byName []os.FileInfo
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Less(i, j int) bool { return b[i].Name() < b[j].Name() }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// File is an open regular file of the file system.
+type File struct {
+	fs       *Filesystem
+	info     *fileInfo
+	clusters []uint32
+	off      int64
+}
+
+// Open opens the regular file name for reading.
+func (fs *Filesystem) Open(name string) (*File, error) {
+	fi, err := fs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi == nil || fi.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+
+	clusters, err := fs.chain(fi.cluster)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	if int64(len(clusters))*fs.clusterSize < fi.size {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("cluster chain shorter than the file")}
+	}
+
+	return &File{fs: fs, info: fi, clusters: clusters}, nil
+}
+
+// ReadFile returns the content of the regular file name.
+func (fs *Filesystem) ReadFile(name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, f.Size())
+	if _, err := f.ReadAt(b, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Stat returns the file information of f.
+func (f *File) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// Size returns the size of f.
+func (f *File) Size() int64 {
+	return f.info.size
+}
+
+// Close is a no-op; it exists so File satisfies io.ReadCloser.
+func (f *File) Close() error {
+	return nil
+}
+
+// Read implements io.Reader.
+func (f *File) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	n := 0
+	for n < len(p) && off < f.info.size {
+		c := f.clusters[off/f.fs.clusterSize]
+		in := off % f.fs.clusterSize
+		chunk := p[n:]
+		if max := f.fs.clusterSize - in; int64(len(chunk)) > max {
+			chunk = chunk[:max]
+		}
+		if max := f.info.size - off; int64(len(chunk)) > max {
+			chunk = chunk[:max]
+		}
+		m, err := f.fs.r.ReadAt(chunk, f.fs.clusterOffset(c)+in)
+		n += m
+		off += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
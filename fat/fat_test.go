@@ -0,0 +1,477 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+const testSectorSize = 512
+
+// testFile is a file of a fixture file system: a directory when children
+// is not nil. A short name, "README  TXT", is used as is with the case
+// flags, else the entry gets a generated short name and a long name.
+type testFile struct {
+	name     string
+	short    string
+	lower    byte
+	data     []byte
+	children []*testFile
+
+	cluster uint32
+}
+
+func (f *testFile) isDir() bool {
+	return f.children != nil
+}
+
+// testFat lays out a FAT file system the way mkfs.fat does: reserved
+// sectors, two FATs, the root directory for FAT12 and FAT16, then the
+// clusters.
+type testFat struct {
+	typ               string
+	sectorsPerCluster int64
+	reserved          int64
+	rootEntries       int64
+	fatSectors        int64
+	totalSectors      int64
+	dataStart         int64
+
+	img  []byte
+	fat  []byte
+	next uint32
+}
+
+var modTime = time.Date(2017, 3, 14, 15, 9, 26, 0, time.UTC)
+
+func newTestFat(typ string, totalSectors, sectorsPerCluster int64) *testFat {
+	t := &testFat{typ: typ, sectorsPerCluster: sectorsPerCluster, totalSectors: totalSectors, reserved: 1, rootEntries: 512, next: 2}
+	bits := map[string]int64{"FAT12": 12, "FAT16": 16, "FAT32": 32}[typ]
+	if typ == "FAT32" {
+		t.reserved, t.rootEntries = 32, 0
+	}
+	clusters := totalSectors/sectorsPerCluster + 2
+	t.fatSectors = (clusters*bits/8 + testSectorSize) / testSectorSize
+	t.dataStart = t.reserved + 2*t.fatSectors + t.rootEntries*dirEntrySize/testSectorSize
+	t.img = make([]byte, totalSectors*testSectorSize)
+	t.fat = make([]byte, t.fatSectors*testSectorSize)
+	t.setFat(0, 0x0ffffff8)
+	t.setFat(1, 0x0fffffff)
+
+	return t
+}
+
+func (t *testFat) clusterSize() int64 {
+	return t.sectorsPerCluster * testSectorSize
+}
+
+func (t *testFat) setFat(c, v uint32) {
+	le := binary.LittleEndian
+	switch t.typ {
+	case "FAT12":
+		v &= 0xfff
+		off := c + c/2
+		old := le.Uint16(t.fat[off:])
+		if c%2 == 1 {
+			le.PutUint16(t.fat[off:], old&0x000f|uint16(v)<<4)
+		} else {
+			le.PutUint16(t.fat[off:], old&0xf000|uint16(v))
+		}
+	case "FAT16":
+		le.PutUint16(t.fat[2*c:], uint16(v))
+	default:
+		le.PutUint32(t.fat[4*c:], v&0x0fffffff)
+	}
+}
+
+// alloc writes data to a new cluster chain and returns its first cluster,
+// 0 for no data.
+func (t *testFat) alloc(data []byte) uint32 {
+	if len(data) == 0 {
+		return 0
+	}
+
+	first := t.next
+	for len(data) > 0 {
+		c := t.next
+		t.next++
+		n := copy(t.img[t.dataStart*testSectorSize+int64(c-2)*t.clusterSize():][:t.clusterSize()], data)
+		data = data[n:]
+		if len(data) > 0 {
+			t.setFat(c, c+1)
+		} else {
+			t.setFat(c, 0x0fffffff)
+		}
+	}
+
+	return first
+}
+
+func checksumOf(short string) byte {
+	return checksum([]byte(short))
+}
+
+func dirEntry(short string, attr, lower byte, cluster uint32, size int) []byte {
+	e := make([]byte, dirEntrySize)
+	copy(e, short)
+	e[11], e[12] = attr, lower
+	le := binary.LittleEndian
+	le.PutUint16(e[20:], uint16(cluster>>16))
+	le.PutUint16(e[22:], uint16(modTime.Hour()<<11|modTime.Minute()<<5|modTime.Second()/2))
+	le.PutUint16(e[24:], uint16((modTime.Year()-1980)<<9|int(modTime.Month())<<5|modTime.Day()))
+	le.PutUint16(e[26:], uint16(cluster))
+	le.PutUint32(e[28:], uint32(size))
+
+	return e
+}
+
+// longEntries returns the long name entries of name, last part first.
+func longEntries(name string, sum byte) []byte {
+	u := utf16.Encode([]rune(name))
+	if len(u)%13 != 0 {
+		u = append(u, 0)
+	}
+	for len(u)%13 != 0 {
+		u = append(u, 0xffff)
+	}
+
+	var b []byte
+	parts := len(u) / 13
+	for n := parts; n >= 1; n-- {
+		e := make([]byte, dirEntrySize)
+		e[0] = byte(n)
+		if n == parts {
+			e[0] |= 0x40
+		}
+		e[11], e[13] = attrLongName, sum
+		part := u[13*(n-1) : 13*n]
+		i := 0
+		for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+			for j := r[0]; j < r[1]; j += 2 {
+				binary.LittleEndian.PutUint16(e[j:], part[i])
+				i++
+			}
+		}
+		b = append(b, e...)
+	}
+
+	return b
+}
+
+// dirData returns the entries of the directory dir, writing its files.
+func (t *testFat) dirData(dir *testFile, parent uint32, root bool) []byte {
+	var b []byte
+	if !root {
+		b = append(b, dirEntry(".          ", attrDirectory, 0, dir.cluster, 0)...)
+		b = append(b, dirEntry("..         ", attrDirectory, 0, parent, 0)...)
+	}
+	for i, f := range dir.children {
+		short := f.short
+		if short == "" {
+			short = fmt.Sprintf("FILE~%-3d   ", i+1)
+			b = append(b, longEntries(f.name, checksumOf(short))...)
+		}
+		var attr byte
+		size := len(f.data)
+		if f.isDir() {
+			attr, size = attrDirectory, 0
+			// reserve the cluster, the entries of the directory need it
+			f.cluster = t.alloc(make([]byte, 1))
+			t.writeDir(f, dir.cluster)
+		} else {
+			f.cluster = t.alloc(f.data)
+		}
+		b = append(b, dirEntry(short, attr, f.lower, f.cluster, size)...)
+	}
+
+	return b
+}
+
+// writeDir writes the subdirectory dir at its first cluster, growing its
+// chain as needed.
+func (t *testFat) writeDir(dir *testFile, parent uint32) {
+	b := t.dirData(dir, parent, false)
+	first := t.dataStart*testSectorSize + int64(dir.cluster-2)*t.clusterSize()
+	copy(t.img[first:first+t.clusterSize()], b)
+	if rest := b[minInt(len(b), int(t.clusterSize())):]; len(rest) > 0 {
+		t.setFat(dir.cluster, t.alloc(rest))
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// makeFat writes a file system of the given type holding root, with the
+// label in the boot sector and a volume label and deleted entry in the
+// root directory.
+func makeFat(typ string, totalSectors, sectorsPerCluster int64, label string, root *testFile) []byte {
+	t := newTestFat(typ, totalSectors, sectorsPerCluster)
+
+	var rootCluster uint32
+	if typ == "FAT32" {
+		rootCluster = t.alloc(make([]byte, 1))
+		root.cluster = rootCluster
+	}
+	entries := dirEntry(fmt.Sprintf("%-11s", label), attrVolumeID, 0, 0, 0)
+	deleted := dirEntry("GONE    TXT", 0, 0, 0, 0)
+	deleted[0] = deletedEntry
+	entries = append(entries, deleted...)
+	entries = append(entries, t.dirData(root, 0, true)...)
+	if typ == "FAT32" {
+		first := t.dataStart*testSectorSize + int64(rootCluster-2)*t.clusterSize()
+		copy(t.img[first:first+t.clusterSize()], entries)
+		if rest := entries[minInt(len(entries), int(t.clusterSize())):]; len(rest) > 0 {
+			t.setFat(rootCluster, t.alloc(rest))
+		}
+	} else {
+		rootStart := (t.reserved + 2*t.fatSectors) * testSectorSize
+		copy(t.img[rootStart:rootStart+t.rootEntries*dirEntrySize], entries)
+	}
+
+	bs := t.img[:testSectorSize]
+	le := binary.LittleEndian
+	copy(bs, []byte{0xeb, 0x3c, 0x90})
+	copy(bs[3:], "mkfs.fat")
+	le.PutUint16(bs[11:], testSectorSize)
+	bs[13] = byte(sectorsPerCluster)
+	le.PutUint16(bs[14:], uint16(t.reserved))
+	bs[16] = 2
+	le.PutUint16(bs[17:], uint16(t.rootEntries))
+	bs[21] = 0xf8
+	if totalSectors < 0x10000 {
+		le.PutUint16(bs[19:], uint16(totalSectors))
+	} else {
+		le.PutUint32(bs[32:], uint32(totalSectors))
+	}
+	labelAt := 0x2b
+	if typ == "FAT32" {
+		le.PutUint32(bs[36:], uint32(t.fatSectors))
+		le.PutUint32(bs[44:], rootCluster)
+		labelAt = 0x47
+	} else {
+		le.PutUint16(bs[22:], uint16(t.fatSectors))
+	}
+	copy(bs[labelAt:], fmt.Sprintf("%-11s", label))
+	bs[510], bs[511] = 0x55, 0xaa
+
+	for i := int64(0); i < 2; i++ {
+		copy(t.img[(t.reserved+i*t.fatSectors)*testSectorSize:], t.fat)
+	}
+
+	return t.img
+}
+
+func fill(size int, seed byte) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = seed + byte(i/7)
+	}
+
+	return b
+}
+
+var (
+	kernel  = fill(5000, 1)
+	grubCfg = []byte("set timeout=3\n")
+	uEnv    = []byte("recoverytype=factory_install\n")
+)
+
+// testTree returns the files of the fixture file systems:
+//
+//	EFI/
+//	  boot/
+//	    grubx64.efi
+//	  ubuntu/grub.cfg
+//	readme.txt        (short name, lower case flags)
+//	recovery/factory/ (many long names, more than a cluster of entries)
+//	uEnv.txt
+//	vmlinuz-4.4.0-a-rather-long-name
+//	empty             (no cluster)
+func testTree() *testFile {
+	var factory []*testFile
+	for i := 0; i < 40; i++ {
+		factory = append(factory, &testFile{name: fmt.Sprintf("snap-number-%02d.tar.xz", i), data: []byte{byte(i)}})
+	}
+
+	return &testFile{children: []*testFile{
+		{name: "EFI", short: "EFI        ", children: []*testFile{
+			{name: "boot", children: []*testFile{{name: "grubx64.efi", data: fill(700, 9)}}},
+			{name: "ubuntu", children: []*testFile{{name: "grub.cfg", data: grubCfg}}},
+		}},
+		{name: "readme.txt", short: "README  TXT", lower: lowerBase | lowerExt, data: []byte("hello\n")},
+		{name: "recovery", children: []*testFile{{name: "factory", children: factory}}},
+		{name: "uEnv.txt", data: uEnv},
+		{name: "vmlinuz-4.4.0-a-rather-long-name", data: kernel},
+		{name: "empty", data: nil},
+	}}
+}
+
+// fatTypes are fixtures of each FAT type, the smallest sizes mkfs.fat
+// would pick the type for.
+var fatTypes = []struct {
+	typ               string
+	totalSectors      int64
+	sectorsPerCluster int64
+}{
+	{"FAT12", 2048, 1},
+	{"FAT16", 8192, 1},
+	{"FAT32", 68000, 1},
+}
+
+func openFixture(t *testing.T, typ string, totalSectors, sectorsPerCluster int64) *Filesystem {
+	fs, err := New(bytes.NewReader(makeFat(typ, totalSectors, sectorsPerCluster, "RECOVERY", testTree())))
+	if err != nil {
+		t.Fatalf("%s: %v", typ, err)
+	}
+	if fs.Type != typ || fs.Label != "RECOVERY" {
+		t.Fatalf("got %s %q, want %s RECOVERY", fs.Type, fs.Label, typ)
+	}
+
+	return fs
+}
+
+func TestNotFat(t *testing.T) {
+	if _, err := New(bytes.NewReader(make([]byte, 1024))); err != ErrNotFat {
+		t.Fatalf("got %v, want ErrNotFat", err)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	for _, ft := range fatTypes {
+		fs := openFixture(t, ft.typ, ft.totalSectors, ft.sectorsPerCluster)
+		for _, c := range []struct {
+			name string
+			want []byte
+		}{
+			{"uEnv.txt", uEnv},
+			// FAT names do not care about case
+			{"/UENV.TXT", uEnv},
+			{"efi/ubuntu/grub.cfg", grubCfg},
+			{"vmlinuz-4.4.0-a-rather-long-name", kernel},
+			{"EFI/boot/grubx64.efi", fill(700, 9)},
+			{"recovery/factory/snap-number-39.tar.xz", []byte{39}},
+			{"empty", []byte{}},
+		} {
+			got, err := fs.ReadFile(c.name)
+			if err != nil {
+				t.Errorf("%s %s: %v", ft.typ, c.name, err)
+				continue
+			}
+			if !bytes.Equal(got, c.want) {
+				t.Errorf("%s %s: got %d bytes, want %d", ft.typ, c.name, len(got), len(c.want))
+			}
+		}
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	for _, ft := range fatTypes {
+		fs := openFixture(t, ft.typ, ft.totalSectors, ft.sectorsPerCluster)
+
+		infos, err := fs.ReadDir("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, fi := range infos {
+			names = append(names, fi.Name())
+		}
+		// no volume label, no deleted entry, short names in lower case
+		if got, want := strings.Join(names, " "), "EFI empty readme.txt recovery uEnv.txt vmlinuz-4.4.0-a-rather-long-name"; got != want {
+			t.Errorf("%s: got %q, want %q", ft.typ, got, want)
+		}
+
+		// the entries of factory/ take more than a cluster
+		infos, err = fs.ReadDir("recovery/factory")
+		if err != nil || len(infos) != 40 {
+			t.Fatalf("%s: got %d entries, %v", ft.typ, len(infos), err)
+		}
+		if infos[7].Name() != "snap-number-07.tar.xz" || infos[7].Size() != 1 {
+			t.Errorf("%s: got %s of %d bytes", ft.typ, infos[7].Name(), infos[7].Size())
+		}
+
+		fi, err := fs.Stat("EFI/boot")
+		if err != nil || !fi.IsDir() || fi.Mode()&os.ModeDir == 0 {
+			t.Errorf("%s: Stat(EFI/boot): got %v %v", ft.typ, fi, err)
+		}
+		fi, err = fs.Stat("uEnv.txt")
+		if err != nil || !fi.ModTime().Equal(modTime) {
+			t.Errorf("%s: got %v, want %v", ft.typ, fi.ModTime(), modTime)
+		}
+		if fi, err := fs.Stat("/"); err != nil || !fi.IsDir() {
+			t.Errorf("%s: Stat(/): got %v %v", ft.typ, fi, err)
+		}
+	}
+}
+
+func TestLookupErrors(t *testing.T) {
+	fs := openFixture(t, "FAT16", 8192, 1)
+	for _, name := range []string{"missing", "EFI/missing", "recovery/factory/missing"} {
+		if _, err := fs.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s: got %v, want a not exist error", name, err)
+		}
+	}
+	if _, err := fs.ReadDir("uEnv.txt"); err == nil {
+		t.Errorf("ReadDir of a file should fail")
+	}
+	if _, err := fs.Open("EFI"); err == nil {
+		t.Errorf("Open of a directory should fail")
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	fs := openFixture(t, "FAT12", 2048, 1)
+	f, err := fs.Open("vmlinuz-4.4.0-a-rather-long-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// across clusters
+	buf := make([]byte, 1000)
+	if _, err := f.ReadAt(buf, 300); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, kernel[300:1300]) {
+		t.Errorf("ReadAt does not match")
+	}
+	n, err := f.ReadAt(buf, int64(len(kernel))-10)
+	if n != 10 || err != io.EOF {
+		t.Errorf("got %d %v, want 10 EOF", n, err)
+	}
+
+	all, err := ioutil.ReadAll(f)
+	if err != nil || !bytes.Equal(all, kernel) {
+		t.Errorf("ReadAll: got %d bytes, %v", len(all), err)
+	}
+}
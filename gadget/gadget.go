@@ -0,0 +1,267 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package gadget reads the meta/gadget.yaml of a gadget snap, which
+// describes the volumes, partitions and raw bootloader blobs of an image.
+package gadget
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	SchemaGPT = "gpt"
+	SchemaMBR = "mbr"
+
+	BootloaderGrub  = "grub"
+	BootloaderUBoot = "u-boot"
+
+	RoleMBR        = "mbr"
+	RoleSystemBoot = "system-boot"
+	RoleSystemData = "system-data"
+
+	// TypeBare marks a structure written to the volume without a
+	// partition table entry.
+	TypeBare = "bare"
+
+	// MBRBootCodeSize is the part of the MBR that may hold boot code.
+	MBRBootCodeSize = 440
+
+	defaultFirstOffset = 1024 * 1024
+)
+
+// Size is a byte count written as a number with an optional K, M or G
+// suffix.
+type Size int64
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (s *Size) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	v, err := ParseSize(str)
+	if err != nil {
+		return err
+	}
+	*s = v
+
+	return nil
+}
+
+// ParseSize parses sizes like "440", "1M" or "2G".
+func ParseSize(str string) (Size, error) {
+	str = strings.TrimSpace(str)
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(str, "K"):
+		unit = 1024
+	case strings.HasSuffix(str, "M"):
+		unit = 1024 * 1024
+	case strings.HasSuffix(str, "G"):
+		unit = 1024 * 1024 * 1024
+	}
+	if unit != 1 {
+		str = str[:len(str)-1]
+	}
+
+	v, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", str)
+	}
+
+	return Size(v * unit), nil
+}
+
+// Content is an entry of the content: list of a structure.
+type Content struct {
+	Image  string
+	Offset *Size
+	Size   Size
+	Source string
+	Target string
+}
+
+// Structure is a partition or raw blob of a volume.
+type Structure struct {
+	Name        string
+	Label       string `yaml:"filesystem-label"`
+	Offset      *Size
+	OffsetWrite string `yaml:"offset-write"`
+	Size        Size
+	Type        string
+	Role        string
+	ID          string
+	Filesystem  string
+	Content     []Content
+}
+
+// EffectiveRole returns the role of the structure, deriving it from the
+// file system label or the type for gadgets that predate roles.
+func (s *Structure) EffectiveRole() string {
+	switch {
+	case s.Role != "":
+		return s.Role
+	case s.Type == RoleMBR:
+		return RoleMBR
+	case s.Label == RoleSystemBoot:
+		return RoleSystemBoot
+	case s.Label == "writable":
+		return RoleSystemData
+	}
+
+	return ""
+}
+
+// IsPartition tells whether the structure gets a partition table entry.
+func (s *Structure) IsPartition() bool {
+	return s.Type != TypeBare && s.Type != RoleMBR && s.EffectiveRole() != RoleMBR
+}
+
+// Volume is an entry of the volumes: map.
+type Volume struct {
+	Schema     string
+	Bootloader string
+	ID         string
+	Structure  []Structure
+}
+
+// EffectiveSchema returns the partitioning schema, gpt by default.
+func (v *Volume) EffectiveSchema() string {
+	if v.Schema == "" {
+		return SchemaGPT
+	}
+
+	return v.Schema
+}
+
+// LaidOutStructure is a structure placed on the volume.
+type LaidOutStructure struct {
+	*Structure
+	// Start is the offset of the structure from the start of the volume.
+	Start int64
+	// Number is the partition number, 0 for raw structures.
+	Number int
+}
+
+// End returns the offset of the first byte after the structure.
+func (ls *LaidOutStructure) End() int64 {
+	return ls.Start + int64(ls.Size)
+}
+
+// LayOut places the structures of the volume the way snapd does:
+// structures without an offset follow the previous one and the first
+// regular structure starts at 1M.
+func (v *Volume) LayOut() []LaidOutStructure {
+	var laidOut []LaidOutStructure
+	var next int64
+	nr := 0
+	for i := range v.Structure {
+		s := &v.Structure[i]
+		start := next
+		switch {
+		case s.Offset != nil:
+			start = int64(*s.Offset)
+		case s.EffectiveRole() == RoleMBR:
+			start = 0
+		case start < defaultFirstOffset:
+			start = defaultFirstOffset
+		}
+
+		ls := LaidOutStructure{Structure: s, Start: start}
+		if s.IsPartition() {
+			nr++
+			ls.Number = nr
+		}
+		laidOut = append(laidOut, ls)
+		next = ls.End()
+	}
+
+	return laidOut
+}
+
+// Role returns the first laid out structure with the given role.
+func (v *Volume) Role(role string) *LaidOutStructure {
+	for _, ls := range v.LayOut() {
+		if ls.EffectiveRole() == role {
+			return &ls
+		}
+	}
+
+	return nil
+}
+
+// Info is the content of gadget.yaml.
+type Info struct {
+	DeviceTree string `yaml:"device-tree"`
+	Volumes    map[string]*Volume
+}
+
+// Read parses gadget.yaml.
+func Read(b []byte) (*Info, error) {
+	var info Info
+	if err := yaml.Unmarshal(b, &info); err != nil {
+		return nil, fmt.Errorf("cannot parse gadget.yaml: %v", err)
+	}
+	if len(info.Volumes) == 0 {
+		return nil, fmt.Errorf("gadget.yaml defines no volumes")
+	}
+
+	for name, v := range info.Volumes {
+		switch v.EffectiveSchema() {
+		case SchemaGPT, SchemaMBR:
+		default:
+			return nil, fmt.Errorf("volume %s: unsupported schema %q", name, v.Schema)
+		}
+		switch v.Bootloader {
+		case "", BootloaderGrub, BootloaderUBoot:
+		default:
+			return nil, fmt.Errorf("volume %s: unsupported bootloader %q", name, v.Bootloader)
+		}
+	}
+
+	return &info, nil
+}
+
+// Volume returns the volume holding the bootloader, which is the one the
+// image is written to.
+func (info *Info) Volume() (string, *Volume, error) {
+	var names []string
+	for name, v := range info.Volumes {
+		if v.Bootloader != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	switch len(names) {
+	case 0:
+		return "", nil, fmt.Errorf("gadget.yaml declares no bootloader")
+	case 1:
+		return names[0], info.Volumes[names[0]], nil
+	}
+
+	return "", nil, fmt.Errorf("gadget.yaml declares a bootloader on several volumes: %s", strings.Join(names, ", "))
+}
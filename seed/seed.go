@@ -0,0 +1,446 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package seed reads the snapd seed (var/lib/snapd/seed) of an image:
+// seed.yaml, the snaps it lists and the assertions shipped next to them.
+package seed
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/snapd/asserts"
+	"gopkg.in/yaml.v2"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/snap"
+)
+
+const (
+	SeedYaml      = "seed.yaml"
+	SnapsDir      = "snaps"
+	AssertionsDir = "assertions"
+)
+
+// Snap types as found in meta/snap.yaml.
+const (
+	TypeApp    = "app"
+	TypeKernel = "kernel"
+	TypeGadget = "gadget"
+	TypeOS     = "os"
+	TypeCore   = "core"
+)
+
+// Snap is an entry of seed.yaml completed with the metadata of the snap
+// file it points to.
+type Snap struct {
+	Name       string `yaml:"name"`
+	SnapID     string `yaml:"snap-id,omitempty"`
+	Channel    string `yaml:"channel,omitempty"`
+	File       string `yaml:"file"`
+	DevMode    bool   `yaml:"devmode,omitempty"`
+	Unasserted bool   `yaml:"unasserted,omitempty"`
+
+	// Path is the absolute location of File.
+	Path string `yaml:"-"`
+	// Type and Version come from meta/snap.yaml.
+	Type    string `yaml:"-"`
+	Version string `yaml:"-"`
+	// Revision is taken from the file name (name_<revision>.snap).
+	Revision string `yaml:"-"`
+}
+
+func (s *Snap) String() string {
+	return fmt.Sprintf("%s (type %s, revision %s, file %s)", s.Name, s.Type, s.Revision, s.File)
+}
+
+// IsCore reports whether s is the core (os) snap.
+func (s *Snap) IsCore() bool {
+	return s.Type == TypeOS || s.Type == TypeCore
+}
+
+type seedYaml struct {
+	Snaps []*Snap `yaml:"snaps"`
+}
+
+// Seed is a parsed seed directory.
+type Seed struct {
+	Dir   string
+	Snaps []*Snap
+	// Assertions holds every assertion found below assertions/.
+	Assertions []asserts.Assertion
+}
+
+// Open reads seed.yaml in dir and the meta/snap.yaml of every snap it
+// lists.
+func Open(dir string) (*Seed, error) {
+	s, err := ReadYaml(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sn := range s.Snaps {
+		if err := ReadSnapInfo(sn); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// ReadYaml reads seed.yaml and the assertions in dir without opening the
+// snap files, which need not be there: the snaps only carry what
+// seed.yaml says, no type, version nor revision.
+func ReadYaml(dir string) (*Seed, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, SeedYaml))
+	if err != nil {
+		return nil, err
+	}
+
+	var y seedYaml
+	if err := yaml.Unmarshal(b, &y); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %v", filepath.Join(dir, SeedYaml), err)
+	}
+
+	s := &Seed{Dir: dir}
+	for _, sn := range y.Snaps {
+		sn.Path = filepath.Join(dir, SnapsDir, sn.File)
+		s.Snaps = append(s.Snaps, sn)
+	}
+
+	if s.Assertions, err = readAssertions(filepath.Join(dir, AssertionsDir)); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ReadSnapInfo completes sn with the name, type and version found in the
+// meta/snap.yaml of sn.Path, and the revision encoded in its file name.
+func ReadSnapInfo(sn *Snap) error {
+	pkg, err := snap.Open(sn.Path)
+	if err != nil {
+		return err
+	}
+	defer pkg.Close()
+
+	info, err := pkg.Info()
+	if err != nil {
+		return err
+	}
+
+	if sn.Name != "" && sn.Name != info.Name {
+		return fmt.Errorf("%s is listed as %q but its snap.yaml names it %q", sn.Path, sn.Name, info.Name)
+	}
+	sn.Name, sn.Type, sn.Version = info.Name, info.Type, info.Version
+	if sn.File == "" {
+		sn.File = filepath.Base(sn.Path)
+	}
+	sn.Revision = revisionFromFile(sn.Name, sn.File)
+
+	return nil
+}
+
+// revisionFromFile extracts the revision from a <name>_<revision>.snap
+// file name, or returns "" when the file does not follow the convention.
+func revisionFromFile(name, file string) string {
+	base := strings.TrimSuffix(filepath.Base(file), ".snap")
+	if !strings.HasPrefix(base, name+"_") {
+		return ""
+	}
+
+	return strings.TrimPrefix(base, name+"_")
+}
+
+func readAssertions(dir string) ([]asserts.Assertion, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var all []asserts.Assertion
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		as, err := DecodeAssertions(b)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode assertions in %s: %v", filepath.Join(dir, fi.Name()), err)
+		}
+		all = append(all, as...)
+	}
+
+	return all, nil
+}
+
+// DecodeAssertions decodes a stream of assertions, as found in seed
+// assertion files or in the .assert files written by "snap download".
+func DecodeAssertions(b []byte) ([]asserts.Assertion, error) {
+	var all []asserts.Assertion
+	dec := asserts.NewDecoder(bytes.NewReader(b))
+	for {
+		a, err := dec.Decode()
+		if err == io.EOF {
+			return all, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, a)
+	}
+}
+
+// Model returns the model assertion of the seed, or nil if the seed does
+// not carry one.
+func (s *Seed) Model() *asserts.Model {
+	for _, a := range s.Assertions {
+		if m, ok := a.(*asserts.Model); ok {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// AddAssertions adds assertions to the seed, skipping the ones it
+// already carries.
+func (s *Seed) AddAssertions(as ...asserts.Assertion) {
+	for _, a := range as {
+		enc := asserts.Encode(a)
+		known := false
+		for _, b := range s.Assertions {
+			if bytes.Equal(enc, asserts.Encode(b)) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			s.Assertions = append(s.Assertions, a)
+		}
+	}
+}
+
+// SnapAssertions returns the assertions needed to check sn on its own:
+// its snap-declaration and snap-revision, and the account and account-key
+// assertions of the seed. It returns nothing for unasserted snaps.
+func (s *Seed) SnapAssertions(sn *Snap) ([]asserts.Assertion, error) {
+	digest, _, err := SnapFileDigest(sn.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rev *asserts.SnapRevision
+	for _, a := range s.Assertions {
+		if r, ok := a.(*asserts.SnapRevision); ok && r.SnapSHA3_384() == digest {
+			rev = r
+		}
+	}
+	if rev == nil {
+		return nil, nil
+	}
+
+	found := []asserts.Assertion{rev}
+	for _, a := range s.Assertions {
+		switch a := a.(type) {
+		case *asserts.SnapDeclaration:
+			if a.SnapID() == rev.SnapID() {
+				found = append(found, a)
+			}
+		case *asserts.Account, *asserts.AccountKey:
+			found = append(found, a)
+		}
+	}
+
+	return found, nil
+}
+
+// ModelAssertions returns the model assertion of the seed with the
+// account and account-key assertions of its brand, what a database needs
+// to accept the model.
+func (s *Seed) ModelAssertions() []asserts.Assertion {
+	model := s.Model()
+	if model == nil {
+		return nil
+	}
+
+	found := []asserts.Assertion{model}
+	for _, a := range s.Assertions {
+		switch a := a.(type) {
+		case *asserts.Account:
+			if a.AccountID() == model.BrandID() {
+				found = append(found, a)
+			}
+		case *asserts.AccountKey:
+			if a.AccountID() == model.BrandID() {
+				found = append(found, a)
+			}
+		}
+	}
+
+	return found
+}
+
+// Replace swaps the seed snap old for sn, keeping its position in
+// seed.yaml.
+func (s *Seed) Replace(old, sn *Snap) {
+	for i, c := range s.Snaps {
+		if c == old {
+			s.Snaps[i] = sn
+		}
+	}
+}
+
+// WriteAssertions writes all the seed assertions as one stream to path.
+func (s *Seed) WriteAssertions(path string) error {
+	var b bytes.Buffer
+	enc := asserts.NewEncoder(&b)
+	for _, a := range s.Assertions {
+		if err := enc.Encode(a); err != nil {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(path, b.Bytes(), 0644)
+}
+
+// WriteYaml writes the seed.yaml describing the current snaps to path.
+func (s *Seed) WriteYaml(path string) error {
+	b, err := yaml.Marshal(&seedYaml{Snaps: s.Snaps})
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// ByName returns the seed snaps called name.
+func (s *Seed) ByName(name string) []*Snap {
+	return filter(s.Snaps, func(sn *Snap) bool { return sn.Name == name })
+}
+
+// ByType returns the seed snaps of the given type; TypeOS and TypeCore
+// are treated alike.
+func (s *Seed) ByType(typ string) []*Snap {
+	core := typ == TypeOS || typ == TypeCore
+
+	return filter(s.Snaps, func(sn *Snap) bool { return sn.Type == typ || core && sn.IsCore() })
+}
+
+// AmbiguousError is returned by Resolve when several snaps qualify.
+type AmbiguousError struct {
+	What       string
+	Candidates []*Snap
+}
+
+func (e *AmbiguousError) Error() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "more than one %s snap in the seed, candidates:", e.What)
+	for _, c := range e.Candidates {
+		fmt.Fprintf(&b, "\n  - %s", c)
+	}
+
+	return b.String()
+}
+
+// NotFoundError is returned by Resolve when no snap of the requested type
+// carries the requested name.
+type NotFoundError struct {
+	What       string
+	Name       string
+	Candidates []*Snap
+}
+
+func (e *NotFoundError) Error() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s snap %q not found in the seed, candidates:", e.What, e.Name)
+	for _, c := range e.Candidates {
+		fmt.Fprintf(&b, "\n  - %s", c)
+	}
+
+	return b.String()
+}
+
+// Resolve finds the single seed snap of type typ. want narrows the
+// candidates and may be empty, a snap name ("pc-kernel") or a snap file
+// name ("pc-kernel_33.snap"); the revision of a file name is used to pick
+// between several revisions of the same snap.
+func (s *Seed) Resolve(typ, want string) (*Snap, error) {
+	candidates := s.ByType(typ)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no %s snap in the seed %s", typ, s.Dir)
+	}
+
+	name, revision := SplitWant(want)
+	if name != "" {
+		named := filter(candidates, func(c *Snap) bool { return c.Name == name })
+		if len(named) == 0 {
+			return nil, &NotFoundError{What: typ, Name: want, Candidates: candidates}
+		}
+		candidates = named
+	}
+	if revision != "" && len(candidates) > 1 {
+		if pinned := filter(candidates, func(c *Snap) bool { return c.Revision == revision }); len(pinned) > 0 {
+			candidates = pinned
+		}
+	}
+
+	if len(candidates) > 1 {
+		return nil, &AmbiguousError{What: typ, Candidates: candidates}
+	}
+
+	return candidates[0], nil
+}
+
+// SplitWant splits what Resolve is asked for into a snap name and, for a
+// snap file name, its revision.
+func SplitWant(want string) (name, revision string) {
+	if !strings.HasSuffix(want, ".snap") {
+		return want, ""
+	}
+
+	base := strings.TrimSuffix(filepath.Base(want), ".snap")
+	if i := strings.LastIndex(base, "_"); i > 0 {
+		return base[:i], base[i+1:]
+	}
+
+	return base, ""
+}
+
+func filter(snaps []*Snap, keep func(*Snap) bool) []*Snap {
+	var kept []*Snap
+	for _, sn := range snaps {
+		if keep(sn) {
+			kept = append(kept, sn)
+		}
+	}
+
+	return kept
+}
@@ -0,0 +1,245 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package seed
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testSeedYaml = `snaps:
+  - name: core
+    file: core_100.snap
+  - name: pc-kernel
+    file: pc-kernel_33.snap
+  - name: pc-kernel
+    file: pc-kernel_35.snap
+  - name: other-kernel
+    file: other-kernel_1.snap
+  - name: pc
+    file: pc_20.snap
+  - name: hello
+    file: hello_5.snap
+`
+
+var testSnapTypes = map[string]string{
+	"core":         "os",
+	"pc-kernel":    "kernel",
+	"other-kernel": "kernel",
+	"pc":           "gadget",
+	"hello":        "",
+}
+
+// writeSnap writes a snap package holding only meta/snap.yaml to file: a
+// squashfs 4.0 image with the metadata and the file data stored
+// uncompressed.
+func writeSnap(t *testing.T, file, snapYaml string) {
+	le := binary.LittleEndian
+	var img bytes.Buffer
+	img.Write(make([]byte, 96))
+	blocksStart := uint32(img.Len())
+	img.WriteString(snapYaml)
+
+	// inode 1 is meta/snap.yaml, 2 meta and 3 the root directory
+	var inodes, dirs bytes.Buffer
+	binary.Write(&inodes, le, []uint16{2, 0644, 0, 0})
+	binary.Write(&inodes, le, []uint32{0, 1, blocksStart, 0xffffffff, 0, uint32(len(snapYaml)), uint32(len(snapYaml)) | 1<<24})
+	dirEntry := func(inodeOffset int, number uint32, typ uint16, name string) int {
+		binary.Write(&dirs, le, []uint32{0, 0, number})
+		binary.Write(&dirs, le, []uint16{uint16(inodeOffset), 0, typ, uint16(len(name) - 1)})
+		dirs.WriteString(name)
+		return 12 + 8 + len(name)
+	}
+	dirInode := func(number uint32, listing, dirOffset int) {
+		binary.Write(&inodes, le, []uint16{1, 0755, 0, 0})
+		binary.Write(&inodes, le, []uint32{0, number, 0, 2})
+		binary.Write(&inodes, le, []uint16{uint16(listing + 3), uint16(dirOffset)})
+		binary.Write(&inodes, le, uint32(0))
+	}
+	metaInode := inodes.Len()
+	dirInode(2, dirEntry(0, 1, 2, "snap.yaml"), 0)
+	rootInode, rootDir := inodes.Len(), dirs.Len()
+	dirInode(3, dirEntry(metaInode, 2, 1, "meta"), rootDir)
+
+	sb := struct {
+		Magic, InodeCount, ModTime, BlockSize, FragmentCount            uint32
+		Compression, BlockLog, Flags, IDCount, Major, Minor             uint16
+		RootInode, BytesUsed, IDTable, XattrTable, InodeTable, DirTable uint64
+		FragmentTable, ExportTable                                      uint64
+	}{
+		Magic: 0x73717368, InodeCount: 3, BlockSize: 4096, Compression: 1, BlockLog: 12,
+		Flags: 0x0010, IDCount: 1, Major: 4, RootInode: uint64(rootInode),
+		XattrTable: ^uint64(0), FragmentTable: ^uint64(0), ExportTable: ^uint64(0),
+	}
+	for _, table := range []struct {
+		start *uint64
+		b     []byte
+	}{{&sb.InodeTable, inodes.Bytes()}, {&sb.DirTable, dirs.Bytes()}} {
+		*table.start = uint64(img.Len())
+		binary.Write(&img, le, uint16(len(table.b))|0x8000)
+		img.Write(table.b)
+	}
+	sb.IDTable, sb.BytesUsed = uint64(img.Len()), uint64(img.Len())
+
+	b := img.Bytes()
+	var head bytes.Buffer
+	binary.Write(&head, le, sb)
+	copy(b, head.Bytes())
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testSeed writes the seed of testSeedYaml to a temporary directory and
+// opens it.
+func testSeed(t *testing.T) (*Seed, string) {
+	dir, err := ioutil.TempDir("", "seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, SnapsDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, SeedYaml), []byte(testSeedYaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := ReadYaml(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sn := range s.Snaps {
+		snapYaml := fmt.Sprintf("name: %s\nversion: \"1.0\"\n", sn.Name)
+		if typ := testSnapTypes[sn.Name]; typ != "" {
+			snapYaml += "type: " + typ + "\n"
+		}
+		writeSnap(t, sn.Path, snapYaml)
+	}
+
+	if s, err = Open(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	return s, dir
+}
+
+func TestOpen(t *testing.T) {
+	s, dir := testSeed(t)
+	defer os.RemoveAll(dir)
+
+	if len(s.Snaps) != 6 {
+		t.Fatalf("got %d snaps, want 6", len(s.Snaps))
+	}
+	sn := s.Snaps[2]
+	if sn.Name != "pc-kernel" || sn.Type != TypeKernel || sn.Version != "1.0" || sn.Revision != "35" {
+		t.Errorf("got %s version %s", sn, sn.Version)
+	}
+	if hello := s.Snaps[5]; hello.Type != TypeApp {
+		t.Errorf("got type %q for a snap without one, want %q", hello.Type, TypeApp)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	s, dir := testSeed(t)
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		typ, want string
+		file      string
+	}{
+		// by type
+		{TypeGadget, "", "pc_20.snap"},
+		{TypeOS, "", "core_100.snap"},
+		{TypeCore, "", "core_100.snap"},
+		// by name or file
+		{TypeKernel, "other-kernel", "other-kernel_1.snap"},
+		{TypeKernel, "pc-kernel_33.snap", "pc-kernel_33.snap"},
+		{TypeKernel, "/tmp/pc-kernel_35.snap", "pc-kernel_35.snap"},
+		{TypeGadget, "pc", "pc_20.snap"},
+	} {
+		sn, err := s.Resolve(c.typ, c.want)
+		if err != nil {
+			t.Errorf("%s %q: %v", c.typ, c.want, err)
+			continue
+		}
+		if sn.File != c.file {
+			t.Errorf("%s %q: got %s, want %s", c.typ, c.want, sn.File, c.file)
+		}
+	}
+}
+
+func TestResolveAmbiguous(t *testing.T) {
+	s, dir := testSeed(t)
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		want       string
+		candidates int
+	}{
+		{"", 3},
+		{"pc-kernel", 2},
+		// an unknown revision does not narrow the candidates
+		{"pc-kernel_34.snap", 2},
+	} {
+		_, err := s.Resolve(TypeKernel, c.want)
+		amb, ok := err.(*AmbiguousError)
+		if !ok {
+			t.Errorf("%q: got %v, want an AmbiguousError", c.want, err)
+			continue
+		}
+		if amb.What != TypeKernel || len(amb.Candidates) != c.candidates {
+			t.Errorf("%q: got %s, want %d candidates", c.want, amb, c.candidates)
+		}
+	}
+}
+
+func TestResolveNotFound(t *testing.T) {
+	s, dir := testSeed(t)
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		typ, want  string
+		candidates int
+	}{
+		// hello is an app snap, not a kernel
+		{TypeKernel, "hello", 3},
+		{TypeGadget, "pc-kernel_33.snap", 1},
+		{TypeOS, "ubuntu-core", 1},
+	} {
+		_, err := s.Resolve(c.typ, c.want)
+		nf, ok := err.(*NotFoundError)
+		if !ok {
+			t.Errorf("%s %q: got %v, want a NotFoundError", c.typ, c.want, err)
+			continue
+		}
+		if nf.What != c.typ || nf.Name != c.want || len(nf.Candidates) != c.candidates {
+			t.Errorf("%s %q: got %s, want %d candidates", c.typ, c.want, nf, c.candidates)
+		}
+	}
+
+	// no snap of the type at all is a plain error
+	if _, err := s.Resolve("base", ""); err == nil {
+		t.Errorf("base: no error")
+	}
+}
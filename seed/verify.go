@@ -0,0 +1,183 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package seed
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/sysdb"
+	"golang.org/x/crypto/sha3"
+)
+
+const series = "16"
+
+// SnapFileDigest returns the SHA3-384 digest of the snap file at path, in
+// the encoding used by snap-revision assertions, and its size.
+func SnapFileDigest(path string) (string, uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha3.New384()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)), uint64(size), nil
+}
+
+// Database returns an assertion database, rooted in the trusted
+// assertions of snapd, holding the seed assertions. Assertions are added
+// in dependency order regardless of the order of the seed files.
+func (s *Seed) Database() (*asserts.Database, error) {
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore: asserts.NewMemoryBackstore(),
+		Trusted:   sysdb.Trusted(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pending := s.Assertions
+	for len(pending) > 0 {
+		var failed []asserts.Assertion
+		var lastErr error
+		for _, a := range pending {
+			if err := db.Add(a); err != nil {
+				failed = append(failed, a)
+				lastErr = err
+			}
+		}
+		if len(failed) == len(pending) {
+			return nil, fmt.Errorf("cannot add %d seed assertion(s) to the database: %v", len(failed), lastErr)
+		}
+		pending = failed
+	}
+
+	return db, nil
+}
+
+// VerifyError lists every seed snap that failed verification.
+type VerifyError struct {
+	Problems []string
+}
+
+func (e *VerifyError) Error() string {
+	var b bytes.Buffer
+	b.WriteString("seed verification failed:")
+	for _, p := range e.Problems {
+		fmt.Fprintf(&b, "\n  - %s", p)
+	}
+
+	return b.String()
+}
+
+// Verify checks that the seed carries a valid model assertion and that
+// every snap matches, by SHA3-384 digest and size, a snap-revision
+// assertion belonging to its snap-declaration. Snaps without a snap-id
+// are unasserted and only accepted when allowUnasserted is set.
+func (s *Seed) Verify(allowUnasserted bool) error {
+	db, err := s.Database()
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	if s.Model() == nil {
+		problems = append(problems, "no model assertion in the seed")
+	}
+
+	for _, sn := range s.Snaps {
+		if err := verifySnap(db, sn); err != nil {
+			if _, ok := err.(unassertedError); ok && allowUnasserted {
+				continue
+			}
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return &VerifyError{Problems: problems}
+	}
+
+	return nil
+}
+
+type unassertedError struct {
+	sn *Snap
+}
+
+func (e unassertedError) Error() string {
+	return fmt.Sprintf("%s is unasserted", e.sn)
+}
+
+func verifySnap(db *asserts.Database, sn *Snap) error {
+	digest, size, err := SnapFileDigest(sn.Path)
+	if err != nil {
+		return err
+	}
+
+	a, err := db.Find(asserts.SnapRevisionType, map[string]string{
+		"snap-sha3-384": digest,
+	})
+	if err == asserts.ErrNotFound {
+		if sn.SnapID == "" || sn.Unasserted {
+			return unassertedError{sn}
+		}
+		return fmt.Errorf("%s does not match any snap-revision assertion (digest %s): tampered or unasserted", sn, digest)
+	}
+	if err != nil {
+		return err
+	}
+
+	rev := a.(*asserts.SnapRevision)
+	if rev.SnapSize() != size {
+		return fmt.Errorf("%s has size %d, its snap-revision assertion expects %d", sn, size, rev.SnapSize())
+	}
+	if sn.SnapID != "" && rev.SnapID() != sn.SnapID {
+		return fmt.Errorf("%s is listed with snap-id %s but its snap-revision assertion belongs to %s", sn, sn.SnapID, rev.SnapID())
+	}
+
+	a, err = db.Find(asserts.SnapDeclarationType, map[string]string{
+		"series":  series,
+		"snap-id": rev.SnapID(),
+	})
+	if err == asserts.ErrNotFound {
+		return fmt.Errorf("%s has no snap-declaration for snap-id %s", sn, rev.SnapID())
+	}
+	if err != nil {
+		return err
+	}
+
+	decl := a.(*asserts.SnapDeclaration)
+	if decl.SnapName() != sn.Name {
+		return fmt.Errorf("%s is declared as %q by its snap-declaration", sn, decl.SnapName())
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package serial requests serial assertions from an identity vault and
+// generates mock account, model and serial assertions for testing.
+package serial
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/assertstest"
+	"github.com/ubuntu-core/identity-vault/service"
+	"gopkg.in/yaml.v2"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery-rplib"
+)
+
+// SignConfig is the config file of "serial sign".
+type SignConfig struct {
+	ModelAssertionFile  string `yaml:"ModelAssertionFile"`
+	DeviceKeyFile       string `yaml:"DeviceKeyFile"`
+	Apikey              string `yaml:"ApiKey"`
+	SignServer          string `yaml:"SignServer"`
+	SerialRequestFile   string `yaml:"SerialRequestFile"`
+	SerialAssertionFile string `yaml:"SerialAssertionFile"`
+}
+
+// ExampleSignConfig is a config for a local identity vault.
+var ExampleSignConfig = SignConfig{
+	ModelAssertionFile:  "modelAssertionMock.txt",
+	DeviceKeyFile:       "TestDeviceKey.asc",
+	Apikey:              "U2VyaWFsIFZhdWx0Cg",
+	SignServer:          "http://localhost:8080/1.0/sign",
+	SerialRequestFile:   "serial.request",
+	SerialAssertionFile: "serial.assertion",
+}
+
+// LoadSignConfig reads the config file of "serial sign".
+func LoadSignConfig(file string) (SignConfig, error) {
+	var c SignConfig
+	err := loadYaml(file, &c)
+	return c, err
+}
+
+func loadYaml(file string, v interface{}) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+
+	return nil
+}
+
+// GetNonce asks the identity vault for a request id to put in the serial
+// request.
+func GetNonce(vaultServer string, apikey string) (string, error) {
+	body := bytes.NewBuffer([]byte(""))
+	vaultServer = strings.TrimRight(vaultServer, "/")
+	vaultServer = vaultServer + "/request-id"
+	log.Println("send request to:", vaultServer)
+	req, err := http.NewRequest("POST", vaultServer, body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("api-key", apikey)
+
+	client := &http.Client{}
+	response, err := client.Do(req)
+	if nil != err {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	returnBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	var nonceResponse service.RequestIDResponse
+	err = json.Unmarshal(returnBody, &nonceResponse)
+	if err != nil {
+		log.Println("returnBody:", string(returnBody))
+		return "", err
+	}
+	return nonceResponse.RequestID, nil
+}
+
+// loadDeviceKey reads the armored device key, or generates one and saves
+// it when the file does not exist. A file that is not a key is an error,
+// it is never overwritten.
+func loadDeviceKey(file string) (asserts.PrivateKey, error) {
+	armored, err := ioutil.ReadFile(file)
+	if err == nil {
+		key, err := readPrivKey(armored)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the device key %s: %v", file, err)
+		}
+		log.Println("device key have been read:", key.PublicKey().ID())
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, armored, err := rplib.GenerateKey(4096)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("new generated Public key id of devicePrivKey: ", key.PublicKey().ID())
+
+	return key, ioutil.WriteFile(file, armored, 0600)
+}
+
+// readPrivKey decodes an armored private key. assertstest.ReadPrivKey
+// panics on what it cannot decode.
+func readPrivKey(armored []byte) (key asserts.PrivateKey, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			key, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+
+	key, _ = assertstest.ReadPrivKey(string(armored))
+	if key == nil {
+		return nil, fmt.Errorf("not an armored private key")
+	}
+
+	return key, nil
+}
+
+// Sign creates a serial request for the model assertion, signed with the
+// device key, and sends it to the sign server of the identity vault.
+func Sign(config SignConfig) error {
+	devicePrivKey, err := loadDeviceKey(config.DeviceKeyFile)
+	if err != nil {
+		return err
+	}
+
+	fileContent, err := ioutil.ReadFile(config.ModelAssertionFile)
+	if err != nil {
+		return err
+	}
+	modelAssertion, err := asserts.Decode(fileContent)
+	if err != nil {
+		return fmt.Errorf("%s: %v", config.ModelAssertionFile, err)
+	}
+
+	// generate serial-request
+	nonce, err := GetNonce(config.SignServer, config.Apikey)
+	if err != nil {
+		return err
+	}
+	log.Println("nonce:", nonce)
+	serialRequest, err := rplib.NewSerialRequest(modelAssertion, devicePrivKey, "A1234567", "1", nonce)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(config.SerialRequestFile, asserts.Encode(serialRequest), 0600)
+	if err != nil {
+		return err
+	}
+
+	// send sign request
+	if config.SignServer != "" {
+		ret, err := rplib.SendSerialRequest(serialRequest, config.SignServer, config.Apikey)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(config.SerialAssertionFile, ret, 0600)
+	}
+
+	return nil
+}
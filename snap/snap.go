@@ -0,0 +1,148 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package snap gives access to the content of snap packages through the
+// squashfs reader, so no mount (and no root) is needed.
+package snap
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/squashfs"
+)
+
+const (
+	SnapYaml   = "meta/snap.yaml"
+	GadgetYaml = "meta/gadget.yaml"
+	InitrdImg  = "initrd.img"
+	KernelImg  = "kernel.img"
+)
+
+// Info is the subset of meta/snap.yaml used by the recovery image builder.
+type Info struct {
+	Name          string   `yaml:"name"`
+	Version       string   `yaml:"version"`
+	Type          string   `yaml:"type"`
+	Architectures []string `yaml:"architectures"`
+	Summary       string   `yaml:"summary"`
+}
+
+// Snap is an opened snap package.
+type Snap struct {
+	Path string
+	fs   *squashfs.Filesystem
+}
+
+// Open opens the snap package at path.
+func Open(path string) (*Snap, error) {
+	fs, err := squashfs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Snap{Path: path, fs: fs}, nil
+}
+
+// New opens the snap package read through r, such as a file of another
+// file system. name is used in errors.
+func New(r io.ReaderAt, name string) (*Snap, error) {
+	fs, err := squashfs.New(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	return &Snap{Path: name, fs: fs}, nil
+}
+
+// Close releases the snap package.
+func (s *Snap) Close() error {
+	return s.fs.Close()
+}
+
+// Filesystem returns the squashfs image backing the snap.
+func (s *Snap) Filesystem() *squashfs.Filesystem {
+	return s.fs
+}
+
+// ReadFile returns the content of the file name inside the snap. The
+// error of a missing file satisfies os.IsNotExist.
+func (s *Snap) ReadFile(name string) ([]byte, error) {
+	b, err := s.fs.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, &os.PathError{Op: "read", Path: s.Path + ":" + name, Err: os.ErrNotExist}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s from %s: %v", name, s.Path, err)
+	}
+
+	return b, nil
+}
+
+// Info parses meta/snap.yaml. A missing type means an application snap.
+func (s *Snap) Info() (*Info, error) {
+	b, err := s.ReadFile(SnapYaml)
+	if err != nil {
+		return nil, err
+	}
+
+	var info Info
+	if err := yaml.Unmarshal(b, &info); err != nil {
+		return nil, fmt.Errorf("cannot parse %s in %s: %v", SnapYaml, s.Path, err)
+	}
+	if info.Name == "" {
+		return nil, fmt.Errorf("%s in %s has no name", SnapYaml, s.Path)
+	}
+	if info.Type == "" {
+		info.Type = "app"
+	}
+
+	return &info, nil
+}
+
+// GadgetYaml returns the raw meta/gadget.yaml of a gadget snap.
+func (s *Snap) GadgetYaml() ([]byte, error) {
+	return s.ReadFile(GadgetYaml)
+}
+
+// Initrd returns the raw initrd.img of a kernel snap.
+func (s *Snap) Initrd() ([]byte, error) {
+	return s.ReadFile(InitrdImg)
+}
+
+// Kernel returns the raw kernel.img of a kernel snap.
+func (s *Snap) Kernel() ([]byte, error) {
+	return s.ReadFile(KernelImg)
+}
+
+// CopyFile streams the file name inside the snap to w.
+func (s *Snap) CopyFile(name string, w io.Writer) error {
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return fmt.Errorf("cannot open %s in %s: %v", name, s.Path, err)
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+
+	return err
+}
@@ -0,0 +1,442 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package squashfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const maxSymlinks = 40
+
+// lookup resolves name to an inode. Symlinks in the leading components are
+// always followed, the last component only when follow is set.
+func (fs *Filesystem) lookup(name string, follow bool) (*inode, error) {
+	i, _, err := fs.lookupFrom("/", name, follow, 0)
+
+	return i, err
+}
+
+// lookupFrom resolves name relative to the directory dirPath, from the
+// root, and returns its inode with its path once symlinks are resolved, so
+// the relative targets of symlinks are resolved from the directory they
+// are in.
+func (fs *Filesystem) lookupFrom(dirPath, name string, follow bool, hops int) (*inode, string, error) {
+	full := name
+	if !path.IsAbs(name) {
+		full = path.Join(dirPath, name)
+	}
+
+	parts := strings.Split(path.Clean("/" + full)[1:], "/")
+	if len(parts) == 1 && parts[0] == "" {
+		return fs.root, "/", nil
+	}
+
+	cur, curPath := fs.root, "/"
+	for n, part := range parts {
+		if !cur.isDir() {
+			return nil, "", &os.PathError{Op: "lookup", Path: name, Err: errors.New("not a directory")}
+		}
+
+		entries, err := fs.readDir(cur)
+		if err != nil {
+			return nil, "", err
+		}
+		var next *inode
+		for _, e := range entries {
+			if e.name == part {
+				if next, err = fs.readInode(e.ref); err != nil {
+					return nil, "", err
+				}
+				break
+			}
+		}
+		if next == nil {
+			return nil, "", &os.PathError{Op: "lookup", Path: name, Err: os.ErrNotExist}
+		}
+
+		last := n == len(parts)-1
+		if next.isSymlink() && (!last || follow) {
+			if hops >= maxSymlinks {
+				return nil, "", &os.PathError{Op: "lookup", Path: name, Err: errors.New("too many levels of symbolic links")}
+			}
+			if next, curPath, err = fs.lookupFrom(curPath, next.target, true, hops+1); err != nil {
+				return nil, "", err
+			}
+		} else {
+			curPath = path.Join(curPath, part)
+		}
+
+		cur = next
+	}
+
+	return cur, curPath, nil
+}
+
+// Stat returns the file information of name, following symlinks.
+func (fs *Filesystem) Stat(name string) (os.FileInfo, error) {
+	i, err := fs.lookup(name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{name: path.Base(name), inode: i}, nil
+}
+
+// Lstat returns the file information of name without following a
+// trailing symlink.
+func (fs *Filesystem) Lstat(name string) (os.FileInfo, error) {
+	i, err := fs.lookup(name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{name: path.Base(name), inode: i}, nil
+}
+
+// Readlink returns the target of the symlink name.
+func (fs *Filesystem) Readlink(name string) (string, error) {
+	i, err := fs.lookup(name, false)
+	if err != nil {
+		return "", err
+	}
+	if !i.isSymlink() {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: errors.New("not a symlink")}
+	}
+
+	return i.target, nil
+}
+
+// ReadDir returns the entries of the directory name sorted by file name,
+// like ioutil.ReadDir.
+func (fs *Filesystem) ReadDir(name string) ([]os.FileInfo, error) {
+	dir, err := fs.lookup(name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !dir.isDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	entries, err := fs.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		i, err := fs.readInode(e.ref)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, &fileInfo{name: e.name, inode: i})
+	}
+	sort.Sort(byName(infos))
+
+	return infos, nil
+}
+
+type byName []os.FileInfo
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Less(i, j int) bool { return b[i].Name() < b[j].Name() }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Walk walks the tree rooted at root in lexical order, calling fn for each
+// file or directory, like filepath.Walk. Symlinks are not followed.
+func (fs *Filesystem) Walk(root string, fn filepath.WalkFunc) error {
+	info, err := fs.Lstat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+
+	err = fs.walk(root, info, fn)
+	if err == filepath.SkipDir {
+		return nil
+	}
+
+	return err
+}
+
+func (fs *Filesystem) walk(name string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if err := fn(name, info, nil); err != nil || !info.IsDir() {
+		return err
+	}
+
+	infos, err := fs.ReadDir(name)
+	if err != nil {
+		return fn(name, info, err)
+	}
+
+	for _, fi := range infos {
+		err := fs.walk(path.Join(name, fi.Name()), fi, fn)
+		if err != nil && !(fi.IsDir() && err == filepath.SkipDir) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// File is an open regular file of the image.
+type File struct {
+	fs    *Filesystem
+	name  string
+	inode *inode
+
+	// offsets of the data blocks relative to the image start
+	blockPos []int64
+	// last decompressed block, to serve sequential reads
+	cacheIndex int
+	cache      []byte
+
+	offset int64
+}
+
+// Open opens the regular file name for reading.
+func (fs *Filesystem) Open(name string) (*File, error) {
+	i, err := fs.lookup(name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !i.isRegular() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("not a regular file")}
+	}
+
+	f := &File{fs: fs, name: name, inode: i, cacheIndex: -1}
+	f.blockPos = make([]int64, len(i.blockSizes))
+	pos := int64(i.blocksStart)
+	for n, size := range i.blockSizes {
+		f.blockPos[n] = pos
+		pos += int64(size &^ blockUncompressed)
+	}
+
+	return f, nil
+}
+
+// ReadFile returns the content of the regular file name.
+func (fs *Filesystem) ReadFile(name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+// Stat returns the file information of f.
+func (f *File) Stat() (os.FileInfo, error) {
+	return &fileInfo{name: path.Base(f.name), inode: f.inode}, nil
+}
+
+// Size returns the uncompressed size of f.
+func (f *File) Size() int64 {
+	return int64(f.inode.size)
+}
+
+// Close is a no-op; it exists so File satisfies io.ReadCloser.
+func (f *File) Close() error {
+	return nil
+}
+
+// Read implements io.Reader.
+func (f *File) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset += f.offset
+	case 2:
+		offset += f.Size()
+	default:
+		return 0, errors.New("squashfs: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("squashfs: negative position")
+	}
+	f.offset = offset
+
+	return offset, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	size := f.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	blockSize := int64(f.fs.sb.BlockSize)
+	n := 0
+	for n < len(p) && off < size {
+		data, err := f.block(int(off / blockSize))
+		if err != nil {
+			return n, err
+		}
+		inBlock := off % blockSize
+		if inBlock >= int64(len(data)) {
+			return n, fmt.Errorf("squashfs: short block in %s", f.name)
+		}
+		c := copy(p[n:], data[inBlock:])
+		n += c
+		off += int64(c)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// block returns the uncompressed data block index of the file; the tail
+// of the file may live in a fragment block shared with other files.
+func (f *File) block(index int) ([]byte, error) {
+	if index == f.cacheIndex {
+		return f.cache, nil
+	}
+
+	var data []byte
+	var err error
+	blockSize := int64(f.fs.sb.BlockSize)
+	want := blockSize
+	if rest := f.Size() - int64(index)*blockSize; rest < want {
+		want = rest
+	}
+
+	if index < len(f.inode.blockSizes) {
+		data, err = f.fs.readDataBlock(f.blockPos[index], f.inode.blockSizes[index])
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		data, err = f.fs.readFragment(f.inode.fragmentIndex)
+		if err != nil {
+			return nil, err
+		}
+		start := int64(f.inode.fragmentOffset)
+		if start+want > int64(len(data)) {
+			return nil, fmt.Errorf("squashfs: fragment too short for %s", f.name)
+		}
+		data = data[start : start+want]
+	}
+
+	f.cacheIndex, f.cache = index, data
+
+	return data, nil
+}
+
+// readDataBlock reads a data block of the given encoded size at pos. A
+// size of zero describes a sparse block.
+func (fs *Filesystem) readDataBlock(pos int64, encoded uint32) ([]byte, error) {
+	size := encoded &^ blockUncompressed
+	if size == 0 {
+		return make([]byte, fs.sb.BlockSize), nil
+	}
+
+	data := make([]byte, size)
+	if _, err := fs.r.ReadAt(data, pos); err != nil {
+		return nil, err
+	}
+	if encoded&blockUncompressed != 0 {
+		return data, nil
+	}
+
+	return fs.decompress(data)
+}
+
+func (fs *Filesystem) readFragment(index uint32) ([]byte, error) {
+	if int(index) >= len(fs.fragments) {
+		return nil, fmt.Errorf("squashfs: fragment %d out of range", index)
+	}
+	frag := fs.fragments[index]
+
+	return fs.readDataBlock(int64(frag.Start), frag.Size)
+}
+
+// Extract copies the file or directory tree src of the image to dst on the
+// host, preserving permissions and symlinks.
+func (fs *Filesystem) Extract(src, dst string) error {
+	src = path.Clean("/" + src)[1:]
+
+	return fs.Walk(src, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, src), "/")
+		target := filepath.Join(dst, filepath.FromSlash(rel))
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := fs.Readlink(name)
+			if err != nil {
+				return err
+			}
+			os.Remove(target)
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return fs.extractFile(name, target, info.Mode().Perm())
+		}
+
+		// device nodes, fifos and sockets are skipped
+		return nil
+	})
+}
+
+func (fs *Filesystem) extractFile(name, target string, perm os.FileMode) error {
+	in, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,295 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package squashfs
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	typeDir = iota + 1
+	typeFile
+	typeSymlink
+	typeBlockDev
+	typeCharDev
+	typeFifo
+	typeSocket
+	typeExtDir
+	typeExtFile
+	typeExtSymlink
+	typeExtBlockDev
+	typeExtCharDev
+	typeExtFifo
+	typeExtSocket
+)
+
+type inodeHeader struct {
+	Type        uint16
+	Permissions uint16
+	UIDIndex    uint16
+	GIDIndex    uint16
+	ModTime     uint32
+	Number      uint32
+}
+
+// inode is the decoded form of every inode type this package cares about.
+type inode struct {
+	inodeHeader
+
+	size uint64
+
+	// directories
+	dirBlock  uint32
+	dirOffset uint16
+
+	// regular files
+	blocksStart    uint64
+	fragmentIndex  uint32
+	fragmentOffset uint32
+	blockSizes     []uint32
+
+	// symlinks
+	target string
+}
+
+func (i *inode) isDir() bool {
+	return i.Type == typeDir || i.Type == typeExtDir
+}
+
+func (i *inode) isRegular() bool {
+	return i.Type == typeFile || i.Type == typeExtFile
+}
+
+func (i *inode) isSymlink() bool {
+	return i.Type == typeSymlink || i.Type == typeExtSymlink
+}
+
+func (i *inode) mode() os.FileMode {
+	mode := os.FileMode(i.Permissions) & os.ModePerm
+	if i.Permissions&0x800 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if i.Permissions&0x400 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if i.Permissions&0x200 != 0 {
+		mode |= os.ModeSticky
+	}
+
+	switch i.Type {
+	case typeDir, typeExtDir:
+		mode |= os.ModeDir
+	case typeSymlink, typeExtSymlink:
+		mode |= os.ModeSymlink
+	case typeBlockDev, typeExtBlockDev:
+		mode |= os.ModeDevice
+	case typeCharDev, typeExtCharDev:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case typeFifo, typeExtFifo:
+		mode |= os.ModeNamedPipe
+	case typeSocket, typeExtSocket:
+		mode |= os.ModeSocket
+	}
+
+	return mode
+}
+
+// readInode decodes the inode pointed to by an inode reference: the upper
+// bits hold the metadata block position relative to the inode table, the
+// lower 16 bits the offset inside the uncompressed block.
+func (fs *Filesystem) readInode(ref uint64) (*inode, error) {
+	mr, err := fs.newMetadataReader(int64(fs.sb.InodeTableStart), ref>>16, uint16(ref&0xffff))
+	if err != nil {
+		return nil, err
+	}
+
+	i := &inode{}
+	if err := mr.read(&i.inodeHeader); err != nil {
+		return nil, err
+	}
+
+	switch i.Type {
+	case typeDir:
+		var d struct {
+			BlockIndex  uint32
+			LinkCount   uint32
+			FileSize    uint16
+			BlockOffset uint16
+			ParentInode uint32
+		}
+		if err := mr.read(&d); err != nil {
+			return nil, err
+		}
+		i.dirBlock, i.dirOffset, i.size = d.BlockIndex, d.BlockOffset, uint64(d.FileSize)
+	case typeExtDir:
+		var d struct {
+			LinkCount   uint32
+			FileSize    uint32
+			BlockIndex  uint32
+			ParentInode uint32
+			IndexCount  uint16
+			BlockOffset uint16
+			XattrIndex  uint32
+		}
+		if err := mr.read(&d); err != nil {
+			return nil, err
+		}
+		i.dirBlock, i.dirOffset, i.size = d.BlockIndex, d.BlockOffset, uint64(d.FileSize)
+	case typeFile:
+		var f struct {
+			BlocksStart    uint32
+			FragmentIndex  uint32
+			FragmentOffset uint32
+			FileSize       uint32
+		}
+		if err := mr.read(&f); err != nil {
+			return nil, err
+		}
+		i.blocksStart, i.size = uint64(f.BlocksStart), uint64(f.FileSize)
+		i.fragmentIndex, i.fragmentOffset = f.FragmentIndex, f.FragmentOffset
+		if err := fs.readBlockSizes(mr, i); err != nil {
+			return nil, err
+		}
+	case typeExtFile:
+		var f struct {
+			BlocksStart    uint64
+			FileSize       uint64
+			Sparse         uint64
+			LinkCount      uint32
+			FragmentIndex  uint32
+			FragmentOffset uint32
+			XattrIndex     uint32
+		}
+		if err := mr.read(&f); err != nil {
+			return nil, err
+		}
+		i.blocksStart, i.size = f.BlocksStart, f.FileSize
+		i.fragmentIndex, i.fragmentOffset = f.FragmentIndex, f.FragmentOffset
+		if err := fs.readBlockSizes(mr, i); err != nil {
+			return nil, err
+		}
+	case typeSymlink, typeExtSymlink:
+		var s struct {
+			LinkCount  uint32
+			TargetSize uint32
+		}
+		if err := mr.read(&s); err != nil {
+			return nil, err
+		}
+		target := make([]byte, s.TargetSize)
+		if _, err := mr.Read(target); err != nil {
+			return nil, err
+		}
+		i.target, i.size = string(target), uint64(s.TargetSize)
+	case typeBlockDev, typeCharDev, typeFifo, typeSocket,
+		typeExtBlockDev, typeExtCharDev, typeExtFifo, typeExtSocket:
+		// nothing beyond the header is needed for these
+	default:
+		return nil, fmt.Errorf("unknown inode type %d", i.Type)
+	}
+
+	return i, nil
+}
+
+func (fs *Filesystem) readBlockSizes(mr *metadataReader, i *inode) error {
+	blockSize := uint64(fs.sb.BlockSize)
+	count := i.size / blockSize
+	if i.fragmentIndex == noFragment && i.size%blockSize != 0 {
+		count++
+	}
+
+	i.blockSizes = make([]uint32, count)
+
+	return mr.read(i.blockSizes)
+}
+
+// dirEntry is a single entry of a directory listing.
+type dirEntry struct {
+	name string
+	ref  uint64
+	typ  uint16
+}
+
+// readDir returns the entries of the directory inode dir.
+func (fs *Filesystem) readDir(dir *inode) ([]dirEntry, error) {
+	// the stored size accounts for the implicit "." and ".." entries
+	if dir.size <= 3 {
+		return nil, nil
+	}
+	remaining := int64(dir.size) - 3
+
+	mr, err := fs.newMetadataReader(int64(fs.sb.DirectoryTableStart), uint64(dir.dirBlock), dir.dirOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []dirEntry
+	for remaining > 0 {
+		var header struct {
+			Count uint32
+			Start uint32
+			Inode uint32
+		}
+		if err := mr.read(&header); err != nil {
+			return nil, err
+		}
+		remaining -= 12
+
+		for n := uint32(0); n <= header.Count; n++ {
+			var e struct {
+				Offset      uint16
+				InodeOffset int16
+				Type        uint16
+				NameSize    uint16
+			}
+			if err := mr.read(&e); err != nil {
+				return nil, err
+			}
+			name := make([]byte, int(e.NameSize)+1)
+			if _, err := mr.Read(name); err != nil {
+				return nil, err
+			}
+			remaining -= 8 + int64(len(name))
+
+			entries = append(entries, dirEntry{
+				name: string(name),
+				ref:  uint64(header.Start)<<16 | uint64(e.Offset),
+				typ:  e.Type,
+			})
+		}
+	}
+
+	return entries, nil
+}
+
+// fileInfo implements os.FileInfo for squashfs inodes.
+type fileInfo struct {
+	name  string
+	inode *inode
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return int64(fi.inode.size) }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.inode.mode() }
+func (fi *fileInfo) ModTime() time.Time { return time.Unix(int64(fi.inode.ModTime), 0) }
+func (fi *fileInfo) IsDir() bool        { return fi.inode.isDir() }
+func (fi *fileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,323 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package squashfs reads squashfs 4.0 images, such as snap packages,
+// without mounting them.
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	magic         = 0x73717368
+	superblockLen = 96
+	metadataSize  = 8192
+
+	compressionGzip = 1
+	compressionLzma = 2
+	compressionLzo  = 3
+	compressionXz   = 4
+	compressionLz4  = 5
+	compressionZstd = 6
+
+	flagNoFragments = 0x0010
+
+	metadataUncompressed = 0x8000
+	blockUncompressed    = 1 << 24
+
+	noFragment = 0xffffffff
+)
+
+var (
+	// ErrNotSquashfs is returned when the image does not start with a
+	// squashfs 4.0 superblock.
+	ErrNotSquashfs = errors.New("not a squashfs 4.0 image")
+)
+
+type superblock struct {
+	Magic               uint32
+	InodeCount          uint32
+	ModificationTime    uint32
+	BlockSize           uint32
+	FragmentEntryCount  uint32
+	CompressionID       uint16
+	BlockLog            uint16
+	Flags               uint16
+	IDCount             uint16
+	VersionMajor        uint16
+	VersionMinor        uint16
+	RootInodeRef        uint64
+	BytesUsed           uint64
+	IDTableStart        uint64
+	XattrIDTableStart   uint64
+	InodeTableStart     uint64
+	DirectoryTableStart uint64
+	FragmentTableStart  uint64
+	ExportTableStart    uint64
+}
+
+type fragment struct {
+	Start  uint64
+	Size   uint32
+	Unused uint32
+}
+
+// Filesystem is a read-only view of a squashfs image.
+type Filesystem struct {
+	r      io.ReaderAt
+	closer io.Closer
+	sb     superblock
+
+	fragments []fragment
+	root      *inode
+}
+
+// Open opens the squashfs image at path.
+func Open(path string) (*Filesystem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fs, err := New(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	fs.closer = f
+
+	return fs, nil
+}
+
+// New reads the squashfs image available through r.
+func New(r io.ReaderAt) (*Filesystem, error) {
+	fs := &Filesystem{r: r}
+
+	buf := make([]byte, superblockLen)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &fs.sb); err != nil {
+		return nil, err
+	}
+	if fs.sb.Magic != magic || fs.sb.VersionMajor != 4 {
+		return nil, ErrNotSquashfs
+	}
+
+	switch fs.sb.CompressionID {
+	case compressionGzip, compressionXz:
+	default:
+		return nil, fmt.Errorf("unsupported squashfs compressor %s", compressorName(fs.sb.CompressionID))
+	}
+
+	if err := fs.readFragmentTable(); err != nil {
+		return nil, fmt.Errorf("cannot read fragment table: %v", err)
+	}
+
+	root, err := fs.readInode(fs.sb.RootInodeRef)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read root inode: %v", err)
+	}
+	fs.root = root
+
+	return fs, nil
+}
+
+// Close releases the image file opened by Open.
+func (fs *Filesystem) Close() error {
+	if fs.closer == nil {
+		return nil
+	}
+
+	return fs.closer.Close()
+}
+
+// BlockSize returns the data block size of the image.
+func (fs *Filesystem) BlockSize() int {
+	return int(fs.sb.BlockSize)
+}
+
+// Compression returns the name of the compressor used by the image.
+func (fs *Filesystem) Compression() string {
+	return compressorName(fs.sb.CompressionID)
+}
+
+func compressorName(id uint16) string {
+	switch id {
+	case compressionGzip:
+		return "gzip"
+	case compressionLzma:
+		return "lzma"
+	case compressionLzo:
+		return "lzo"
+	case compressionXz:
+		return "xz"
+	case compressionLz4:
+		return "lz4"
+	case compressionZstd:
+		return "zstd"
+	}
+
+	return fmt.Sprintf("unknown(%d)", id)
+}
+
+// decompress inflates a single metadata or data block.
+func (fs *Filesystem) decompress(data []byte) ([]byte, error) {
+	var r io.Reader
+	var err error
+
+	switch fs.sb.CompressionID {
+	case compressionGzip:
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	case compressionXz:
+		r, err = xz.NewReader(bytes.NewReader(data))
+	default:
+		err = fmt.Errorf("unsupported squashfs compressor %s", compressorName(fs.sb.CompressionID))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+// readMetadataBlock reads the metadata block at the absolute position pos
+// and returns its content and the position of the following block.
+func (fs *Filesystem) readMetadataBlock(pos int64) ([]byte, int64, error) {
+	var header [2]byte
+	if _, err := fs.r.ReadAt(header[:], pos); err != nil {
+		return nil, 0, err
+	}
+
+	h := binary.LittleEndian.Uint16(header[:])
+	size := int64(h &^ metadataUncompressed)
+	if size == 0 || size > metadataSize {
+		return nil, 0, fmt.Errorf("invalid metadata block size %d at %d", size, pos)
+	}
+
+	data := make([]byte, size)
+	if _, err := fs.r.ReadAt(data, pos+2); err != nil {
+		return nil, 0, err
+	}
+
+	if h&metadataUncompressed == 0 {
+		var err error
+		if data, err = fs.decompress(data); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return data, pos + 2 + size, nil
+}
+
+// metadataReader streams the content of consecutive metadata blocks.
+type metadataReader struct {
+	fs   *Filesystem
+	next int64
+	buf  []byte
+}
+
+func (fs *Filesystem) newMetadataReader(start int64, block uint64, offset uint16) (*metadataReader, error) {
+	mr := &metadataReader{fs: fs, next: start + int64(block)}
+	if err := mr.fill(); err != nil {
+		return nil, err
+	}
+	if int(offset) > len(mr.buf) {
+		return nil, fmt.Errorf("metadata offset %d out of range", offset)
+	}
+	mr.buf = mr.buf[offset:]
+
+	return mr, nil
+}
+
+func (mr *metadataReader) fill() error {
+	data, next, err := mr.fs.readMetadataBlock(mr.next)
+	if err != nil {
+		return err
+	}
+	mr.buf = data
+	mr.next = next
+
+	return nil
+}
+
+func (mr *metadataReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(mr.buf) == 0 {
+			if err := mr.fill(); err != nil {
+				return n, err
+			}
+		}
+		c := copy(p[n:], mr.buf)
+		mr.buf = mr.buf[c:]
+		n += c
+	}
+
+	return n, nil
+}
+
+func (mr *metadataReader) read(data interface{}) error {
+	return binary.Read(mr, binary.LittleEndian, data)
+}
+
+func (fs *Filesystem) readFragmentTable() error {
+	count := int(fs.sb.FragmentEntryCount)
+	if count == 0 || fs.sb.Flags&flagNoFragments != 0 {
+		return nil
+	}
+
+	const perBlock = metadataSize / 16
+	blocks := (count + perBlock - 1) / perBlock
+	index := make([]byte, 8*blocks)
+	if _, err := fs.r.ReadAt(index, int64(fs.sb.FragmentTableStart)); err != nil {
+		return err
+	}
+
+	fs.fragments = make([]fragment, 0, count)
+	for i := 0; i < blocks; i++ {
+		pos := int64(binary.LittleEndian.Uint64(index[8*i:]))
+		mr, err := fs.newMetadataReader(pos, 0, 0)
+		if err != nil {
+			return err
+		}
+
+		n := count - len(fs.fragments)
+		if n > perBlock {
+			n = perBlock
+		}
+		entries := make([]fragment, n)
+		if err := mr.read(entries); err != nil {
+			return err
+		}
+		fs.fragments = append(fs.fragments, entries...)
+	}
+
+	return nil
+}
@@ -0,0 +1,493 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+const testBlockSize = 4096
+
+// testNode is a file of a fixture image: a directory with children, a
+// symlink with a target, or a regular file with data.
+type testNode struct {
+	name     string
+	children []*testNode
+	target   string
+	data     []byte
+	// noFragment stores the tail of the file in its own block.
+	noFragment bool
+
+	// set while writing the image
+	blocksStart uint32
+	blockSizes  []uint32
+	fragOffset  uint32
+	inodeOffset int
+	number      uint32
+}
+
+func (n *testNode) isDir() bool {
+	return n.children != nil
+}
+
+func (n *testNode) inodeType() uint16 {
+	switch {
+	case n.isDir():
+		return typeDir
+	case n.target != "":
+		return typeSymlink
+	}
+
+	return typeFile
+}
+
+// compressBytes compresses b with the squashfs compressor id, as a
+// gzip (zlib) stream or an xz stream with CRC32 checks like mksquashfs.
+func compressBytes(id uint16, b []byte) []byte {
+	var z bytes.Buffer
+	var w io.WriteCloser
+	switch id {
+	case compressionGzip:
+		w = zlib.NewWriter(&z)
+	case compressionXz:
+		var err error
+		if w, err = (xz.WriterConfig{CheckSum: xz.CRC32}).NewWriter(&z); err != nil {
+			panic(err)
+		}
+	default:
+		panic("no fixture compressor " + compressorName(id))
+	}
+	w.Write(b)
+	w.Close()
+
+	return z.Bytes()
+}
+
+// writeMetadata writes b, at most one metadata block, compressed.
+func writeMetadata(img *bytes.Buffer, id uint16, b []byte) {
+	if len(b) > metadataSize {
+		panic("fixture metadata does not fit in one block")
+	}
+	z := compressBytes(id, b)
+	binary.Write(img, binary.LittleEndian, uint16(len(z)))
+	img.Write(z)
+}
+
+// writeData writes a data block, compressed unless that does not make it
+// smaller, and returns its encoded size.
+func writeData(img *bytes.Buffer, id uint16, b []byte) uint32 {
+	if z := compressBytes(id, b); len(z) < len(b) {
+		img.Write(z)
+		return uint32(len(z))
+	}
+	img.Write(b)
+
+	return uint32(len(b)) | blockUncompressed
+}
+
+// makeImage writes the squashfs 4.0 image of the tree root, with the
+// compressor id and a single fragment block, the way mksquashfs lays it
+// out: data blocks, then the inode, directory and fragment tables.
+func makeImage(root *testNode, id uint16) []byte {
+	img := &bytes.Buffer{}
+	img.Write(make([]byte, superblockLen))
+
+	var frag []byte
+	var files []*testNode
+	var walk func(n *testNode)
+	walk = func(n *testNode) {
+		for _, c := range n.children {
+			walk(c)
+		}
+		if !n.isDir() && n.target == "" {
+			files = append(files, n)
+		}
+	}
+	walk(root)
+	for _, f := range files {
+		f.blocksStart = uint32(img.Len())
+		data := f.data
+		for len(data) >= testBlockSize || f.noFragment && len(data) > 0 {
+			size := testBlockSize
+			if len(data) < size {
+				size = len(data)
+			}
+			f.blockSizes = append(f.blockSizes, writeData(img, id, data[:size]))
+			data = data[size:]
+		}
+		if !f.noFragment {
+			f.fragOffset = uint32(len(frag))
+			frag = append(frag, data...)
+		}
+	}
+	fragStart := uint64(img.Len())
+	fragSize := writeData(img, id, frag)
+
+	var inodes, dirs bytes.Buffer
+	number := uint32(0)
+	var writeInode func(n *testNode)
+	writeInode = func(n *testNode) {
+		for _, c := range n.children {
+			writeInode(c)
+		}
+		number++
+		n.number = number
+		n.inodeOffset = inodes.Len()
+
+		le := binary.LittleEndian
+		binary.Write(&inodes, le, inodeHeader{Type: n.inodeType(), Permissions: 0755, ModTime: 1500000000, Number: n.number})
+		switch n.inodeType() {
+		case typeDir:
+			dirOffset, listing := dirs.Len(), 0
+			if len(n.children) > 0 {
+				base := n.children[0].number
+				binary.Write(&dirs, le, []uint32{uint32(len(n.children) - 1), 0, base})
+				listing += 12
+				for _, c := range n.children {
+					binary.Write(&dirs, le, []uint16{uint16(c.inodeOffset), uint16(c.number - base), c.inodeType(), uint16(len(c.name) - 1)})
+					dirs.WriteString(c.name)
+					listing += 8 + len(c.name)
+				}
+			}
+			binary.Write(&inodes, le, []uint32{0, 2})
+			binary.Write(&inodes, le, []uint16{uint16(listing + 3), uint16(dirOffset)})
+			binary.Write(&inodes, le, uint32(0))
+		case typeSymlink:
+			binary.Write(&inodes, le, []uint32{1, uint32(len(n.target))})
+			inodes.WriteString(n.target)
+		case typeFile:
+			fragIndex := uint32(0)
+			if n.noFragment {
+				fragIndex = noFragment
+			}
+			binary.Write(&inodes, le, []uint32{n.blocksStart, fragIndex, n.fragOffset, uint32(len(n.data))})
+			binary.Write(&inodes, le, n.blockSizes)
+		}
+	}
+	writeInode(root)
+
+	sb := superblock{
+		Magic:              magic,
+		InodeCount:         number,
+		BlockSize:          testBlockSize,
+		FragmentEntryCount: 1,
+		CompressionID:      id,
+		BlockLog:           12,
+		IDCount:            1,
+		VersionMajor:       4,
+		RootInodeRef:       uint64(root.inodeOffset),
+	}
+	sb.InodeTableStart = uint64(img.Len())
+	writeMetadata(img, id, inodes.Bytes())
+	sb.DirectoryTableStart = uint64(img.Len())
+	writeMetadata(img, id, dirs.Bytes())
+	fragTable := uint64(img.Len())
+	var entries bytes.Buffer
+	binary.Write(&entries, binary.LittleEndian, fragment{Start: fragStart, Size: fragSize})
+	writeMetadata(img, id, entries.Bytes())
+	sb.FragmentTableStart = uint64(img.Len())
+	binary.Write(img, binary.LittleEndian, fragTable)
+	sb.IDTableStart, sb.XattrIDTableStart, sb.ExportTableStart = uint64(img.Len()), ^uint64(0), ^uint64(0)
+	sb.BytesUsed = uint64(img.Len())
+
+	b := img.Bytes()
+	var head bytes.Buffer
+	binary.Write(&head, binary.LittleEndian, sb)
+	copy(b, head.Bytes())
+
+	return b
+}
+
+func dir(name string, children ...*testNode) *testNode {
+	return &testNode{name: name, children: append([]*testNode{}, children...)}
+}
+
+func symlink(name, target string) *testNode {
+	return &testNode{name: name, target: target}
+}
+
+func file(name string, data []byte) *testNode {
+	return &testNode{name: name, data: data}
+}
+
+// pattern returns size bytes that do not repeat within a block, so some
+// blocks compress and some do not.
+func pattern(size int, seed byte) []byte {
+	b := make([]byte, size)
+	x := uint32(seed) + 1
+	for i := range b {
+		x = x*1103515245 + 12345
+		b[i] = byte(x >> 16)
+	}
+
+	return b
+}
+
+var (
+	hostname = []byte("recovery\n")
+	// two blocks and a tail in the fragment block
+	shareFoo = append(bytes.Repeat([]byte("squashfs"), testBlockSize/8), pattern(testBlockSize+100, 1)...)
+	// a block and a tail in a block of its own
+	bigBin = pattern(testBlockSize+10, 2)
+)
+
+// testImage returns the gzip fixture image:
+//
+//	big.bin
+//	etc/hostname
+//	lib -> usr/lib
+//	loop -> loop2
+//	loop2 -> loop
+//	usr/bin/sh -> /usr/share/foo
+//	usr/lib/foo -> ../share/foo
+//	usr/share/foo
+//	var/
+func testImage(t *testing.T) *Filesystem {
+	return compressedImage(t, compressionGzip)
+}
+
+// compressedImage returns the fixture image of testImage with the
+// compressor id.
+func compressedImage(t *testing.T, id uint16) *Filesystem {
+	big := file("big.bin", bigBin)
+	big.noFragment = true
+	root := dir("",
+		big,
+		dir("etc", file("hostname", hostname)),
+		symlink("lib", "usr/lib"),
+		symlink("loop", "loop2"),
+		symlink("loop2", "loop"),
+		dir("usr",
+			dir("bin", symlink("sh", "/usr/share/foo")),
+			dir("lib", symlink("foo", "../share/foo")),
+			dir("share", file("foo", shareFoo)),
+		),
+		dir("var"),
+	)
+
+	fs, err := New(bytes.NewReader(makeImage(root, id)))
+	if err != nil {
+		t.Fatalf("cannot read the fixture image: %v", err)
+	}
+
+	return fs
+}
+
+func TestNotSquashfs(t *testing.T) {
+	if _, err := New(bytes.NewReader(make([]byte, superblockLen))); err != ErrNotSquashfs {
+		t.Fatalf("got %v, want ErrNotSquashfs", err)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	fs := testImage(t)
+	if fs.Compression() != "gzip" || fs.BlockSize() != testBlockSize {
+		t.Errorf("got %s %d, want gzip %d", fs.Compression(), fs.BlockSize(), testBlockSize)
+	}
+
+	for _, c := range []struct {
+		name string
+		want []byte
+	}{
+		{"etc/hostname", hostname},
+		{"/etc/hostname", hostname},
+		{"usr/share/foo", shareFoo},
+		{"big.bin", bigBin},
+		// symlinks: relative with .., absolute, and a symlinked directory
+		{"usr/lib/foo", shareFoo},
+		{"usr/bin/sh", shareFoo},
+		{"lib/foo", shareFoo},
+		{"usr/lib/../share/foo", shareFoo},
+	} {
+		got, err := fs.ReadFile(c.name)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("%s: got %d bytes, want %d", c.name, len(got), len(c.want))
+		}
+	}
+}
+
+func TestReadFileXz(t *testing.T) {
+	fs := compressedImage(t, compressionXz)
+	if fs.Compression() != "xz" {
+		t.Errorf("got %s, want xz", fs.Compression())
+	}
+
+	// metadata, fragment and full blocks are all xz streams
+	for _, c := range []struct {
+		name string
+		want []byte
+	}{
+		{"etc/hostname", hostname},
+		{"usr/share/foo", shareFoo},
+		{"big.bin", bigBin},
+		{"lib/foo", shareFoo},
+	} {
+		got, err := fs.ReadFile(c.name)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("%s: got %d bytes, want %d", c.name, len(got), len(c.want))
+		}
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	fs := testImage(t)
+	f, err := fs.Open("usr/share/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// across the second block and the fragment
+	off := int64(2*testBlockSize - 50)
+	buf := make([]byte, 120)
+	if _, err := f.ReadAt(buf, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, shareFoo[off:off+120]) {
+		t.Errorf("ReadAt(%d) does not match", off)
+	}
+
+	if _, err := f.Seek(-10, 2); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tail, shareFoo[len(shareFoo)-10:]) {
+		t.Errorf("the tail does not match")
+	}
+	if _, err := f.ReadAt(buf, f.Size()); err != io.EOF {
+		t.Errorf("reading past the end: got %v, want EOF", err)
+	}
+}
+
+func TestLookupErrors(t *testing.T) {
+	fs := testImage(t)
+	for _, name := range []string{"missing", "etc/missing", "usr/lib/missing"} {
+		if _, err := fs.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s: got %v, want a not exist error", name, err)
+		}
+	}
+	if _, err := fs.Stat("etc/hostname/x"); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("got %v, want not a directory", err)
+	}
+	if _, err := fs.Stat("loop"); err == nil || !strings.Contains(err.Error(), "too many levels") {
+		t.Errorf("got %v, want a symlink loop error", err)
+	}
+	if _, err := fs.Open("etc"); err == nil {
+		t.Errorf("opening a directory should fail")
+	}
+}
+
+func TestDirectories(t *testing.T) {
+	fs := testImage(t)
+
+	infos, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	if got, want := strings.Join(names, " "), "big.bin etc lib loop loop2 usr var"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// lib is followed to usr/lib
+	infos, err = fs.ReadDir("lib")
+	if err != nil || len(infos) != 1 || infos[0].Name() != "foo" {
+		t.Errorf("ReadDir(lib): got %v %v", infos, err)
+	}
+	if infos, err = fs.ReadDir("var"); err != nil || len(infos) != 0 {
+		t.Errorf("ReadDir(var): got %v %v", infos, err)
+	}
+
+	fi, err := fs.Stat("usr/share")
+	if err != nil || !fi.IsDir() {
+		t.Errorf("Stat(usr/share): got %v %v", fi, err)
+	}
+	fi, err = fs.Lstat("usr/lib/foo")
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Lstat(usr/lib/foo): got %v %v", fi, err)
+	}
+	fi, err = fs.Stat("usr/lib/foo")
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() != int64(len(shareFoo)) {
+		t.Errorf("Stat(usr/lib/foo): got %v %v", fi, err)
+	}
+	if target, err := fs.Readlink("usr/lib/foo"); err != nil || target != "../share/foo" {
+		t.Errorf("Readlink: got %q %v", target, err)
+	}
+
+	var walked []string
+	err = fs.Walk("usr", func(name string, info os.FileInfo, err error) error {
+		walked = append(walked, name)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(walked, " "), "usr usr/bin usr/bin/sh usr/lib usr/lib/foo usr/share usr/share/foo"; got != want {
+		t.Errorf("Walk: got %q, want %q", got, want)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	fs := testImage(t)
+	dir, err := ioutil.TempDir("", "squashfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := fs.Extract("usr", dir); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "share/foo"))
+	if err != nil || !bytes.Equal(b, shareFoo) {
+		t.Errorf("share/foo: got %d bytes, %v", len(b), err)
+	}
+	// the relative symlink still works on the host
+	if b, err = ioutil.ReadFile(filepath.Join(dir, "lib/foo")); err != nil || !bytes.Equal(b, shareFoo) {
+		t.Errorf("lib/foo: got %d bytes, %v", len(b), err)
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "bin/sh")); err != nil || target != "/usr/share/foo" {
+		t.Errorf("bin/sh: got %q %v", target, err)
+	}
+}
@@ -0,0 +1,342 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package update
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// StageDir is where Apply stages the new files, in the recovery partition
+// so that committing them is a rename on the same file system.
+const StageDir = ".update"
+
+const journalFile = "journal.yaml"
+
+// journal lists the renames and removals committing a staged update.
+type journal struct {
+	Files []journalEntry
+}
+
+type journalEntry struct {
+	Path string
+	// Staged is the staged file replacing Path; Path is removed when it
+	// is empty.
+	Staged string `yaml:",omitempty"`
+}
+
+// ErrUpToDate is returned by Check and Apply when the files already are
+// as the update leaves them.
+var ErrUpToDate = errors.New("recovery partition already up to date")
+
+// MismatchError lists the files which are not as the update expects them
+// before it is applied.
+type MismatchError struct {
+	Files []string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("files differ from what the update expects: %s", strings.Join(e.Files, ", "))
+}
+
+// fileSum returns the SHA-256 of the file, or "" when it does not exist.
+func fileSum(file string) (string, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Check checks that the recovery partition mounted at root has the files
+// the update expects before it is applied.
+func (b *Bundle) Check(root string) error {
+	var mismatch []string
+	upToDate := true
+	for _, f := range b.Manifest.Files {
+		sum, err := fileSum(filepath.Join(root, filepath.FromSlash(f.Path)))
+		if err != nil {
+			return err
+		}
+		if sum != f.New {
+			upToDate = false
+		}
+		if sum != f.Old {
+			mismatch = append(mismatch, f.Path)
+		}
+	}
+
+	switch {
+	case upToDate:
+		return ErrUpToDate
+	case len(mismatch) > 0:
+		return &MismatchError{Files: mismatch}
+	}
+
+	return nil
+}
+
+// Apply updates the recovery partition mounted at root. The new files
+// are staged and checked against the manifest first; then a journal is
+// written and the files are renamed into place. An update interrupted
+// while renaming is finished by Recover, which Apply runs first.
+func (b *Bundle) Apply(root string) (err error) {
+	if err := Recover(root); err != nil {
+		return err
+	}
+	if err := b.Check(root); err != nil {
+		return err
+	}
+
+	stage := filepath.Join(root, StageDir)
+	if err := os.RemoveAll(stage); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stage, 0755); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(stage)
+		}
+	}()
+
+	if err := b.stage(root, stage); err != nil {
+		return err
+	}
+
+	var j journal
+	for i, f := range b.Manifest.Files {
+		e := journalEntry{Path: f.Path}
+		if !f.Removed() {
+			e.Staged = strconv.Itoa(i)
+		}
+		j.Files = append(j.Files, e)
+	}
+	if err := writeJournal(stage, &j); err != nil {
+		return err
+	}
+
+	return commit(root, &j)
+}
+
+// stage writes the new content of every file of the update to the stage
+// directory, named after its index in the manifest.
+func (b *Bundle) stage(root, stage string) error {
+	payloads := map[string]int{}
+	for i, f := range b.Manifest.Files {
+		if !f.Removed() {
+			payloads[f.Payload] = i
+		}
+	}
+
+	bf, err := os.Open(b.file)
+	if err != nil {
+		return err
+	}
+	defer bf.Close()
+
+	tr := tar.NewReader(bf)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		i, ok := payloads[h.Name]
+		if !ok {
+			continue
+		}
+		delete(payloads, h.Name)
+		if err := stageFile(root, filepath.Join(stage, strconv.Itoa(i)), &b.Manifest.Files[i], tr); err != nil {
+			return fmt.Errorf("%s: %v", b.Manifest.Files[i].Path, err)
+		}
+	}
+	if len(payloads) > 0 {
+		return fmt.Errorf("%d payloads missing from the bundle", len(payloads))
+	}
+
+	return nil
+}
+
+func stageFile(root, staged string, f *File, payload io.Reader) error {
+	out, err := os.Create(staged)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	w := io.MultiWriter(out, h)
+	if f.Delta {
+		old, err := os.Open(filepath.Join(root, filepath.FromSlash(f.Path)))
+		if err != nil {
+			return err
+		}
+		defer old.Close()
+		err = ApplyDelta(w, old, payload)
+	} else {
+		_, err = io.Copy(w, payload)
+	}
+	if err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != f.New {
+		return fmt.Errorf("updated content has SHA-256 %s, the manifest expects %s", sum, f.New)
+	}
+
+	return out.Sync()
+}
+
+func writeJournal(stage string, j *journal) error {
+	b, err := yaml.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(stage, journalFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(stage, journalFile)); err != nil {
+		return err
+	}
+	return syncDir(stage)
+}
+
+// commit renames the staged files into place and removes the files the
+// update removes. It can run again after an interruption: the staged
+// files already renamed are gone. The journal is only removed once the
+// directories of every target are synced, so a rename lost with the
+// power is done again by Recover.
+func commit(root string, j *journal) error {
+	root = filepath.Clean(root)
+	stage := filepath.Join(root, StageDir)
+	dirs := map[string]bool{}
+	for _, e := range j.Files {
+		target := filepath.Join(root, filepath.FromSlash(e.Path))
+		// the directories created for target are entries of their parents
+		for dir := filepath.Dir(target); ; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+			if dir == root || !strings.HasPrefix(dir, root) {
+				break
+			}
+		}
+
+		if e.Staged == "" {
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+
+		staged := filepath.Join(stage, e.Staged)
+		if _, err := os.Stat(staged); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(staged, target); err != nil {
+			return err
+		}
+	}
+	for dir := range dirs {
+		// the directory of a file removed may be missing already
+		if err := syncDir(dir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := os.RemoveAll(stage); err != nil {
+		return err
+	}
+
+	return syncDir(root)
+}
+
+// Recover finishes an update of the recovery partition mounted at root
+// that was interrupted after its journal was written, and drops the
+// files staged by an update interrupted before. Agents should run it at
+// boot.
+func Recover(root string) error {
+	stage := filepath.Join(root, StageDir)
+	b, err := ioutil.ReadFile(filepath.Join(stage, journalFile))
+	if os.IsNotExist(err) {
+		return os.RemoveAll(stage)
+	}
+	if err != nil {
+		return err
+	}
+
+	var j journal
+	if err := yaml.Unmarshal(b, &j); err != nil {
+		return fmt.Errorf("%s: %v", journalFile, err)
+	}
+
+	return commit(root, &j)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,215 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package update
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A delta rebuilds a file from its old content: after deltaMagic come
+// operations copying a range of the old file or inserting literal bytes,
+// their numbers encoded as uvarints, up to opEnd.
+const (
+	deltaMagic = "URIDELTA1\n"
+
+	opCopy   = 'C' // offset, length
+	opInsert = 'I' // length, bytes
+	opEnd    = 'E'
+
+	deltaBlockSize = 4096
+)
+
+// weakSum is the rolling checksum of rsync over a block.
+type weakSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newWeakSum(block []byte) weakSum {
+	s := weakSum{n: uint32(len(block))}
+	for i, c := range block {
+		s.a += uint32(c)
+		s.b += uint32(len(block)-i) * uint32(c)
+	}
+
+	return s
+}
+
+// roll moves the block one byte forward, dropping out and adding in.
+func (s *weakSum) roll(out, in byte) {
+	s.a += uint32(in) - uint32(out)
+	s.b += s.a - s.n*uint32(out)
+}
+
+func (s weakSum) sum() uint32 {
+	return s.a&0xffff | s.b<<16
+}
+
+// Delta returns the delta rebuilding newData from oldData, matching the
+// blocks of oldData wherever they moved to in newData.
+func Delta(oldData, newData []byte) []byte {
+	index := map[uint32][]int{}
+	// filter avoids most map lookups for sums of no block
+	filter := make([]bool, 1<<20)
+	for off := 0; off+deltaBlockSize <= len(oldData); off += deltaBlockSize {
+		sum := newWeakSum(oldData[off : off+deltaBlockSize]).sum()
+		index[sum] = append(index[sum], off)
+		filter[sum&(1<<20-1)] = true
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(deltaMagic)
+	d := deltaWriter{w: &buf}
+
+	literal := 0
+	i := 0
+	var s weakSum
+	if len(newData) >= deltaBlockSize {
+		s = newWeakSum(newData[:deltaBlockSize])
+	}
+	for i+deltaBlockSize <= len(newData) {
+		match := -1
+		if sum := s.sum(); filter[sum&(1<<20-1)] {
+			for _, off := range index[sum] {
+				if bytes.Equal(oldData[off:off+deltaBlockSize], newData[i:i+deltaBlockSize]) {
+					match = off
+					break
+				}
+			}
+		}
+		if match < 0 {
+			if i+deltaBlockSize < len(newData) {
+				s.roll(newData[i], newData[i+deltaBlockSize])
+			}
+			i++
+			continue
+		}
+
+		n := deltaBlockSize
+		for i+n < len(newData) && match+n < len(oldData) && oldData[match+n] == newData[i+n] {
+			n++
+		}
+		d.insert(newData[literal:i])
+		d.copy(match, n)
+		i += n
+		literal = i
+		if i+deltaBlockSize <= len(newData) {
+			s = newWeakSum(newData[i : i+deltaBlockSize])
+		}
+	}
+	d.insert(newData[literal:])
+	d.end()
+
+	return buf.Bytes()
+}
+
+// deltaWriter writes operations, merging adjacent copies.
+type deltaWriter struct {
+	w                *bytes.Buffer
+	copyOff, copyLen int
+	scratch          [binary.MaxVarintLen64]byte
+}
+
+func (d *deltaWriter) uvarint(v int) {
+	n := binary.PutUvarint(d.scratch[:], uint64(v))
+	d.w.Write(d.scratch[:n])
+}
+
+func (d *deltaWriter) flushCopy() {
+	if d.copyLen > 0 {
+		d.w.WriteByte(opCopy)
+		d.uvarint(d.copyOff)
+		d.uvarint(d.copyLen)
+		d.copyLen = 0
+	}
+}
+
+func (d *deltaWriter) copy(off, n int) {
+	if d.copyLen > 0 && d.copyOff+d.copyLen == off {
+		d.copyLen += n
+		return
+	}
+	d.flushCopy()
+	d.copyOff, d.copyLen = off, n
+}
+
+func (d *deltaWriter) insert(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	d.flushCopy()
+	d.w.WriteByte(opInsert)
+	d.uvarint(len(b))
+	d.w.Write(b)
+}
+
+func (d *deltaWriter) end() {
+	d.flushCopy()
+	d.w.WriteByte(opEnd)
+}
+
+// ErrBadDelta is returned for a delta that is corrupt or does not apply
+// to the old file.
+var ErrBadDelta = errors.New("bad delta")
+
+// ApplyDelta writes to w the file rebuilt from the old file and delta,
+// streaming both.
+func ApplyDelta(w io.Writer, old io.ReaderAt, delta io.Reader) error {
+	r := bufio.NewReader(delta)
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != deltaMagic {
+		return ErrBadDelta
+	}
+
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return ErrBadDelta
+		}
+		switch op {
+		case opCopy:
+			off, err1 := binary.ReadUvarint(r)
+			n, err2 := binary.ReadUvarint(r)
+			if err1 != nil || err2 != nil {
+				return ErrBadDelta
+			}
+			if _, err := io.Copy(w, io.NewSectionReader(old, int64(off), int64(n))); err != nil {
+				return err
+			}
+		case opInsert:
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return ErrBadDelta
+			}
+			if _, err := io.CopyN(w, r, int64(n)); err != nil {
+				return fmt.Errorf("%v: %v", ErrBadDelta, err)
+			}
+		case opEnd:
+			return nil
+		default:
+			return ErrBadDelta
+		}
+	}
+}
@@ -0,0 +1,320 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package update writes and applies signed bundles updating the recovery
+// partition of deployed devices from one recovery image to another.
+//
+// A bundle is a tar archive of payloads, the new content of a file or a
+// binary delta from its old content, followed by manifest.yaml and
+// manifest.sig. The manifest lists the files with their SHA-256 before and
+// after the update, so the RSA signature of the manifest covers the
+// payloads as well.
+package update
+
+import (
+	"archive/tar"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	utils "github.com/Lyoncore/ubuntu-recovery-image/utils"
+)
+
+// Format is the version of the bundle format written by Writer.
+const Format = 1
+
+const (
+	manifestFile  = "manifest.yaml"
+	signatureFile = "manifest.sig"
+)
+
+// Manifest describes the update of a bundle.
+type Manifest struct {
+	Format  int
+	Created time.Time
+	// From and To are the buildstamps of the recovery partitions the
+	// bundle updates from and to.
+	From utils.BuildStamp
+	To   utils.BuildStamp
+	// Files are applied in order; the buildstamp comes last.
+	Files []File
+}
+
+// File is a file added, replaced or removed by the update.
+type File struct {
+	Path string
+	// Old is the SHA-256 of the file before the update, empty for an
+	// added file.
+	Old string `yaml:",omitempty"`
+	// New is the SHA-256 of the file after the update, empty for a
+	// removed file.
+	New  string `yaml:",omitempty"`
+	Size int64  `yaml:",omitempty"`
+	// Payload is the bundle entry holding the new content, or a delta
+	// from the old content when Delta is set.
+	Payload string `yaml:",omitempty"`
+	Delta   bool   `yaml:",omitempty"`
+}
+
+// Removed tells whether the update removes f.
+func (f *File) Removed() bool {
+	return f.New == ""
+}
+
+// Sum returns the SHA-256 of b as used in the manifest.
+func Sum(b []byte) string {
+	s := sha256.Sum256(b)
+	return hex.EncodeToString(s[:])
+}
+
+// Writer writes a bundle.
+type Writer struct {
+	tw       *tar.Writer
+	key      *rsa.PrivateKey
+	manifest Manifest
+}
+
+// NewWriter returns a Writer of the bundle updating from the buildstamp
+// from to to, signed with key.
+func NewWriter(w io.Writer, key *rsa.PrivateKey, from, to utils.BuildStamp) *Writer {
+	return &Writer{
+		tw:       tar.NewWriter(w),
+		key:      key,
+		manifest: Manifest{Format: Format, Created: time.Now().UTC(), From: from, To: to},
+	}
+}
+
+// Add adds f to the manifest, with the size bytes of payload if the file
+// is not removed. The payload is hashed while it is copied into the
+// bundle; unless it is a delta, it must match f.New.
+func (w *Writer) Add(f File, payload io.Reader, size int64) error {
+	if !f.Removed() {
+		f.Payload = fmt.Sprintf("payload/%d", len(w.manifest.Files))
+		h := &tar.Header{Name: f.Payload, Mode: 0644, Size: size, ModTime: w.manifest.Created}
+		if err := w.tw.WriteHeader(h); err != nil {
+			return err
+		}
+		sum := sha256.New()
+		if _, err := io.Copy(w.tw, io.TeeReader(io.LimitReader(payload, size), sum)); err != nil {
+			return err
+		}
+		// the tar writer refuses to close a short entry
+		if err := w.tw.Flush(); err != nil {
+			return fmt.Errorf("payload of %s: %v", f.Path, err)
+		}
+		if got := hex.EncodeToString(sum.Sum(nil)); !f.Delta && got != f.New {
+			return fmt.Errorf("payload of %s has SHA-256 %s, not %s", f.Path, got, f.New)
+		}
+	}
+	w.manifest.Files = append(w.manifest.Files, f)
+
+	return nil
+}
+
+func (w *Writer) writeEntry(name string, b []byte) error {
+	h := &tar.Header{Name: name, Mode: 0644, Size: int64(len(b)), ModTime: w.manifest.Created}
+	if err := w.tw.WriteHeader(h); err != nil {
+		return err
+	}
+	_, err := w.tw.Write(b)
+
+	return err
+}
+
+// Close signs and writes the manifest. It does not close the underlying
+// writer.
+func (w *Writer) Close() error {
+	m, err := yaml.Marshal(&w.manifest)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(m)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, w.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return err
+	}
+
+	if err := w.writeEntry(manifestFile, m); err != nil {
+		return err
+	}
+	if err := w.writeEntry(signatureFile, sig); err != nil {
+		return err
+	}
+
+	return w.tw.Close()
+}
+
+// ErrBadSignature is returned for a bundle not signed by the expected key.
+var ErrBadSignature = errors.New("bad bundle signature")
+
+// Bundle is a bundle whose manifest signature is verified.
+type Bundle struct {
+	Manifest Manifest
+	file     string
+}
+
+// ReadBundle reads the manifest of the bundle file and checks its
+// signature with key.
+func ReadBundle(file string, key *rsa.PublicKey) (*Bundle, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var m, sig []byte
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		switch h.Name {
+		case manifestFile:
+			m, err = ioutil.ReadAll(tr)
+		case signatureFile:
+			sig, err = ioutil.ReadAll(tr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	if m == nil || sig == nil {
+		return nil, fmt.Errorf("%s: no signed manifest, not an update bundle", file)
+	}
+
+	digest := sha256.Sum256(m)
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, ErrBadSignature
+	}
+
+	b := &Bundle{file: file}
+	if err := yaml.Unmarshal(m, &b.Manifest); err != nil {
+		return nil, fmt.Errorf("%s: %v", manifestFile, err)
+	}
+	if b.Manifest.Format != Format {
+		return nil, fmt.Errorf("unsupported bundle format %d, expected %d", b.Manifest.Format, Format)
+	}
+	for _, f := range b.Manifest.Files {
+		if err := checkPath(f.Path); err != nil {
+			return nil, fmt.Errorf("%s: %v", manifestFile, err)
+		}
+	}
+
+	return b, nil
+}
+
+// checkPath checks that the manifest path p names a file of the recovery
+// partition, outside of the stage directory, whoever signed the manifest.
+func checkPath(p string) error {
+	if p == "" || path.IsAbs(p) || path.Clean(p) != p {
+		return fmt.Errorf("%q is not a clean relative path", p)
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == ".." {
+			return fmt.Errorf("%q is outside of the recovery partition", p)
+		}
+	}
+	if p == StageDir || strings.HasPrefix(p, StageDir+"/") {
+		return fmt.Errorf("%q is in the stage directory %s", p, StageDir)
+	}
+
+	return nil
+}
+
+// LoadPrivateKey reads a PEM encoded RSA private key, in PKCS #1 or
+// PKCS #8 form.
+func LoadPrivateKey(file string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA key", file)
+	}
+
+	return rsaKey, nil
+}
+
+// LoadPublicKey reads a PEM encoded RSA public key, in PKIX or PKCS #1
+// form.
+func LoadPublicKey(file string) (*rsa.PublicKey, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		var key rsa.PublicKey
+		if _, err := asn1.Unmarshal(block.Bytes, &key); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		return &key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA key", file)
+	}
+
+	return rsaKey, nil
+}
+
+func readPEM(file string) (*pem.Block, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", file)
+	}
+
+	return block, nil
+}
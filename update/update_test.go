@@ -0,0 +1,366 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package update
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Lyoncore/ubuntu-recovery-image/utils"
+)
+
+var testKey, otherKey *rsa.PrivateKey
+
+func init() {
+	var err error
+	if testKey, err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+		panic(err)
+	}
+	if otherKey, err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+		panic(err)
+	}
+}
+
+func randomData(seed int64, n int) []byte {
+	b := make([]byte, n)
+	mathrand.New(mathrand.NewSource(seed)).Read(b)
+	return b
+}
+
+func cat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	old := randomData(1, 5*deltaBlockSize+100)
+	for _, c := range []struct {
+		what     string
+		old, new []byte
+	}{
+		{"identical", old, old},
+		{"empty old", nil, old},
+		{"empty new", old, nil},
+		{"both empty", nil, nil},
+		{"appended", old, cat(old, randomData(2, 3000))},
+		{"inserted", old, cat(old[:2*deltaBlockSize+7], []byte("inserted"), old[2*deltaBlockSize+7:])},
+		{"moved blocks", old, cat(old[3*deltaBlockSize:], old[:3*deltaBlockSize])},
+		{"unrelated", old, randomData(3, 4*deltaBlockSize)},
+	} {
+		delta := Delta(c.old, c.new)
+		var out bytes.Buffer
+		if err := ApplyDelta(&out, bytes.NewReader(c.old), bytes.NewReader(delta)); err != nil {
+			t.Errorf("%s: %v", c.what, err)
+			continue
+		}
+		if !bytes.Equal(out.Bytes(), c.new) {
+			t.Errorf("%s: rebuilt %d bytes differing from the %d new ones", c.what, out.Len(), len(c.new))
+		}
+	}
+
+	// a delta of a file with an insertion copies most of the old blocks
+	if delta := Delta(old, cat([]byte("x"), old)); len(delta) > deltaBlockSize {
+		t.Errorf("delta of an insertion is %d bytes", len(delta))
+	}
+}
+
+func TestApplyDeltaBad(t *testing.T) {
+	delta := Delta([]byte("old"), []byte("new content"))
+	for _, c := range []struct {
+		what  string
+		delta []byte
+	}{
+		{"empty", nil},
+		{"bad magic", []byte("NOTADELTA\nE")},
+		{"no end", delta[:len(delta)-1]},
+		{"bad op", []byte(deltaMagic + "X")},
+		{"truncated insert", []byte(deltaMagic + "I\x10abc")},
+	} {
+		err := ApplyDelta(ioutil.Discard, bytes.NewReader([]byte("old")), bytes.NewReader(c.delta))
+		if err == nil {
+			t.Errorf("%s: no error", c.what)
+		}
+	}
+}
+
+type testFile struct {
+	path     string
+	old, new []byte
+	delta    bool
+	removed  bool
+}
+
+// writeBundle writes a bundle of files signed with key and returns its
+// path in dir.
+func writeBundle(t *testing.T, dir string, key *rsa.PrivateKey, files []testFile) string {
+	name := filepath.Join(dir, "update.bundle")
+	out, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	w := NewWriter(out, key, utils.BuildStamp{Output: "old.img"}, utils.BuildStamp{Output: "new.img"})
+	for _, tf := range files {
+		f := File{Path: tf.path}
+		if tf.old != nil {
+			f.Old = Sum(tf.old)
+		}
+		payload := tf.new
+		if !tf.removed {
+			f.New = Sum(tf.new)
+			f.Size = int64(len(tf.new))
+			if tf.delta {
+				f.Delta = true
+				payload = Delta(tf.old, tf.new)
+			}
+		}
+		if err := w.Add(f, bytes.NewReader(payload), int64(len(payload))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return name
+}
+
+func writeFiles(t *testing.T, root string, files map[string][]byte) {
+	for name, b := range files {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkFiles checks the content of the files of root, nil for a file
+// which must not exist.
+func checkFiles(t *testing.T, root string, files map[string][]byte) {
+	for name, want := range files {
+		got, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		switch {
+		case want == nil && !os.IsNotExist(err):
+			t.Errorf("%s: exists, want it removed (%v)", name, err)
+		case want == nil:
+		case err != nil:
+			t.Errorf("%s: %v", name, err)
+		case !bytes.Equal(got, want):
+			t.Errorf("%s: got %d bytes differing from the %d expected", name, len(got), len(want))
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, StageDir)); !os.IsNotExist(err) {
+		t.Errorf("%s left: %v", StageDir, err)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "update-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestApply(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+
+	oldBig := randomData(1, 4*deltaBlockSize)
+	newBig := cat(oldBig[:deltaBlockSize], []byte("patched"), oldBig[deltaBlockSize:])
+	writeFiles(t, root, map[string][]byte{
+		"untouched":          []byte("untouched"),
+		"boot/vmlinuz":       []byte("old kernel"),
+		"recovery/big.bin":   oldBig,
+		"factory/old-snap":   []byte("old snap"),
+		utils.BuildStampFile: []byte("old stamp"),
+	})
+
+	bundle := writeBundle(t, dir, testKey, []testFile{
+		{path: "boot/vmlinuz", old: []byte("old kernel"), new: []byte("new kernel")},
+		{path: "recovery/big.bin", old: oldBig, new: newBig, delta: true},
+		{path: "factory/old-snap", old: []byte("old snap"), removed: true},
+		{path: "factory/new/added", new: []byte("added")},
+		{path: utils.BuildStampFile, old: []byte("old stamp"), new: []byte("new stamp")},
+	})
+	b, err := ReadBundle(bundle, &testKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Manifest.From.Output != "old.img" || b.Manifest.To.Output != "new.img" || len(b.Manifest.Files) != 5 {
+		t.Errorf("unexpected manifest %+v", b.Manifest)
+	}
+
+	if err := b.Apply(root); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, root, map[string][]byte{
+		"untouched":          []byte("untouched"),
+		"boot/vmlinuz":       []byte("new kernel"),
+		"recovery/big.bin":   newBig,
+		"factory/old-snap":   nil,
+		"factory/new/added":  []byte("added"),
+		utils.BuildStampFile: []byte("new stamp"),
+	})
+
+	if err := b.Apply(root); err != ErrUpToDate {
+		t.Errorf("applied again: got %v, want ErrUpToDate", err)
+	}
+}
+
+func TestApplyMismatch(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	writeFiles(t, root, map[string][]byte{
+		"a": []byte("changed locally"),
+		"b": []byte("old b"),
+	})
+
+	bundle := writeBundle(t, dir, testKey, []testFile{
+		{path: "a", old: []byte("old a"), new: []byte("new a")},
+		{path: "b", old: []byte("old b"), new: []byte("new b")},
+	})
+	b, err := ReadBundle(bundle, &testKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Apply(root)
+	if e, ok := err.(*MismatchError); !ok || len(e.Files) != 1 || e.Files[0] != "a" {
+		t.Fatalf("got %v, want a mismatch of a", err)
+	}
+	checkFiles(t, root, map[string][]byte{
+		"a": []byte("changed locally"),
+		"b": []byte("old b"),
+	})
+}
+
+// TestRecover finishes an update interrupted while committing: the first
+// file is already renamed, the others are still staged.
+func TestRecover(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	stage := filepath.Join(root, StageDir)
+	writeFiles(t, root, map[string][]byte{
+		"done":          []byte("new done"),
+		"pending":       []byte("old pending"),
+		"removed":       []byte("removed"),
+		StageDir + "/1": []byte("new pending"),
+		StageDir + "/3": []byte("new added"),
+	})
+	j := journal{Files: []journalEntry{
+		{Path: "done", Staged: "0"},
+		{Path: "pending", Staged: "1"},
+		{Path: "removed"},
+		{Path: "dir/added", Staged: "3"},
+	}}
+	if err := writeJournal(stage, &j); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Recover(root); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, root, map[string][]byte{
+		"done":      []byte("new done"),
+		"pending":   []byte("new pending"),
+		"removed":   nil,
+		"dir/added": []byte("new added"),
+	})
+
+	// without a journal, the staged files of an update interrupted before
+	// committing are dropped
+	writeFiles(t, root, map[string][]byte{StageDir + "/0": []byte("staged")})
+	if err := Recover(root); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, root, map[string][]byte{"pending": []byte("new pending")})
+}
+
+func TestBadSignature(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	bundle := writeBundle(t, dir, otherKey, []testFile{{path: "a", new: []byte("a")}})
+	if _, err := ReadBundle(bundle, &testKey.PublicKey); err != ErrBadSignature {
+		t.Errorf("got %v, want ErrBadSignature", err)
+	}
+}
+
+func TestAddChecksPayload(t *testing.T) {
+	content := []byte("content")
+	for _, c := range []struct {
+		name    string
+		payload []byte
+		size    int64
+	}{
+		{"other content", []byte("other!!"), int64(len(content))},
+		{"short payload", content[:3], int64(len(content))},
+	} {
+		w := NewWriter(ioutil.Discard, testKey, utils.BuildStamp{}, utils.BuildStamp{})
+		f := File{Path: "a", New: Sum(content), Size: int64(len(content))}
+		if err := w.Add(f, bytes.NewReader(c.payload), c.size); err == nil {
+			t.Errorf("%s: no error", c.name)
+		}
+	}
+}
+
+func TestReadBundlePaths(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		path string
+		ok   bool
+	}{
+		{"a/b", true},
+		{"..a/b..", true},
+		{".updates", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"../etc/passwd", false},
+		{"a/../../etc/passwd", false},
+		{"a/..", false},
+		{"./a", false},
+		{"a//b", false},
+		{"a/", false},
+		{StageDir, false},
+		{StageDir + "/" + journalFile, false},
+	} {
+		bundle := writeBundle(t, dir, testKey, []testFile{{path: c.path, new: []byte("a")}})
+		_, err := ReadBundle(bundle, &testKey.PublicKey)
+		if c.ok && err != nil {
+			t.Errorf("%q: %v", c.path, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%q: accepted", c.path)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016-2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testData struct {
+	Bootloader string
+	RecoveryNR int
+}
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		file := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkFile(t *testing.T, file, want string) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(b) != want {
+		t.Errorf("%s: got %q, want %q", file, b, want)
+	}
+}
+
+func TestRenderTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+
+	writeTree(t, src, map[string]string{
+		"grub.cfg.tmpl":         "set recovery={{.RecoveryNR}}\n",
+		"boot/uEnv.txt.tmpl":    "bootloader={{.Bootloader}}\n",
+		"boot/plain.txt":        "{{.Bootloader}}\n",
+		"boot/tmpl.txt":         "not a template\n",
+		"boot/empty/.gitkeep":   "",
+		"boot/double.tmpl.tmpl": "{{.RecoveryNR}}",
+	})
+	if err := RenderTree(src, dst, testData{Bootloader: "u-boot", RecoveryNR: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the .tmpl suffix is stripped once, other files are copied as is
+	checkFile(t, filepath.Join(dst, "grub.cfg"), "set recovery=3\n")
+	checkFile(t, filepath.Join(dst, "boot/uEnv.txt"), "bootloader=u-boot\n")
+	checkFile(t, filepath.Join(dst, "boot/plain.txt"), "{{.Bootloader}}\n")
+	checkFile(t, filepath.Join(dst, "boot/tmpl.txt"), "not a template\n")
+	checkFile(t, filepath.Join(dst, "boot/double.tmpl"), "3")
+	checkFile(t, filepath.Join(dst, "boot/empty/.gitkeep"), "")
+	for _, name := range []string{"grub.cfg.tmpl", "boot/uEnv.txt.tmpl"} {
+		if _, err := os.Stat(filepath.Join(dst, name)); !os.IsNotExist(err) {
+			t.Errorf("%s: got %v, want no such file", name, err)
+		}
+	}
+}
+
+func TestRenderTreeMissingKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+
+	writeTree(t, src, map[string]string{"boot/uEnv.txt.tmpl": "a\nb={{.Missing}}\n"})
+
+	// a map has no fields to check, missingkey=error catches the typo
+	err = RenderTree(src, dst, map[string]string{"Bootloader": "grub"})
+	if err == nil || !strings.Contains(err.Error(), "uEnv.txt.tmpl:2:4") || !strings.Contains(err.Error(), `"Missing"`) {
+		t.Errorf("map: got %v", err)
+	}
+	err = RenderTree(src, dst, testData{})
+	if err == nil || !strings.Contains(err.Error(), "uEnv.txt.tmpl:2:4") {
+		t.Errorf("struct: got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "boot/uEnv.txt")); !os.IsNotExist(err) {
+		t.Errorf("uEnv.txt: got %v, want no such file", err)
+	}
+}
+
+func TestRenderTreeSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	first, second, dst := filepath.Join(dir, "first"), filepath.Join(dir, "second"), filepath.Join(dir, "dst")
+
+	writeTree(t, first, map[string]string{"boot/kernel.img": "kernel"})
+	writeTree(t, second, map[string]string{"boot/.keep": ""})
+	for _, l := range []struct{ root, target string }{{first, "kernel.img"}, {second, "kernel-2.img"}} {
+		if err := os.Symlink(l.target, filepath.Join(l.root, "boot/vmlinuz")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a later include directory replaces the symlink of an earlier one,
+	// links are copied as links and not followed
+	for _, src := range []string{first, second} {
+		if err := RenderTree(src, dst, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "boot/vmlinuz")); err != nil || target != "kernel-2.img" {
+		t.Errorf("got %q, %v, want kernel-2.img", target, err)
+	}
+	checkFile(t, filepath.Join(dst, "boot/kernel.img"), "kernel")
+}
@@ -25,6 +25,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"time"
@@ -44,14 +45,40 @@ type ProjectInfo struct {
 	CommitStamp time.Time
 }
 
+// SnapInfo is a snap put in the recovery partition.
+type SnapInfo struct {
+	// Type is the snap type: kernel, gadget, os or core.
+	Type     string
+	Name     string
+	Version  string
+	Revision string
+}
+
 type BuildStamp struct {
 	BuildDate   time.Time
 	BuildTool   ProjectInfo
 	BuildConfig ProjectInfo
+	// Variant is the variant of config.yaml the image is built from.
+	Variant string `yaml:",omitempty"`
+	// Output is the file name the image is built as.
+	Output string     `yaml:",omitempty"`
+	Snaps  []SnapInfo `yaml:",omitempty"`
+	// Refreshes is the history of the refreshes of the image, oldest first.
+	Refreshes []Refresh `yaml:",omitempty"`
+}
+
+// Refresh is a change of the recovery partition of a built image.
+type Refresh struct {
+	Date        time.Time
+	BuildTool   ProjectInfo
+	BuildConfig ProjectInfo
+	// Replaced lists the files or include directories replaced, as
+	// kernel.snap or local-includes.
+	Replaced []string
 }
 
-func ReadVersionFromPackageJson() string {
-	reader, err := os.Open("package.json")
+func ReadVersionFromPackageJson(dir string) string {
+	reader, err := os.Open(filepath.Join(dir, "package.json"))
 	if err != nil {
 		log.Fatal("Failed to open package.json")
 	}
@@ -67,8 +94,8 @@ func ReadVersionFromPackageJson() string {
 	return jsonObj["version"].(string)
 }
 
-func GetGitSha() string {
-	v, err := runError("git", "describe", "--always", "--dirty")
+func GetGitSha(dir string) string {
+	v, err := runError(dir, "git", "describe", "--always", "--dirty")
 	if err != nil {
 		return "unknown-dev"
 	}
@@ -79,8 +106,8 @@ func GetGitSha() string {
 	return string(v)
 }
 
-func CommitStamp() int64 {
-	bs, err := runError("git", "show", "-s", "--format=%ct")
+func CommitStamp(dir string) int64 {
+	bs, err := runError(dir, "git", "show", "-s", "--format=%ct")
 	if err != nil {
 		return time.Now().Unix()
 	}
@@ -88,8 +115,9 @@ func CommitStamp() int64 {
 	return s
 }
 
-func runError(cmd string, args ...string) ([]byte, error) {
+func runError(dir string, cmd string, args ...string) ([]byte, error) {
 	ecmd := exec.Command(cmd, args...)
+	ecmd.Dir = dir
 	bs, err := ecmd.CombinedOutput()
 	if err != nil {
 		return nil, err